@@ -7,6 +7,7 @@ package stun
 import (
 	"fmt"
 	"net"
+	"net/netip"
 )
 
 // An Addr represents a STUN transport address.
@@ -26,3 +27,15 @@ func (a *Addr) String() string {
 	}
 	return net.JoinHostPort(a.IP.String(), fmt.Sprintf("%d", a.Port))
 }
+
+// AddrPort returns the address as netip.AddrPort.
+// An IPv4-mapped IPv6 address is converted to an IPv4 address.
+func (a *Addr) AddrPort() netip.AddrPort {
+	ip, _ := netip.AddrFromSlice(a.IP)
+	return netip.AddrPortFrom(ip.Unmap(), uint16(a.Port))
+}
+
+// AddrFromAddrPort returns ap as Addr.
+func AddrFromAddrPort(ap netip.AddrPort) *Addr {
+	return &Addr{Port: int(ap.Port()), IP: net.IP(ap.Addr().AsSlice())}
+}
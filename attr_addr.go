@@ -8,6 +8,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"net"
+	"net/netip"
 )
 
 // An XORPeerAddr represents a STUN XOR-PEER-ADDRESS attribute.
@@ -18,6 +19,10 @@ func (xa *XORPeerAddr) Len() int {
 	return addrAttrLen(xa.IP)
 }
 
+func (xa *XORPeerAddr) addrPort() netip.AddrPort {
+	return (*Addr)(xa).AddrPort()
+}
+
 // An XORRelayedAddr represents a STUN XOR-RELAYED-ADDRESS attribute.
 type XORRelayedAddr Addr
 
@@ -26,6 +31,10 @@ func (xa *XORRelayedAddr) Len() int {
 	return addrAttrLen(xa.IP)
 }
 
+func (xa *XORRelayedAddr) addrPort() netip.AddrPort {
+	return (*Addr)(xa).AddrPort()
+}
+
 // An XORMappedAddr represents a STUN XOR-MAPPED-ADDRESS attribute.
 type XORMappedAddr Addr
 
@@ -34,6 +43,10 @@ func (xa *XORMappedAddr) Len() int {
 	return addrAttrLen(xa.IP)
 }
 
+func (xa *XORMappedAddr) addrPort() netip.AddrPort {
+	return (*Addr)(xa).AddrPort()
+}
+
 // An AlternateServer represents a STUN ALTERNATE-SERVER attribute.
 type AlternateServer Addr
 
@@ -42,6 +55,16 @@ func (as *AlternateServer) Len() int {
 	return addrAttrLen(as.IP)
 }
 
+func (as *AlternateServer) addrPort() netip.AddrPort {
+	return (*Addr)(as).AddrPort()
+}
+
+// An addrAttr represents an address attribute.
+type addrAttr interface {
+	Attribute
+	addrPort() netip.AddrPort
+}
+
 func addrAttrLen(ip net.IP) int {
 	l := 4
 	if ip.To4() != nil {
@@ -54,98 +77,269 @@ func addrAttrLen(ip net.IP) int {
 }
 
 func marshalAddrAttr(b []byte, t int, attr Attribute, tid []byte) error {
-	if len(b) < 4+attr.Len() {
+	ap := attr.(addrAttr).addrPort()
+	var ip [net.IPv6len]byte
+	port, family := int(ap.Port()), addrFamily(ap.Addr(), &ip)
+	if len(b) < 4 {
 		return errors.New("short buffer")
 	}
-	var port int
-	var ip net.IP
-	switch attr := attr.(type) {
-	case *XORPeerAddr:
-		port = attr.Port
-		ip = attr.IP
-	case *XORRelayedAddr:
-		port = attr.Port
-		ip = attr.IP
-	case *XORMappedAddr:
-		port = attr.Port
-		ip = attr.IP
-	case *AlternateServer:
-		port = attr.Port
-		ip = attr.IP
-	}
-	if ip4 := ip.To4(); ip4 != nil {
-		b[5] = 1
-		copy(b[8:], ip4)
-		switch t {
-		case attrXOR_PEER_ADDRESS, attrXOR_RELAYED_ADDRESS, attrXOR_MAPPED_ADDRESS:
-			for i := range b[8:12] {
-				b[8+i] ^= MagicCookie[i]
-			}
-		}
+	b[0] = 0
+	b[1] = byte(family)
+	binary.BigEndian.PutUint16(b[2:4], uint16(port))
+	switch family {
+	case 1:
+		copy(b[4:], ip[:net.IPv4len])
+	case 2:
+		copy(b[4:], ip[:])
 	}
-	if ip6 := ip.To16(); ip6 != nil && ip6.To4() == nil {
-		b[5] = 2
-		copy(b[8:], ip6)
-		if t == attrXOR_MAPPED_ADDRESS {
-			cookie := append(MagicCookie, tid...)
-			for i := range b[8:20] {
-				b[8+i] ^= cookie[i]
-			}
+	if isXORAddrAttr(t) {
+		if err := xorAddr(b, tid); err != nil {
+			return err
 		}
 	}
-	marshalAttrTypeLen(b, t, attr.Len())
-	binary.BigEndian.PutUint16(b[6:8], uint16(port))
-	switch t {
-	case attrXOR_PEER_ADDRESS, attrXOR_RELAYED_ADDRESS, attrXOR_MAPPED_ADDRESS:
-		b[6] ^= MagicCookie[0]
-		b[7] ^= MagicCookie[1]
-	}
 	return nil
 }
 
 func parseAddrAttr(b []byte, _, _ int, tid []byte, t, l int) (Attribute, error) {
-	if l-4 != net.IPv4len && l-4 != net.IPv6len {
-		return nil, errors.New("short attribute")
+	ap, err := parseAddrPort(b[:l], tid, t)
+	if err != nil {
+		return nil, err
 	}
+	a16 := ap.Addr().As16()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, a16[:])
+	port := int(ap.Port())
 	switch t {
 	case attrXOR_PEER_ADDRESS:
-		xa := XORPeerAddr{Port: int(binary.BigEndian.Uint16(b[2:4])), IP: make(net.IP, l-4)}
-		copy(xa.IP, b[4:l])
-		xa.Port, xa.IP = parseXORPortAddr(tid, xa.Port, xa.IP)
-		return &xa, nil
+		return &XORPeerAddr{Port: port, IP: ip}, nil
 	case attrXOR_RELAYED_ADDRESS:
-		xa := XORRelayedAddr{Port: int(binary.BigEndian.Uint16(b[2:4])), IP: make(net.IP, l-4)}
-		copy(xa.IP, b[4:l])
-		xa.Port, xa.IP = parseXORPortAddr(tid, xa.Port, xa.IP)
-		return &xa, nil
+		return &XORRelayedAddr{Port: port, IP: ip}, nil
 	case attrXOR_MAPPED_ADDRESS:
-		xa := XORMappedAddr{Port: int(binary.BigEndian.Uint16(b[2:4])), IP: make(net.IP, l-4)}
-		copy(xa.IP, b[4:l])
-		xa.Port, xa.IP = parseXORPortAddr(tid, xa.Port, xa.IP)
-		return &xa, nil
+		return &XORMappedAddr{Port: port, IP: ip}, nil
 	case attrALTERNATE_SERVER:
-		as := AlternateServer{Port: int(binary.BigEndian.Uint16(b[2:4])), IP: make(net.IP, net.IPv6len)}
-		copy(as.IP, net.IP(b[4:l]).To16())
-		return &as, nil
+		return &AlternateServer{Port: port, IP: ip}, nil
+	case attrMAPPED_ADDRESS:
+		return &MappedAddr{Port: port, IP: ip}, nil
+	case attrRESPONSE_ADDRESS:
+		return &ResponseAddr{Port: port, IP: ip}, nil
+	case attrSOURCE_ADDRESS:
+		return &SourceAddr{Port: port, IP: ip}, nil
+	case attrCHANGED_ADDRESS:
+		return &ChangedAddr{Port: port, IP: ip}, nil
+	case attrREFLECTED_FROM:
+		return &ReflectedFrom{Port: port, IP: ip}, nil
+	case attrRESPONSE_ORIGIN:
+		return &ResponseOrigin{Port: port, IP: ip}, nil
+	case attrOTHER_ADDRESS:
+		return &OtherAddr{Port: port, IP: ip}, nil
 	default:
 		return nil, errors.New("invalid attribute")
 	}
 }
 
-func parseXORPortAddr(tid []byte, port int, ip net.IP) (int, net.IP) {
-	port ^= int(binary.BigEndian.Uint16(MagicCookie[:2]))
-	if ip4 := ip.To4(); ip4 != nil {
-		for i := range ip4 {
-			ip4[i] ^= MagicCookie[i]
+// xorAddr XORs the port and address in b, the value of XOR address
+// attribute, with the magic cookie and transaction ID in place as
+// described in RFC 5389 section 15.2.
+// Every XOR address attribute shares the same encoding.
+func xorAddr(b, tid []byte) error {
+	b[2] ^= MagicCookie[0]
+	b[3] ^= MagicCookie[1]
+	switch len(b) {
+	case 4 + net.IPv4len:
+		for i := range b[4:] {
+			b[4+i] ^= MagicCookie[i]
+		}
+	case 4 + net.IPv6len:
+		if len(tid) != 12 {
+			return errors.New("invalid transaction ID")
+		}
+		for i := range b[4:8] {
+			b[4+i] ^= MagicCookie[i]
+		}
+		for i := range b[8:] {
+			b[8+i] ^= tid[i]
 		}
-		return port, ip4.To16()
 	}
-	if ip6 := ip.To16(); ip6 != nil && ip6.To4() == nil {
-		cookie := append(MagicCookie, tid...)
-		for i := range ip6 {
-			ip6[i] ^= cookie[i]
+	return nil
+}
+
+// addrFamily copies ip to dst and returns the address family; 1 for
+// IPv4 and 2 for IPv6.
+// An IPv4-mapped IPv6 address is treated as an IPv6 address.
+func addrFamily(ip netip.Addr, dst *[net.IPv6len]byte) int {
+	switch {
+	case ip.Is4():
+		a4 := ip.As4()
+		copy(dst[:], a4[:])
+		return 1
+	case ip.Is6():
+		*dst = ip.As16()
+		return 2
+	default:
+		return 0
+	}
+}
+
+// An XORPeerAddrPort represents a STUN XOR-PEER-ADDRESS attribute
+// using netip.AddrPort.
+// It is used in place of XORPeerAddr when FlagAddrPort is specified
+// for parsing.
+type XORPeerAddrPort struct {
+	netip.AddrPort
+}
+
+// Len implements the Len method of Attribute interface.
+func (xa XORPeerAddrPort) Len() int {
+	return addrPortAttrLen(xa.Addr())
+}
+
+func (xa XORPeerAddrPort) addrPort() netip.AddrPort {
+	return xa.AddrPort
+}
+
+// An XORRelayedAddrPort represents a STUN XOR-RELAYED-ADDRESS
+// attribute using netip.AddrPort.
+// It is used in place of XORRelayedAddr when FlagAddrPort is
+// specified for parsing.
+type XORRelayedAddrPort struct {
+	netip.AddrPort
+}
+
+// Len implements the Len method of Attribute interface.
+func (xa XORRelayedAddrPort) Len() int {
+	return addrPortAttrLen(xa.Addr())
+}
+
+func (xa XORRelayedAddrPort) addrPort() netip.AddrPort {
+	return xa.AddrPort
+}
+
+// An XORMappedAddrPort represents a STUN XOR-MAPPED-ADDRESS attribute
+// using netip.AddrPort.
+// It is used in place of XORMappedAddr when FlagAddrPort is specified
+// for parsing.
+type XORMappedAddrPort struct {
+	netip.AddrPort
+}
+
+// Len implements the Len method of Attribute interface.
+func (xa XORMappedAddrPort) Len() int {
+	return addrPortAttrLen(xa.Addr())
+}
+
+func (xa XORMappedAddrPort) addrPort() netip.AddrPort {
+	return xa.AddrPort
+}
+
+// An AlternateServerAddrPort represents a STUN ALTERNATE-SERVER
+// attribute using netip.AddrPort.
+// It is used in place of AlternateServer when FlagAddrPort is
+// specified for parsing.
+type AlternateServerAddrPort struct {
+	netip.AddrPort
+}
+
+// Len implements the Len method of Attribute interface.
+func (as AlternateServerAddrPort) Len() int {
+	return addrPortAttrLen(as.Addr())
+}
+
+func (as AlternateServerAddrPort) addrPort() netip.AddrPort {
+	return as.AddrPort
+}
+
+func addrPortAttrLen(ip netip.Addr) int {
+	switch {
+	case ip.Is4():
+		return 4 + net.IPv4len
+	case ip.Is6():
+		return 4 + net.IPv6len
+	default:
+		return 4
+	}
+}
+
+func isAddrAttr(t int) bool {
+	switch t {
+	case attrALTERNATE_SERVER, attrMAPPED_ADDRESS, attrRESPONSE_ADDRESS, attrSOURCE_ADDRESS, attrCHANGED_ADDRESS, attrREFLECTED_FROM, attrRESPONSE_ORIGIN, attrOTHER_ADDRESS:
+		return true
+	default:
+		return isXORAddrAttr(t)
+	}
+}
+
+func isXORAddrAttr(t int) bool {
+	switch t {
+	case attrXOR_PEER_ADDRESS, attrXOR_RELAYED_ADDRESS, attrXOR_MAPPED_ADDRESS:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseAddrPort parses b as the value of address attribute of type t
+// without allocating memory.
+// An IPv4 address family is decoded as an IPv4 address and an IPv6
+// address family is decoded as an IPv6 address, including an
+// IPv4-mapped IPv6 address.
+func parseAddrPort(b, tid []byte, t int) (netip.AddrPort, error) {
+	if !isAddrAttr(t) {
+		return netip.AddrPort{}, errors.New("invalid attribute")
+	}
+	var v [4 + net.IPv6len]byte
+	switch {
+	case len(b) == 4+net.IPv4len && b[1] == 1:
+	case len(b) == 4+net.IPv6len && b[1] == 2:
+	case len(b) != 4+net.IPv4len && len(b) != 4+net.IPv6len:
+		return netip.AddrPort{}, errors.New("short attribute")
+	default:
+		return netip.AddrPort{}, errors.New("invalid address family")
+	}
+	n := copy(v[:], b)
+	if isXORAddrAttr(t) {
+		if err := xorAddr(v[:n], tid); err != nil {
+			return netip.AddrPort{}, err
 		}
-		return port, ip6
 	}
-	return -1, nil
+	port := binary.BigEndian.Uint16(v[2:4])
+	if n == 4+net.IPv4len {
+		return netip.AddrPortFrom(netip.AddrFrom4([net.IPv4len]byte(v[4:8])), port), nil
+	}
+	return netip.AddrPortFrom(netip.AddrFrom16([net.IPv6len]byte(v[4:])), port), nil
+}
+
+func parseAddrPortAttr(b []byte, tid []byte, t, l int) (Attribute, error) {
+	if len(b) < l {
+		return nil, errors.New("short attribute")
+	}
+	ap, err := parseAddrPort(b[:l], tid, t)
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case attrXOR_PEER_ADDRESS:
+		return XORPeerAddrPort{ap}, nil
+	case attrXOR_RELAYED_ADDRESS:
+		return XORRelayedAddrPort{ap}, nil
+	case attrXOR_MAPPED_ADDRESS:
+		return XORMappedAddrPort{ap}, nil
+	case attrALTERNATE_SERVER:
+		return AlternateServerAddrPort{ap}, nil
+	case attrMAPPED_ADDRESS:
+		return MappedAddrPort{ap}, nil
+	case attrRESPONSE_ADDRESS:
+		return ResponseAddrPort{ap}, nil
+	case attrSOURCE_ADDRESS:
+		return SourceAddrPort{ap}, nil
+	case attrCHANGED_ADDRESS:
+		return ChangedAddrPort{ap}, nil
+	case attrREFLECTED_FROM:
+		return ReflectedFromAddrPort{ap}, nil
+	case attrRESPONSE_ORIGIN:
+		return ResponseOriginAddrPort{ap}, nil
+	case attrOTHER_ADDRESS:
+		return OtherAddrPort{ap}, nil
+	default:
+		return nil, errors.New("invalid attribute")
+	}
 }
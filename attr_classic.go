@@ -0,0 +1,205 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+// STUN attribute types defined in RFC 3489 and reserved in RFC 5389.
+const (
+	attrRESPONSE_ADDRESS = 0x0002 // RESPONSE-ADDRESS
+	attrSOURCE_ADDRESS   = 0x0004 // SOURCE-ADDRESS
+	attrCHANGED_ADDRESS  = 0x0005 // CHANGED-ADDRESS
+	attrREFLECTED_FROM   = 0x000B // REFLECTED-FROM
+)
+
+// A MappedAddr represents a STUN MAPPED-ADDRESS attribute.
+type MappedAddr Addr
+
+// Len implements the Len method of Attribute interface.
+func (ma *MappedAddr) Len() int {
+	return addrAttrLen(ma.IP)
+}
+
+func (ma *MappedAddr) addrPort() netip.AddrPort {
+	return (*Addr)(ma).AddrPort()
+}
+
+// A ResponseAddr represents a STUN RESPONSE-ADDRESS attribute.
+type ResponseAddr Addr
+
+// Len implements the Len method of Attribute interface.
+func (ra *ResponseAddr) Len() int {
+	return addrAttrLen(ra.IP)
+}
+
+func (ra *ResponseAddr) addrPort() netip.AddrPort {
+	return (*Addr)(ra).AddrPort()
+}
+
+// A SourceAddr represents a STUN SOURCE-ADDRESS attribute.
+type SourceAddr Addr
+
+// Len implements the Len method of Attribute interface.
+func (sa *SourceAddr) Len() int {
+	return addrAttrLen(sa.IP)
+}
+
+func (sa *SourceAddr) addrPort() netip.AddrPort {
+	return (*Addr)(sa).AddrPort()
+}
+
+// A ChangedAddr represents a STUN CHANGED-ADDRESS attribute.
+type ChangedAddr Addr
+
+// Len implements the Len method of Attribute interface.
+func (ca *ChangedAddr) Len() int {
+	return addrAttrLen(ca.IP)
+}
+
+func (ca *ChangedAddr) addrPort() netip.AddrPort {
+	return (*Addr)(ca).AddrPort()
+}
+
+// A ReflectedFrom represents a STUN REFLECTED-FROM attribute.
+type ReflectedFrom Addr
+
+// Len implements the Len method of Attribute interface.
+func (rf *ReflectedFrom) Len() int {
+	return addrAttrLen(rf.IP)
+}
+
+func (rf *ReflectedFrom) addrPort() netip.AddrPort {
+	return (*Addr)(rf).AddrPort()
+}
+
+// A MappedAddrPort represents a STUN MAPPED-ADDRESS attribute using
+// netip.AddrPort.
+type MappedAddrPort struct {
+	netip.AddrPort
+}
+
+// Len implements the Len method of Attribute interface.
+func (ma MappedAddrPort) Len() int {
+	return addrPortAttrLen(ma.Addr())
+}
+
+func (ma MappedAddrPort) addrPort() netip.AddrPort {
+	return ma.AddrPort
+}
+
+// A ResponseAddrPort represents a STUN RESPONSE-ADDRESS attribute
+// using netip.AddrPort.
+type ResponseAddrPort struct {
+	netip.AddrPort
+}
+
+// Len implements the Len method of Attribute interface.
+func (ra ResponseAddrPort) Len() int {
+	return addrPortAttrLen(ra.Addr())
+}
+
+func (ra ResponseAddrPort) addrPort() netip.AddrPort {
+	return ra.AddrPort
+}
+
+// A SourceAddrPort represents a STUN SOURCE-ADDRESS attribute using
+// netip.AddrPort.
+type SourceAddrPort struct {
+	netip.AddrPort
+}
+
+// Len implements the Len method of Attribute interface.
+func (sa SourceAddrPort) Len() int {
+	return addrPortAttrLen(sa.Addr())
+}
+
+func (sa SourceAddrPort) addrPort() netip.AddrPort {
+	return sa.AddrPort
+}
+
+// A ChangedAddrPort represents a STUN CHANGED-ADDRESS attribute using
+// netip.AddrPort.
+type ChangedAddrPort struct {
+	netip.AddrPort
+}
+
+// Len implements the Len method of Attribute interface.
+func (ca ChangedAddrPort) Len() int {
+	return addrPortAttrLen(ca.Addr())
+}
+
+func (ca ChangedAddrPort) addrPort() netip.AddrPort {
+	return ca.AddrPort
+}
+
+// A ReflectedFromAddrPort represents a STUN REFLECTED-FROM attribute
+// using netip.AddrPort.
+type ReflectedFromAddrPort struct {
+	netip.AddrPort
+}
+
+// Len implements the Len method of Attribute interface.
+func (rf ReflectedFromAddrPort) Len() int {
+	return addrPortAttrLen(rf.Addr())
+}
+
+func (rf ReflectedFromAddrPort) addrPort() netip.AddrPort {
+	return rf.AddrPort
+}
+
+// A ChangeRequest represents a STUN CHANGE-REQUEST attribute.
+type ChangeRequest uint32
+
+// Flags of CHANGE-REQUEST attribute.
+const (
+	ChangeRequestPort ChangeRequest = 0x02 // change port
+	ChangeRequestIP   ChangeRequest = 0x04 // change IP address
+)
+
+// NewChangeRequest returns a new CHANGE-REQUEST attribute.
+func NewChangeRequest(changeIP, changePort bool) ChangeRequest {
+	var cr ChangeRequest
+	if changeIP {
+		cr |= ChangeRequestIP
+	}
+	if changePort {
+		cr |= ChangeRequestPort
+	}
+	return cr
+}
+
+// Len implements the Len method of Attribute interface.
+func (_ ChangeRequest) Len() int {
+	return 4
+}
+
+// ChangeIP reports whether the change IP flag is set.
+func (cr ChangeRequest) ChangeIP() bool {
+	return cr&ChangeRequestIP != 0
+}
+
+// ChangePort reports whether the change port flag is set.
+func (cr ChangeRequest) ChangePort() bool {
+	return cr&ChangeRequestPort != 0
+}
+
+func marshalChangeRequestAttr(b []byte, t int, attr Attribute, _ []byte) error {
+	if len(b) < 4 {
+		return errors.New("short buffer")
+	}
+	binary.BigEndian.PutUint32(b[:4], uint32(attr.(ChangeRequest)))
+	return nil
+}
+
+func parseChangeRequestAttr(b []byte, min, max int, _ []byte, _, l int) (Attribute, error) {
+	if min > l || l > max || len(b) < l {
+		return nil, errors.New("short attribute")
+	}
+	return ChangeRequest(binary.BigEndian.Uint32(b[:4])), nil
+}
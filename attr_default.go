@@ -4,11 +4,9 @@
 
 package stun
 
-import "errors"
-
 // A DefaultAttr reprensents the default STUN attribute.
 // DefaultAttr is used for marshaling and parsing STUN attributes not
-// supported in the package.
+// supported in the package and not registered by RegisterAttribute.
 type DefaultAttr struct {
 	// Type specifies the attribute type.
 	Type int
@@ -26,11 +24,7 @@ func (da *DefaultAttr) Len() int {
 }
 
 func marshalDefaultAttr(b []byte, t int, attr Attribute, _ []byte) error {
-	if len(b) < 4+attr.Len() {
-		return errors.New("short buffer")
-	}
-	marshalAttrTypeLen(b, t, attr.Len())
-	copy(b[4:], attr.(*DefaultAttr).Data)
+	copy(b, attr.(*DefaultAttr).Data)
 	return nil
 }
 
@@ -21,13 +21,12 @@ func (ec *ECNCheck) Len() int {
 }
 
 func marshalECNCheckAttr(b []byte, t int, attr Attribute, _ []byte) error {
-	if len(b) < 4+4 {
+	if len(b) < 4 {
 		return errors.New("short buffer")
 	}
-	marshalAttrTypeLen(b, t, 4)
-	b[7] = byte(attr.(*ECNCheck).ECF & 0x03 << 1)
+	b[3] = byte(attr.(*ECNCheck).ECF & 0x03 << 1)
 	if attr.(*ECNCheck).V {
-		b[7] |= 0x01
+		b[3] |= 0x01
 	}
 	return nil
 }
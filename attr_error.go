@@ -7,6 +7,7 @@ package stun
 import (
 	"encoding/binary"
 	"errors"
+	"strconv"
 )
 
 // An Error represents a STUN ERROR-CODE attribute.
@@ -23,6 +24,28 @@ func (e *Error) Len() int {
 	return 4 + len(e.Reason)
 }
 
+// NewError returns a new STUN ERROR-CODE attribute with the error
+// code and its default reason phrase.
+func NewError(code int) *Error {
+	return &Error{Code: code, Reason: StatusText(code)}
+}
+
+// StatusText returns a reason phrase for the STUN error code.
+// It returns the empty string if the code is unknown.
+func StatusText(code int) string {
+	return statusTexts[code]
+}
+
+// Error implements the Error method of error interface.
+// It allows the STUN error code of an error response to be returned
+// as an error.
+func (e *Error) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return strconv.Itoa(e.Code) + " " + e.Reason
+}
+
 // Class returns the error class.
 func (e *Error) Class() int {
 	if e == nil {
@@ -40,12 +63,11 @@ func (e *Error) Number() int {
 }
 
 func marshalErrorAttr(b []byte, t int, attr Attribute, _ []byte) error {
-	if len(b) < 4+attr.Len() {
+	if len(b) < 4 {
 		return errors.New("short buffer")
 	}
-	marshalAttrTypeLen(b, t, attr.Len())
-	b[6], b[7] = byte(attr.(*Error).Class()), byte(attr.(*Error).Number())
-	copy(b[8:], attr.(*Error).Reason)
+	b[2], b[3] = byte(attr.(*Error).Class()), byte(attr.(*Error).Number())
+	copy(b[4:], attr.(*Error).Reason)
 	return nil
 }
 
@@ -70,11 +92,6 @@ func (ua UnknownAttrs) Len() int {
 }
 
 func marshalUnknownAttrs(b []byte, t int, attr Attribute, _ []byte) error {
-	if len(b) < 4+attr.Len() {
-		return errors.New("short buffer")
-	}
-	marshalAttrTypeLen(b, t, attr.Len())
-	b = b[4:]
 	for _, t := range attr.(UnknownAttrs) {
 		if len(b) < 2 {
 			return errors.New("short buffer")
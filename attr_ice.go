@@ -4,8 +4,6 @@
 
 package stun
 
-import "errors"
-
 // A Priority represents a STUN PRIORITY attribute.
 type Priority uint
 
@@ -22,11 +20,7 @@ func (_ *UseCandidate) Len() int {
 	return 0
 }
 
-func marshalUseCandidateAttr(b []byte, t int, _ Attribute, _ []byte) error {
-	if len(b) < 4 {
-		return errors.New("short buffer")
-	}
-	marshalAttrTypeLen(b, t, 0)
+func marshalUseCandidateAttr(_ []byte, _ int, _ Attribute, _ []byte) error {
 	return nil
 }
 
@@ -0,0 +1,108 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+// A ResponseOrigin represents a STUN RESPONSE-ORIGIN attribute.
+type ResponseOrigin Addr
+
+// Len implements the Len method of Attribute interface.
+func (ro *ResponseOrigin) Len() int {
+	return addrAttrLen(ro.IP)
+}
+
+func (ro *ResponseOrigin) addrPort() netip.AddrPort {
+	return (*Addr)(ro).AddrPort()
+}
+
+// An OtherAddr represents a STUN OTHER-ADDRESS attribute.
+type OtherAddr Addr
+
+// Len implements the Len method of Attribute interface.
+func (oa *OtherAddr) Len() int {
+	return addrAttrLen(oa.IP)
+}
+
+func (oa *OtherAddr) addrPort() netip.AddrPort {
+	return (*Addr)(oa).AddrPort()
+}
+
+// A ResponseOriginAddrPort represents a STUN RESPONSE-ORIGIN attribute
+// using netip.AddrPort.
+type ResponseOriginAddrPort struct {
+	netip.AddrPort
+}
+
+// Len implements the Len method of Attribute interface.
+func (ro ResponseOriginAddrPort) Len() int {
+	return addrPortAttrLen(ro.Addr())
+}
+
+func (ro ResponseOriginAddrPort) addrPort() netip.AddrPort {
+	return ro.AddrPort
+}
+
+// An OtherAddrPort represents a STUN OTHER-ADDRESS attribute using
+// netip.AddrPort.
+type OtherAddrPort struct {
+	netip.AddrPort
+}
+
+// Len implements the Len method of Attribute interface.
+func (oa OtherAddrPort) Len() int {
+	return addrPortAttrLen(oa.Addr())
+}
+
+func (oa OtherAddrPort) addrPort() netip.AddrPort {
+	return oa.AddrPort
+}
+
+// A ResponsePort represents a STUN RESPONSE-PORT attribute.
+type ResponsePort uint16
+
+// Len implements the Len method of Attribute interface.
+func (_ ResponsePort) Len() int {
+	return 4
+}
+
+// A Padding represents a STUN PADDING attribute.
+type Padding []byte
+
+// NewPadding returns a new PADDING attribute of which the length is n
+// rounded up to a multiple of 4 bytes, as required by RFC 5780
+// section 7.6.
+// The value of padding consists of zeros.
+func NewPadding(n int) Padding {
+	if n < 0 {
+		n = 0
+	}
+	return make(Padding, roundup(n))
+}
+
+// Len implements the Len method of Attribute interface.
+func (p Padding) Len() int {
+	return len(p)
+}
+
+func marshalResponsePortAttr(b []byte, t int, attr Attribute, _ []byte) error {
+	if len(b) < 4 {
+		return errors.New("short buffer")
+	}
+	binary.BigEndian.PutUint16(b[:2], uint16(attr.(ResponsePort)))
+	b[2], b[3] = 0, 0
+	return nil
+}
+
+func parseResponsePortAttr(b []byte, min, max int, _ []byte, _, l int) (Attribute, error) {
+	if min > l || l > max || len(b) < l {
+		return nil, errors.New("short attribute")
+	}
+	return ResponsePort(binary.BigEndian.Uint16(b[:2])), nil
+}
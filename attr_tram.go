@@ -35,17 +35,15 @@ func (pas PasswordAlgorithms) Len() int {
 }
 
 func marshalPasswordAlgosAttr(b []byte, t int, attr Attribute, _ []byte) error {
-	l := attr.Len()
-	if len(b) < l {
-		return errors.New("short buffer")
-	}
-	marshalAttrTypeLen(b, t, l)
-	b = b[4:]
 	for _, pa := range attr.(PasswordAlgorithms) {
+		l := roundup(pa.Len())
+		if len(b) < l {
+			return errors.New("short buffer")
+		}
 		binary.BigEndian.PutUint16(b[:2], uint16(pa.Number))
 		binary.BigEndian.PutUint16(b[2:4], uint16(len(pa.Params)))
 		copy(b[4:], pa.Params)
-		b = b[roundup(pa.Len()):]
+		b = b[l:]
 	}
 	return nil
 }
@@ -70,6 +68,12 @@ func parsePasswordAlgosAttr(b []byte, min, max int, _ []byte, _, l int) (Attribu
 	return pas, nil
 }
 
+// Password algorithm numbers.
+const (
+	PasswordAlgorithmMD5    = 0x0001 // MD5
+	PasswordAlgorithmSHA256 = 0x0002 // SHA256
+)
+
 // A PasswordAlgorithm represents a STUN PASSWORD-ALGORITHM attribute.
 type PasswordAlgorithm struct {
 	Number int    // algorithm number; 0x0001 for MD5, 0x0002 for SHA256
@@ -85,15 +89,13 @@ func (pa *PasswordAlgorithm) Len() int {
 }
 
 func marshalPasswordAlgoAttr(b []byte, t int, attr Attribute, _ []byte) error {
-	l := attr.Len()
-	if len(b) < l {
-		return errors.New("short buffer")
-	}
-	marshalAttrTypeLen(b, t, l)
 	if pa, ok := attr.(*PasswordAlgorithm); ok && pa != nil {
-		binary.BigEndian.PutUint16(b[4:6], uint16(pa.Number))
-		binary.BigEndian.PutUint16(b[6:8], uint16(len(pa.Params)))
-		copy(b[8:], pa.Params)
+		if len(b) < 4 {
+			return errors.New("short buffer")
+		}
+		binary.BigEndian.PutUint16(b[:2], uint16(pa.Number))
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(pa.Params)))
+		copy(b[4:], pa.Params)
 	}
 	return nil
 }
@@ -24,11 +24,10 @@ func (cn *ChannelNumber) Len() int {
 }
 
 func marshalChannelNumberAttr(b []byte, t int, attr Attribute, _ []byte) error {
-	if len(b) < 4+4 {
+	if len(b) < 4 {
 		return errors.New("short buffer")
 	}
-	marshalAttrTypeLen(b, t, 4)
-	binary.BigEndian.PutUint16(b[4:6], uint16(attr.(*ChannelNumber).Number))
+	binary.BigEndian.PutUint16(b[:2], uint16(attr.(*ChannelNumber).Number))
 	return nil
 }
 
@@ -72,11 +71,10 @@ func (af *RequestedAddrFamily) Len() int {
 }
 
 func marshalRequestedAddrFamilyAttr(b []byte, t int, attr Attribute, _ []byte) error {
-	if len(b) < 4+4 {
+	if len(b) < 4 {
 		return errors.New("short buffer")
 	}
-	marshalAttrTypeLen(b, t, 4)
-	b[4] = byte(attr.(*RequestedAddrFamily).ID)
+	b[0] = byte(attr.(*RequestedAddrFamily).ID)
 	return nil
 }
 
@@ -101,12 +99,11 @@ func (ep *EvenPort) Len() int {
 }
 
 func marshalEvenPortAttr(b []byte, t int, attr Attribute, _ []byte) error {
-	if len(b) < 4+1 {
+	if len(b) < 1 {
 		return errors.New("short buffer")
 	}
-	marshalAttrTypeLen(b, t, 1)
 	if attr.(*EvenPort).R {
-		b[4] |= 0x80
+		b[0] |= 0x80
 	}
 	return nil
 }
@@ -137,11 +134,10 @@ func (rt *RequestedTransport) Len() int {
 }
 
 func marshalRequestedTransportAttr(b []byte, t int, attr Attribute, _ []byte) error {
-	if len(b) < 4+4 {
+	if len(b) < 4 {
 		return errors.New("short buffer")
 	}
-	marshalAttrTypeLen(b, t, 4)
-	b[4] = byte(attr.(*RequestedTransport).Protocol)
+	b[0] = byte(attr.(*RequestedTransport).Protocol)
 	return nil
 }
 
@@ -160,11 +156,7 @@ func (_ *DontFragment) Len() int {
 	return 0
 }
 
-func marshalDontFragmentAttr(b []byte, t int, _ Attribute, _ []byte) error {
-	if len(b) < 4 {
-		return errors.New("short buffer")
-	}
-	marshalAttrTypeLen(b, t, 0)
+func marshalDontFragmentAttr(_ []byte, _ int, _ Attribute, _ []byte) error {
 	return nil
 }
 
@@ -24,6 +24,9 @@ func (ae *AttributeError) Error() string {
 	if ae == nil {
 		return "<nil>"
 	}
+	if name := attrName(ae.Type); name != "" {
+		return fmt.Sprintf("%#04x (%s): %s", ae.Type, name, ae.Err.Error())
+	}
 	return fmt.Sprintf("%#04x: %s", ae.Type, ae.Err.Error())
 }
 
@@ -40,12 +43,27 @@ type fingerprint struct {
 	off  int       // offset in a message
 }
 
-func marshalAttrs(b []byte, m *Control) ([]fingerprint, error) {
-	b = b[controlHeaderLen:]
-	off := controlHeaderLen
+// marshalAttrs appends the attributes of m to the message that starts
+// at b[start] and returns the extended buffer.
+// The offsets of fingerprints are relative to the start of message.
+func marshalAttrs(b []byte, start int, m *Control) ([]byte, [3]fingerprint, error) {
+	attrs := m.Attrs
+	if m.Flags&FlagStrict != 0 {
+		var err error
+		if attrs, err = strictAttrOrder(attrs); err != nil {
+			return b, [3]fingerprint{}, err
+		}
+	}
 	var fps [3]fingerprint
-	for _, attr := range m.Attrs {
-		t, fn := attrTypeMarshaler(attr)
+	for _, attr := range attrs {
+		t, fn, err := attrTypeMarshaler(attr)
+		if err != nil {
+			return b, fps, err
+		}
+		l := attr.Len()
+		n := len(b)
+		b = append(b, make([]byte, roundup(4+l))...)
+		off := n - start
 		switch t {
 		case attrMESSAGE_INTEGRITY:
 			if fps[0].attr == nil {
@@ -63,85 +81,45 @@ func marshalAttrs(b []byte, m *Control) ([]fingerprint, error) {
 				fps[2].off = off
 			}
 		}
-		if err := fn(b, t, attr, m.TID); err != nil {
-			return nil, &AttributeError{Type: t, Err: err}
+		marshalAttrTypeLen(b[n:], t, l)
+		if err := fn(b[n+4:n+4+l], t, attr, m.TID); err != nil {
+			return b, fps, &AttributeError{Type: t, Err: err}
 		}
-		l := roundup(4 + attr.Len())
-		b = b[l:]
-		off += l
 	}
-	return fps[:], nil
+	return b, fps, nil
 }
 
-func attrTypeMarshaler(attr Attribute) (int, func([]byte, int, Attribute, []byte) error) {
-	switch attr := attr.(type) {
-	case Username:
-		return attrUSERNAME, marshalStringAttr
-	case MessageIntegrity:
-		return attrMESSAGE_INTEGRITY, marshalBytesAttr
-	case MessageIntegritySHA256:
-		return attrMESSAGE_INTEGRITY_SHA256, marshalBytesAttr
-	case *Error:
-		return attrERROR_CODE, marshalErrorAttr
-	case UnknownAttrs:
-		return attrUNKNOWN_ATTRIBUTES, marshalUnknownAttrs
-	case *ChannelNumber:
-		return attrCHANNEL_NUMBER, marshalChannelNumberAttr
-	case Lifetime:
-		return attrLIFETIME, marshalDurationAttr
-	case *XORPeerAddr:
-		return attrXOR_PEER_ADDRESS, marshalAddrAttr
-	case Data:
-		return attrDATA, marshalBytesAttr
-	case Realm:
-		return attrREALM, marshalStringAttr
-	case Nonce:
-		return attrNONCE, marshalStringAttr
-	case *XORRelayedAddr:
-		return attrXOR_RELAYED_ADDRESS, marshalAddrAttr
-	case *RequestedAddrFamily:
-		return attrREQUESTED_ADDRESS_FAMILY, marshalRequestedAddrFamilyAttr
-	case *EvenPort:
-		return attrEVEN_PORT, marshalEvenPortAttr
-	case *RequestedTransport:
-		return attrREQUESTED_TRANSPORT, marshalRequestedTransportAttr
-	case *DontFragment:
-		return attrDONT_FRAGMENT, marshalDontFragmentAttr
-	case *XORMappedAddr:
-		return attrXOR_MAPPED_ADDRESS, marshalAddrAttr
-	case ReservationToken:
-		return attrRESERVATION_TOKEN, marshalBytesAttr
-	case Priority:
-		return attrPRIORITY, marshalUintAttr
-	case *UseCandidate:
-		return attrUSE_CANDIDATE, marshalUseCandidateAttr
-	case ConnectionID:
-		return attrCONNECTION_ID, marshalUintAttr
-	case Software:
-		return attrSOFTWARE, marshalStringAttr
-	case *AlternateServer:
-		return attrALTERNATE_SERVER, marshalAddrAttr
-	case Fingerprint:
-		return attrFINGERPRINT, marshalUintAttr
-	case ICEControlled:
-		return attrICE_CONTROLLED, marshalUint64Attr
-	case ICEControlling:
-		return attrICE_CONTROLLING, marshalUint64Attr
-	case *ECNCheck:
-		return attrECN_CHECK_STUN, marshalECNCheckAttr
-	case PasswordAlgorithms:
-		return attrPASSWORD_ALGORITHMS, marshalPasswordAlgosAttr
-	case *PasswordAlgorithm:
-		return attrPASSWORD_ALGORITHM, marshalPasswordAlgoAttr
-	case AlternateDomain:
-		return attrALTERNATE_DOMAIN, marshalStringAttr
-	case Origin:
-		return attrORIGIN, marshalStringAttr
-	case *DefaultAttr:
-		return attr.Type, marshalDefaultAttr
-	default:
-		panic(fmt.Sprintf("unknown attribute: %T", attr))
+// strictAttrOrder returns the list of attributes in which
+// MESSAGE-INTEGRITY, MESSAGE-INTEGRITY-SHA256 and FINGERPRINT
+// attributes are moved to the end in that order.
+func strictAttrOrder(attrs []Attribute) ([]Attribute, error) {
+	var fps [3]Attribute
+	ordered := make([]Attribute, 0, len(attrs))
+	for _, attr := range attrs {
+		var i int
+		switch attr.(type) {
+		case MessageIntegrity:
+			i = 0
+		case MessageIntegritySHA256:
+			i = 1
+		case Fingerprint:
+			i = 2
+		default:
+			ordered = append(ordered, attr)
+			continue
+		}
+		if fps[i] != nil {
+			t, _, _ := attrTypeMarshaler(attr)
+			return nil, &AttributeError{Type: t, Err: errors.New("duplicate attribute")}
+		}
+		fps[i] = attr
+	}
+	for _, attr := range fps {
+		if attr != nil {
+			ordered = append(ordered, attr)
+		}
 	}
+	return ordered, nil
 }
 
 func marshalAttrTypeLen(b []byte, t, l int) {
@@ -150,23 +128,19 @@ func marshalAttrTypeLen(b []byte, t, l int) {
 }
 
 func marshalStringAttr(b []byte, t int, attr Attribute, _ []byte) error {
-	if len(b) < 4+attr.Len() {
-		return errors.New("short buffer")
-	}
-	marshalAttrTypeLen(b, t, attr.Len())
 	switch t {
 	case attrUSERNAME:
-		copy(b[4:], attr.(Username))
+		copy(b, attr.(Username))
 	case attrREALM:
-		copy(b[4:], attr.(Realm))
+		copy(b, attr.(Realm))
 	case attrNONCE:
-		copy(b[4:], attr.(Nonce))
+		copy(b, attr.(Nonce))
 	case attrSOFTWARE:
-		copy(b[4:], attr.(Software))
+		copy(b, attr.(Software))
 	case attrALTERNATE_DOMAIN:
-		copy(b[4:], attr.(AlternateDomain))
+		copy(b, attr.(AlternateDomain))
 	case attrORIGIN:
-		copy(b[4:], attr.(Origin))
+		copy(b, attr.(Origin))
 	default:
 		return errors.New("invalid attribute")
 	}
@@ -174,19 +148,17 @@ func marshalStringAttr(b []byte, t int, attr Attribute, _ []byte) error {
 }
 
 func marshalBytesAttr(b []byte, t int, attr Attribute, _ []byte) error {
-	if len(b) < 4+attr.Len() {
-		return errors.New("short buffer")
-	}
-	marshalAttrTypeLen(b, t, attr.Len())
 	switch t {
 	case attrMESSAGE_INTEGRITY:
-		copy(b[4:], attr.(MessageIntegrity))
+		copy(b, attr.(MessageIntegrity))
 	case attrMESSAGE_INTEGRITY_SHA256:
-		copy(b[4:], attr.(MessageIntegritySHA256))
+		copy(b, attr.(MessageIntegritySHA256))
 	case attrDATA:
-		copy(b[4:], attr.(Data))
+		copy(b, attr.(Data))
 	case attrRESERVATION_TOKEN:
-		copy(b[4:], attr.(ReservationToken))
+		copy(b, attr.(ReservationToken))
+	case attrPADDING:
+		copy(b, attr.(Padding))
 	default:
 		return errors.New("invalid attribute")
 	}
@@ -194,10 +166,9 @@ func marshalBytesAttr(b []byte, t int, attr Attribute, _ []byte) error {
 }
 
 func marshalUintAttr(b []byte, t int, attr Attribute, _ []byte) error {
-	if len(b) < 4+4 {
+	if len(b) < 4 {
 		return errors.New("short buffer")
 	}
-	marshalAttrTypeLen(b, t, 4)
 	var v uint
 	switch t {
 	case attrPRIORITY:
@@ -209,15 +180,14 @@ func marshalUintAttr(b []byte, t int, attr Attribute, _ []byte) error {
 	default:
 		return errors.New("invalid attribute")
 	}
-	binary.BigEndian.PutUint32(b[4:8], uint32(v))
+	binary.BigEndian.PutUint32(b[:4], uint32(v))
 	return nil
 }
 
 func marshalUint64Attr(b []byte, t int, attr Attribute, _ []byte) error {
-	if len(b) < 4+8 {
+	if len(b) < 8 {
 		return errors.New("short buffer")
 	}
-	marshalAttrTypeLen(b, t, 8)
 	var v uint64
 	switch t {
 	case attrICE_CONTROLLED:
@@ -227,26 +197,25 @@ func marshalUint64Attr(b []byte, t int, attr Attribute, _ []byte) error {
 	default:
 		return errors.New("invalid attribute")
 	}
-	binary.BigEndian.PutUint64(b[4:12], v)
+	binary.BigEndian.PutUint64(b[:8], v)
 	return nil
 }
 
 func marshalDurationAttr(b []byte, t int, attr Attribute, _ []byte) error {
-	if len(b) < 4+4 {
+	if len(b) < 4 {
 		return errors.New("short buffer")
 	}
-	marshalAttrTypeLen(b, t, 4)
 	switch t {
 	case attrLIFETIME:
 		v := uint32(time.Duration(attr.(Lifetime)).Seconds())
-		binary.BigEndian.PutUint32(b[4:8], uint32(v))
+		binary.BigEndian.PutUint32(b[:4], uint32(v))
 	default:
 		return errors.New("invalid attribute")
 	}
 	return nil
 }
 
-func parseAttrs(b, tid []byte) ([]Attribute, []fingerprint, error) {
+func parseAttrs(b, tid []byte, flags Flags) ([]Attribute, []fingerprint, error) {
 	if len(b) == 0 {
 		return nil, nil, nil
 	}
@@ -260,8 +229,22 @@ func parseAttrs(b, tid []byte) ([]Attribute, []fingerprint, error) {
 		if err != nil {
 			return nil, nil, &AttributeError{Type: t, Err: err}
 		}
+		if flags&FlagStrict != 0 {
+			if fps[2].attr != nil {
+				return nil, nil, &AttributeError{Type: attrFINGERPRINT, Err: errors.New("not last attribute")}
+			}
+			if fps[1].attr != nil && t != attrFINGERPRINT || fps[0].attr != nil && t != attrMESSAGE_INTEGRITY_SHA256 && t != attrFINGERPRINT {
+				b = b[ll:]
+				off += ll
+				continue
+			}
+		}
 		var attr Attribute
-		if p, ok := parsers[t]; !ok {
+		if flags&flagLegacy != 0 && isXORAddrAttr(t) {
+			attr, err = parseDefaultAttr(b[4:4+l], -1, -1, tid, t, l)
+		} else if flags&FlagAddrPort != 0 && isAddrAttr(t) {
+			attr, err = parseAddrPortAttr(b[4:4+l], tid, t, l)
+		} else if p, ok := attrTypeParser(t); !ok {
 			attr, err = parseDefaultAttr(b[4:4+l], -1, -1, tid, t, l)
 		} else {
 			attr, err = p.fn(b[4:4+l], p.min, p.max, tid, t, l)
@@ -308,46 +291,6 @@ func parseAttrTypeLen(b []byte) (t, l, ll int, err error) {
 	return t, l, ll, nil
 }
 
-type parser struct {
-	fn  func([]byte, int, int, []byte, int, int) (Attribute, error)
-	min int
-	max int
-}
-
-var parsers = map[int]parser{
-	attrUSERNAME:                 {parseStringAttr, 0, 512},
-	attrMESSAGE_INTEGRITY:        {parseBytesAttr, 20, 20},
-	attrMESSAGE_INTEGRITY_SHA256: {parseBytesAttr, 32, 32},
-	attrERROR_CODE:               {parseErrorAttr, 4, 4 + 763},
-	attrUNKNOWN_ATTRIBUTES:       {parseUnknownAttrs, 0, 65535},
-	attrCHANNEL_NUMBER:           {parseChannelNumberAttr, 4, 4},
-	attrLIFETIME:                 {parseDurationAttr, 4, 4},
-	attrXOR_PEER_ADDRESS:         {parseAddrAttr, -1, -1},
-	attrDATA:                     {parseBytesAttr, 0, 65535},
-	attrREALM:                    {parseStringAttr, 0, 763},
-	attrNONCE:                    {parseStringAttr, 0, 763},
-	attrXOR_RELAYED_ADDRESS:      {parseAddrAttr, -1, -1},
-	attrREQUESTED_ADDRESS_FAMILY: {parseRequestedAddrFamilyAttr, 4, 4},
-	attrEVEN_PORT:                {parseEvenPortAttr, 1, 1},
-	attrREQUESTED_TRANSPORT:      {parseRequestedTransportAttr, 4, 4},
-	attrDONT_FRAGMENT:            {parseDontFragmentAttr, 0, 0},
-	attrXOR_MAPPED_ADDRESS:       {parseAddrAttr, -1, -1},
-	attrRESERVATION_TOKEN:        {parseBytesAttr, 8, 8},
-	attrPRIORITY:                 {parseUintAttr, 4, 4},
-	attrUSE_CANDIDATE:            {parseUseCandidateAttr, 0, 0},
-	attrCONNECTION_ID:            {parseUintAttr, 4, 4},
-	attrSOFTWARE:                 {parseStringAttr, 0, 763},
-	attrALTERNATE_SERVER:         {parseAddrAttr, -1, -1},
-	attrFINGERPRINT:              {parseUintAttr, 4, 4},
-	attrICE_CONTROLLED:           {parseUint64Attr, 8, 8},
-	attrICE_CONTROLLING:          {parseUint64Attr, 8, 8},
-	attrECN_CHECK_STUN:           {parseECNCheckAttr, 4, 4},
-	attrPASSWORD_ALGORITHMS:      {parsePasswordAlgosAttr, 0, 65535},
-	attrPASSWORD_ALGORITHM:       {parsePasswordAlgoAttr, 4, 65535},
-	attrALTERNATE_DOMAIN:         {parseStringAttr, 0, 763},
-	attrORIGIN:                   {parseStringAttr, 0, 65535},
-}
-
 func parseStringAttr(b []byte, min, max int, _ []byte, t, l int) (Attribute, error) {
 	if min > l || l > max || len(b) < l {
 		return nil, errors.New("short attribute")
@@ -390,6 +333,8 @@ func parseBytesAttr(b []byte, min, max int, _ []byte, t, l int) (Attribute, erro
 		v := make(ReservationToken, l)
 		copy(v, b)
 		return v, nil
+	case attrPADDING:
+		return Padding(b[:l]), nil
 	default:
 		return nil, errors.New("invalid attribute")
 	}
@@ -7,11 +7,13 @@ package stun
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -28,7 +30,7 @@ func TestParseFuzzAttribute(t *testing.T) {
 		if _, err := io.ReadFull(rand.Reader, b); err != nil {
 			t.Fatal(err)
 		}
-		if _, _, err := parseAttrs(b, attrTestTID); err != nil {
+		if _, _, err := parseAttrs(b, attrTestTID, 0); err != nil {
 			fmt.Fprintf(ioutil.Discard, "%v", err)
 		}
 	}
@@ -54,10 +56,17 @@ var marshalAndParseAttributeTests = []struct {
 				0x00, 0x01, 0xbe, 0xef,
 				0xc0, 0xa8, 0x00, 0x01,
 			}),
-		attr: &DefaultAttr{
-			Type: attrMAPPED_ADDRESS,
-			Data: []byte{0x00, 0x01, 0xbe, 0xef, 0xc0, 0xa8, 0x00, 0x01},
-		},
+		attr: &MappedAddr{Port: 0xbeef, IP: net.ParseIP("192.168.0.1")},
+	},
+
+	// RESPONSE-ADDRESS
+	{
+		wire: attrWireFormat(attrRESPONSE_ADDRESS, 4+net.IPv4len,
+			[]byte{
+				0x00, 0x01, 0xbe, 0xef,
+				0xc0, 0xa8, 0x00, 0x01,
+			}),
+		attr: &ResponseAddr{Port: 0xbeef, IP: net.ParseIP("192.168.0.1")},
 	},
 
 	// CHANGE-REQUEST
@@ -66,10 +75,27 @@ var marshalAndParseAttributeTests = []struct {
 			[]byte{
 				0x00, 0x00, 0x0, 0x06,
 			}),
-		attr: &DefaultAttr{
-			Type: attrCHANGE_REQUEST,
-			Data: []byte{0x00, 0x00, 0x0, 0x06},
-		},
+		attr: ChangeRequestIP | ChangeRequestPort,
+	},
+
+	// SOURCE-ADDRESS
+	{
+		wire: attrWireFormat(attrSOURCE_ADDRESS, 4+net.IPv4len,
+			[]byte{
+				0x00, 0x01, 0xbe, 0xef,
+				0xc0, 0xa8, 0x00, 0x01,
+			}),
+		attr: &SourceAddr{Port: 0xbeef, IP: net.ParseIP("192.168.0.1")},
+	},
+
+	// CHANGED-ADDRESS
+	{
+		wire: attrWireFormat(attrCHANGED_ADDRESS, 4+net.IPv4len,
+			[]byte{
+				0x00, 0x01, 0xbe, 0xef,
+				0xc0, 0xa8, 0x00, 0x01,
+			}),
+		attr: &ChangedAddr{Port: 0xbeef, IP: net.ParseIP("192.168.0.1")},
 	},
 
 	// USERNAME
@@ -137,6 +163,16 @@ var marshalAndParseAttributeTests = []struct {
 		attr: UnknownAttrs([]int{attrMAPPED_ADDRESS, attrCHANGE_REQUEST, attrUSERNAME}),
 	},
 
+	// REFLECTED-FROM
+	{
+		wire: attrWireFormat(attrREFLECTED_FROM, 4+net.IPv4len,
+			[]byte{
+				0x00, 0x01, 0xbe, 0xef,
+				0xc0, 0xa8, 0x00, 0x01,
+			}),
+		attr: &ReflectedFrom{Port: 0xbeef, IP: net.ParseIP("192.168.0.1")},
+	},
+
 	// CHANNEL-NUMBER
 	{
 		wire: attrWireFormat(attrCHANNEL_NUMBER, 4,
@@ -284,6 +320,25 @@ var marshalAndParseAttributeTests = []struct {
 		attr: &UseCandidate{},
 	},
 
+	// PADDING
+	{
+		wire: attrWireFormat(attrPADDING, 8,
+			[]byte{
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+			}),
+		attr: NewPadding(5),
+	},
+
+	// RESPONSE-PORT
+	{
+		wire: attrWireFormat(attrRESPONSE_PORT, 4,
+			[]byte{
+				0xbe, 0xef, 0x00, 0x00,
+			}),
+		attr: ResponsePort(0xbeef),
+	},
+
 	// CONNECTION-ID
 	{
 		wire: attrWireFormat(attrCONNECTION_ID, 4,
@@ -347,6 +402,29 @@ var marshalAndParseAttributeTests = []struct {
 		attr: ICEControlling(0x12345678deadbeef),
 	},
 
+	// RESPONSE-ORIGIN
+	{
+		wire: attrWireFormat(attrRESPONSE_ORIGIN, 4+net.IPv4len,
+			[]byte{
+				0x00, 0x01, 0xbe, 0xef,
+				0xc0, 0xa8, 0x00, 0x01,
+			}),
+		attr: &ResponseOrigin{Port: 0xbeef, IP: net.ParseIP("192.168.0.1")},
+	},
+
+	// OTHER-ADDRESS
+	{
+		wire: attrWireFormat(attrOTHER_ADDRESS, 4+net.IPv6len,
+			[]byte{
+				0x00, 0x02, 0xbe, 0xef,
+				0x20, 0x01, 0x0d, 0xb8,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x01,
+			}),
+		attr: &OtherAddr{Port: 0xbeef, IP: net.ParseIP("2001:db8::1")},
+	},
+
 	// ECN-CHECK
 	{
 		wire: attrWireFormat(attrECN_CHECK_STUN, 4,
@@ -416,9 +494,10 @@ var marshalAndParseAttributeTests = []struct {
 func TestMarshalAndParseAttribute(t *testing.T) {
 	var allAttrs []Attribute
 	for i, tt := range marshalAndParseAttributeTests {
-		b := make([]byte, 256)
+		b := make([]byte, controlHeaderLen, 256)
 		m := Control{Attrs: []Attribute{tt.attr}}
-		if _, err := marshalAttrs(b, &m); err != nil {
+		b, _, err := marshalAttrs(b, 0, &m)
+		if err != nil {
 			t.Errorf("#%d: %v", i, err)
 			continue
 		}
@@ -428,7 +507,7 @@ func TestMarshalAndParseAttribute(t *testing.T) {
 			t.Errorf("#%d: got %#v; want %#v", i, b, tt.wire)
 			continue
 		}
-		attrs, _, err := parseAttrs(b, attrTestTID)
+		attrs, _, err := parseAttrs(b, attrTestTID, 0)
 		if err != nil {
 			t.Errorf("#%d: %v", i, err)
 			continue
@@ -443,12 +522,190 @@ func TestMarshalAndParseAttribute(t *testing.T) {
 	for _, attr := range allAttrs {
 		l += roundup(4 + attr.Len())
 	}
-	b := make([]byte, l)
 	m := Control{Cookie: MagicCookie, TID: attrTestTID, Attrs: allAttrs}
-	if _, err := marshalAttrs(b, &m); err != nil {
+	b, _, err := marshalAttrs(make([]byte, controlHeaderLen), 0, &m)
+	if err != nil {
 		t.Error(err)
 	}
-	if _, _, err := parseAttrs(b[controlHeaderLen:], attrTestTID); err != nil {
+	if len(b) != l {
+		t.Errorf("got %d; want %d", len(b), l)
+	}
+	if _, _, err := parseAttrs(b[controlHeaderLen:], attrTestTID, 0); err != nil {
 		t.Error(err)
 	}
 }
+
+type testVendorAttr struct {
+	Flags uint16
+	Text  string
+}
+
+func (va *testVendorAttr) Len() int {
+	if va == nil {
+		return 0
+	}
+	return 2 + len(va.Text)
+}
+
+func (va *testVendorAttr) MarshalAttr(b, _ []byte) error {
+	binary.BigEndian.PutUint16(b[:2], va.Flags)
+	copy(b[2:], va.Text)
+	return nil
+}
+
+func (va *testVendorAttr) ParseAttr(b, _ []byte) error {
+	if len(b) < 2 {
+		return errors.New("short attribute")
+	}
+	va.Flags = binary.BigEndian.Uint16(b[:2])
+	va.Text = string(b[2:])
+	return nil
+}
+
+type testDraftAttr uint32
+
+func (_ testDraftAttr) Len() int {
+	return 4
+}
+
+// unregisterAttribute removes the STUN attribute type t and the
+// dynamic type of attr from the registry.
+func unregisterAttribute(t int, attr Attribute) {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.parsers, t)
+	delete(registry.marshalers, reflect.TypeOf(attr))
+}
+
+func TestRegisterAttribute(t *testing.T) {
+	t.Cleanup(func() {
+		unregisterAttribute(0xc0f0, new(testVendorAttr))
+		unregisterAttribute(0x7ff0, testDraftAttr(0))
+	})
+	if err := RegisterAttribute(0xc0f0, "TEST-VENDOR", func() Attribute { return new(testVendorAttr) }, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterAttribute(0x7ff0, "TEST-DRAFT", func() Attribute { return testDraftAttr(0) },
+		func(b []byte, attr Attribute, _ []byte) error {
+			binary.BigEndian.PutUint32(b, uint32(attr.(testDraftAttr)))
+			return nil
+		},
+		func(b, _ []byte) (Attribute, error) {
+			if len(b) != 4 {
+				return nil, errors.New("short attribute")
+			}
+			return testDraftAttr(binary.BigEndian.Uint32(b)), nil
+		}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		t    int
+		attr Attribute
+	}{
+		{0xc0f0, new(testVendorAttr)},       // type already registered
+		{0xc0f1, new(testVendorAttr)},       // Go type already registered
+		{attrUSERNAME, new(testVendorAttr)}, // built-in attribute
+		{0xc0f2, testDraftAttr(0)},          // Go type already registered
+		{0xc0f3, Nonce("")},                 // built-in attribute
+		{0xc0f4, &DefaultAttr{}},            // default attribute
+		{0x10000, new(testVendorAttr)},      // out of range
+	} {
+		if err := RegisterAttribute(tt.t, "", func() Attribute { return tt.attr }, nil, nil); err == nil {
+			t.Errorf("%#x, %T: got nil; want error", tt.t, tt.attr)
+		}
+	}
+
+	err := RegisterAttribute(0xc0f0, "", func() Attribute { return new(testVendorAttr) }, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "TEST-VENDOR") {
+		t.Errorf("got %v; want error containing TEST-VENDOR", err)
+	}
+	if s := (&AttributeError{Type: 0x7ff0, Err: errors.New("short attribute")}).Error(); s != "0x7ff0 (TEST-DRAFT): short attribute" {
+		t.Errorf("got %q; want 0x7ff0 (TEST-DRAFT): short attribute", s)
+	}
+
+	attrs := []Attribute{
+		&testVendorAttr{Flags: 0xbeef, Text: "vendor"},
+		testDraftAttr(0x12345678),
+		Software("test"),
+		Fingerprint(0),
+	}
+	m := Control{Type: MessageType(ClassRequest, MethodBinding), TID: attrTestTID, Attrs: attrs}
+	b := make([]byte, m.Len())
+	n, err := m.Marshal(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, mm, err := ParseMessage(b[:n], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mm.(*Control).Attrs[:3], attrs[:3]) {
+		t.Fatalf("got %#v; want %#v", mm.(*Control).Attrs[:3], attrs[:3])
+	}
+}
+
+type testUnregisteredAttr struct{}
+
+func (_ *testUnregisteredAttr) Len() int {
+	return 0
+}
+
+func TestMarshalUnknownAttribute(t *testing.T) {
+	m := Control{Type: MessageType(ClassRequest, MethodBinding), Attrs: []Attribute{&testUnregisteredAttr{}}}
+	b := make([]byte, m.Len())
+	if _, err := m.Marshal(b, nil); err == nil {
+		t.Fatal("got nil; want error")
+	}
+}
+
+func TestChangeRequest(t *testing.T) {
+	for _, tt := range []struct {
+		changeIP, changePort bool
+		cr                   ChangeRequest
+	}{
+		{false, false, 0},
+		{true, false, ChangeRequestIP},
+		{false, true, ChangeRequestPort},
+		{true, true, ChangeRequestIP | ChangeRequestPort},
+	} {
+		cr := NewChangeRequest(tt.changeIP, tt.changePort)
+		if cr != tt.cr || cr.ChangeIP() != tt.changeIP || cr.ChangePort() != tt.changePort {
+			t.Errorf("got %#x, %v, %v; want %#x, %v, %v", cr, cr.ChangeIP(), cr.ChangePort(), tt.cr, tt.changeIP, tt.changePort)
+		}
+	}
+}
+
+type testCountingAttr struct {
+	n *int // number of calls to Len
+}
+
+func (ca testCountingAttr) Len() int {
+	*ca.n++
+	return 3
+}
+
+func (ca testCountingAttr) MarshalAttr(b, _ []byte) error {
+	copy(b, "abc")
+	return nil
+}
+
+func (ca testCountingAttr) ParseAttr(_, _ []byte) error {
+	return nil
+}
+
+func TestMarshalAttrLen(t *testing.T) {
+	if err := RegisterAttribute(0xc0f8, "TEST-COUNTING", func() Attribute { return testCountingAttr{} }, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unregisterAttribute(0xc0f8, testCountingAttr{}) })
+	var n int
+	m := Control{Type: MessageType(ClassRequest, MethodBinding), TID: attrTestTID, Attrs: []Attribute{testCountingAttr{&n}}}
+	b, err := m.AppendMarshal(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(b) != controlHeaderLen+8 {
+		t.Fatalf("got %d calls, %d bytes; want 1 call, %d bytes", n, len(b), controlHeaderLen+8)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// Errors returned by Authenticator.
+var (
+	// ErrUnauthorized is returned when a server rejects the
+	// request carrying the long-term credential with the STUN
+	// error code 401.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrWrongCredentials is returned when a server responds with
+	// the STUN error code 441.
+	ErrWrongCredentials = errors.New("wrong credentials")
+
+	// ErrNoPasswordAlgorithm is returned when none of the
+	// password algorithms offered by a server is supported.
+	ErrNoPasswordAlgorithm = errors.New("no supported password algorithm")
+)
+
+// maxAuthAttempts is the maximum number of requests sent by a single
+// call to Do method of Authenticator.
+const maxAuthAttempts = 4
+
+// An Authenticator represents a client side state machine of the
+// long-term credential mechanism as described in RFC 8489 section
+// 9.2.
+//
+// An Authenticator runs transactions over Transport. When the server
+// challenges a request with the STUN error code 401, the
+// Authenticator retries the request with USERNAME, REALM, NONCE and
+// MESSAGE-INTEGRITY or MESSAGE-INTEGRITY-SHA256 attributes. When the
+// server responds with the STUN error code 438, it retries the
+// request with the new nonce.
+//
+// The realm, nonce and password algorithm learned from a server are
+// cached per server and used for subsequent requests to the server.
+// A server is identified by the RemoteAddr method of the transport,
+// such as the one of Client; DoVia runs transactions with other
+// servers than Transport.
+//
+// Multiple goroutines may invoke methods on an Authenticator
+// simultaneously.
+type Authenticator struct {
+	Transport RoundTripper // transport to the server
+	Username  string       // username
+	Password  string       // password
+
+	mu     sync.Mutex
+	states map[string]authState // keyed by server
+}
+
+type authState struct {
+	realm Realm
+	nonce Nonce
+	algo  int                // selected password algorithm
+	algos PasswordAlgorithms // password algorithms offered by server
+}
+
+// Do sends the request req with the long-term credential and returns
+// the response.
+// The request req is not modified.
+//
+// A success response that carries MESSAGE-INTEGRITY or
+// MESSAGE-INTEGRITY-SHA256 attribute is verified with the key.
+// An error response with the STUN error code 401 to the request
+// carrying the credential fails with ErrUnauthorized, and the one
+// with the STUN error code 441 fails with ErrWrongCredentials. Other
+// error responses are returned without error.
+func (a *Authenticator) Do(ctx context.Context, req *Control) (*Control, error) {
+	return a.DoVia(ctx, a.Transport, req)
+}
+
+// DoVia is like Do but runs the transactions over t instead of
+// Transport.
+func (a *Authenticator) DoVia(ctx context.Context, t RoundTripper, req *Control) (*Control, error) {
+	server := serverKey(t)
+	var challenged bool // received a challenge during this call
+	var resp *Control
+	for i := 0; i < maxAuthAttempts; i++ {
+		st := a.state(server)
+		r, k := a.request(req, &st)
+		var err error
+		resp, err = t.RoundTrip(ctx, r, k)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Type.Class() == ClassSuccessResponse {
+			if k != nil && (Has[MessageIntegrity](resp) || Has[MessageIntegritySHA256](resp)) {
+				if err := resp.VerifyIntegrity(k); err != nil {
+					return nil, err
+				}
+			}
+			return resp, nil
+		}
+		e, ok := Get[*Error](resp)
+		if resp.Type.Class() != ClassErrorResponse || !ok {
+			return resp, nil
+		}
+		switch e.Code {
+		case StatusUnauthorized:
+			if k != nil && challenged {
+				return nil, &MessageError{Type: resp.Type, Err: ErrUnauthorized}
+			}
+			challenged = true
+		case StatusStaleNonce:
+			challenged = true
+		case StatusWrongCredentials:
+			return nil, &MessageError{Type: resp.Type, Err: ErrWrongCredentials}
+		default:
+			return resp, nil
+		}
+		if err := a.update(server, resp, e.Code, &st); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// Key returns the key derived from the realm and password algorithm
+// cached for the server of Transport.
+// It returns nil when the Authenticator has not been challenged yet.
+func (a *Authenticator) Key() Key {
+	st := a.state(serverKey(a.Transport))
+	if st.realm == "" {
+		return nil
+	}
+	return &LongTermKey{Username: a.Username, Realm: string(st.realm), Password: a.Password, Algorithm: st.algo}
+}
+
+// request returns a copy of req with the credential attributes in st
+// and the key for the copy.
+func (a *Authenticator) request(req *Control, st *authState) (*Control, Key) {
+	r := &Control{Type: req.Type, Cookie: req.Cookie, Attrs: make([]Attribute, 0, len(req.Attrs)+6)}
+	for _, attr := range req.Attrs {
+		switch attr.(type) {
+		case Username, Realm, Nonce, *PasswordAlgorithm, PasswordAlgorithms, MessageIntegrity, MessageIntegritySHA256:
+		default:
+			r.Attrs = append(r.Attrs, attr)
+		}
+	}
+	if st.realm == "" {
+		return r, nil
+	}
+	r.Add(Username(a.Username))
+	r.Add(st.realm)
+	r.Add(st.nonce)
+	if st.algos != nil {
+		r.Add(&PasswordAlgorithm{Number: st.algo})
+		r.Add(st.algos)
+		r.Add(MessageIntegritySHA256(nil))
+	} else {
+		r.Add(MessageIntegrity(nil))
+	}
+	return r, &LongTermKey{Username: a.Username, Realm: string(st.realm), Password: a.Password, Algorithm: st.algo}
+}
+
+func (a *Authenticator) state(server string) authState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.states[server]
+}
+
+// update updates st and the state cached for the server with the
+// REALM, NONCE and PASSWORD-ALGORITHMS attributes of the error
+// response resp with the STUN error code.
+func (a *Authenticator) update(server string, resp *Control, code int, st *authState) error {
+	if realm, ok := Get[Realm](resp); ok {
+		st.realm = realm
+	}
+	nonce, ok := Get[Nonce](resp)
+	if !ok || st.realm == "" {
+		return &MessageError{Type: resp.Type, Err: errors.New("missing realm or nonce")}
+	}
+	st.nonce = nonce
+	algos, ok := Get[PasswordAlgorithms](resp)
+	switch {
+	case ok:
+		st.algo = 0
+		for _, pa := range algos {
+			if pa.Number == PasswordAlgorithmMD5 || pa.Number == PasswordAlgorithmSHA256 {
+				st.algo = pa.Number
+				break
+			}
+		}
+		if st.algo == 0 {
+			return &MessageError{Type: resp.Type, Err: ErrNoPasswordAlgorithm}
+		}
+		st.algos = algos
+	case code == StatusUnauthorized:
+		st.algo, st.algos = 0, nil
+	}
+	a.mu.Lock()
+	if a.states == nil {
+		a.states = make(map[string]authState)
+	}
+	a.states[server] = *st
+	a.mu.Unlock()
+	return nil
+}
+
+// serverKey returns the key of the state cached for the server at
+// the other end of t.
+func serverKey(t RoundTripper) string {
+	if t, ok := t.(interface{ RemoteAddr() net.Addr }); ok {
+		if addr := t.RemoteAddr(); addr != nil {
+			return addr.Network() + " " + addr.String()
+		}
+	}
+	return ""
+}
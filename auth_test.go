@@ -0,0 +1,172 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/mikioh/stun"
+)
+
+// authServer is an in-memory long-term credential server.
+type authServer struct {
+	addr     net.Addr
+	realm    string
+	nonce    string
+	password string
+	algos    stun.PasswordAlgorithms // offered when non-nil
+	code     int                     // error code for the request carrying the credential, if non-zero
+	requests int
+}
+
+func (s *authServer) RoundTrip(ctx context.Context, req *stun.Control, k stun.Key) (*stun.Control, error) {
+	s.requests++
+	b, err := req.AppendMarshal(nil, k)
+	if err != nil {
+		return nil, err
+	}
+	_, m, err := stun.ParseMessage(b, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, rk := s.serve(m.(*stun.Control))
+	resp.TID = req.TID
+	b, err = resp.AppendMarshal(nil, rk)
+	if err != nil {
+		return nil, err
+	}
+	_, m, err = stun.ParseMessage(b, nil)
+	if err != nil {
+		return nil, err
+	}
+	return m.(*stun.Control), nil
+}
+
+func (s *authServer) RemoteAddr() net.Addr {
+	return s.addr
+}
+
+func (s *authServer) serve(req *stun.Control) (*stun.Control, stun.Key) {
+	challenge := func(code int) *stun.Control {
+		resp := stun.ErrorResponse(req, code)
+		resp.Add(stun.Realm(s.realm))
+		resp.Add(stun.Nonce(s.nonce))
+		if s.algos != nil {
+			resp.Add(s.algos)
+		}
+		return resp
+	}
+	username, ok := stun.Get[stun.Username](req)
+	if !ok {
+		return challenge(stun.StatusUnauthorized), nil
+	}
+	if nonce, _ := stun.Get[stun.Nonce](req); string(nonce) != s.nonce {
+		return challenge(stun.StatusStaleNonce), nil
+	}
+	k := &stun.LongTermKey{Username: string(username), Realm: s.realm, Password: s.password}
+	if pa, ok := stun.Get[*stun.PasswordAlgorithm](req); ok {
+		k.Algorithm = pa.Number
+		if !stun.Has[stun.MessageIntegritySHA256](req) {
+			return challenge(stun.StatusBadRequest), nil
+		}
+	}
+	if err := req.VerifyIntegrity(k); err != nil {
+		return challenge(stun.StatusUnauthorized), nil
+	}
+	if s.code != 0 {
+		return stun.ErrorResponse(req, s.code), nil
+	}
+	resp := bindingResponse(req)
+	if k.Algorithm != 0 {
+		resp.Add(stun.MessageIntegritySHA256(nil))
+	} else {
+		resp.Add(stun.MessageIntegrity(nil))
+	}
+	return resp, k
+}
+
+func TestAuthenticator(t *testing.T) {
+	for i, algos := range []stun.PasswordAlgorithms{
+		nil,
+		{{Number: stun.PasswordAlgorithmSHA256}, {Number: stun.PasswordAlgorithmMD5}},
+		{{Number: 0x00ff}, {Number: stun.PasswordAlgorithmMD5}},
+	} {
+		s := &authServer{realm: "example.org", nonce: "nonce-1", password: "secret", algos: algos}
+		a := &stun.Authenticator{Transport: s, Username: "user", Password: "secret"}
+		req := newBindingRequest()
+		resp, err := a.Do(context.Background(), req)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if resp.Type.Class() != stun.ClassSuccessResponse || s.requests != 2 {
+			t.Fatalf("#%d: got %v after %d requests; want success after 2 requests", i, resp.Type, s.requests)
+		}
+		if len(req.Attrs) != 0 {
+			t.Fatalf("#%d: request modified: %v", i, req.Attrs)
+		}
+
+		// The cached realm and nonce are used without a challenge.
+		s.requests = 0
+		if _, err := a.Do(context.Background(), newBindingRequest()); err != nil || s.requests != 1 {
+			t.Fatalf("#%d: got %v after %d requests; want nil after 1 request", i, err, s.requests)
+		}
+
+		// A stale nonce is refreshed.
+		s.requests, s.nonce = 0, "nonce-2"
+		if _, err := a.Do(context.Background(), newBindingRequest()); err != nil || s.requests != 2 {
+			t.Fatalf("#%d: got %v after %d requests; want nil after 2 requests", i, err, s.requests)
+		}
+		if a.Key() == nil {
+			t.Fatalf("#%d: no key", i)
+		}
+	}
+}
+
+func TestAuthenticatorServers(t *testing.T) {
+	servers := []*authServer{
+		{addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}, realm: "example.org", nonce: "nonce-1", password: "secret"},
+		{addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 3478}, realm: "example.net", nonce: "nonce-2", password: "secret"},
+	}
+	a := &stun.Authenticator{Transport: servers[0], Username: "user", Password: "secret"}
+	for i, want := range []int{2, 2, 1, 1} {
+		s := servers[i%len(servers)]
+		s.requests = 0
+		if _, err := a.DoVia(context.Background(), s, newBindingRequest()); err != nil || s.requests != want {
+			t.Fatalf("#%d: got %v after %d requests; want nil after %d requests", i, err, s.requests, want)
+		}
+	}
+	if k, ok := a.Key().(*stun.LongTermKey); !ok || k.Realm != "example.org" {
+		t.Fatalf("got %#v; want key for example.org", a.Key())
+	}
+}
+
+func TestAuthenticatorErrors(t *testing.T) {
+	for i, tt := range []struct {
+		s   *authServer
+		err error
+	}{
+		{&authServer{realm: "example.org", nonce: "nonce", password: "wrong"}, stun.ErrUnauthorized},
+		{&authServer{realm: "example.org", nonce: "nonce", password: "secret", code: stun.StatusWrongCredentials}, stun.ErrWrongCredentials},
+		{&authServer{realm: "example.org", nonce: "nonce", password: "secret", algos: stun.PasswordAlgorithms{{Number: 0x00ff}}}, stun.ErrNoPasswordAlgorithm},
+	} {
+		a := &stun.Authenticator{Transport: tt.s, Username: "user", Password: "secret"}
+		if _, err := a.Do(context.Background(), newBindingRequest()); !errors.Is(err, tt.err) {
+			t.Errorf("#%d: got %v; want %v", i, err, tt.err)
+		}
+	}
+
+	s := &authServer{realm: "example.org", nonce: "nonce", password: "secret", code: stun.StatusForbidden}
+	a := &stun.Authenticator{Transport: s, Username: "user", Password: "secret"}
+	resp, err := a.Do(context.Background(), newBindingRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := stun.Get[*stun.Error](resp); !ok || e.Code != stun.StatusForbidden {
+		t.Fatalf("got %v; want %d", e, stun.StatusForbidden)
+	}
+}
@@ -5,14 +5,13 @@
 package stun_test
 
 import (
-	"crypto/sha1"
 	"testing"
 
 	"github.com/mikioh/stun"
 )
 
 var (
-	rfc5769LongTermAuthHash                 = longTermAuth("\u30de\u30c8\u30ea\u30c3\u30af\u30b9", "example.org", "TheMatrIX", sha1.New)
+	rfc5769LongTermAuthKey                  = &stun.LongTermKey{Username: "\u30de\u30c8\u30ea\u30c3\u30af\u30b9", Realm: "example.org", Password: "TheMatrIX"}
 	rfc5769LongTermAuthMessage stun.Message = &stun.Control{
 		Type:   stun.MessageType(stun.ClassRequest, stun.MethodBinding),
 		Cookie: stun.MagicCookie,
@@ -40,7 +39,7 @@ var (
 func BenchmarkMarshalRFC5769LongTermAuthMessage(b *testing.B) {
 	wb := make([]byte, rfc5769LongTermAuthMessage.Len())
 	for i := 0; i < b.N; i++ {
-		if _, err := rfc5769LongTermAuthMessage.Marshal(wb, rfc5769LongTermAuthHash); err != nil {
+		if _, err := rfc5769LongTermAuthMessage.Marshal(wb, rfc5769LongTermAuthKey); err != nil {
 			b.Fatal(err)
 		}
 	}
@@ -48,7 +47,50 @@ func BenchmarkMarshalRFC5769LongTermAuthMessage(b *testing.B) {
 
 func BenchmarkParseRFC5769LongTermAuthMessage(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		if _, _, err := stun.ParseMessage(rfc5769LongTermAuthWire, rfc5769LongTermAuthHash); err != nil {
+		if _, _, err := stun.ParseMessage(rfc5769LongTermAuthWire, rfc5769LongTermAuthKey); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseRFC5769LongTermAuthMessageView(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		v, err := stun.NewMessageView(rfc5769LongTermAuthWire)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for it := v.Attrs(); it.Next(); {
+			if len(it.Value()) == 0 {
+				b.Fatal("empty attribute")
+			}
+		}
+		if _, ok := v.Lookup(stun.Realm("")); !ok {
+			b.Fatal("no REALM attribute")
+		}
+	}
+}
+
+func BenchmarkVerifyRFC5769FingerprintMessageView(b *testing.B) {
+	wire := []byte(rfc5769Tests[0].wire)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		v, err := stun.NewMessageView(wire)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := v.VerifyFingerprint(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendMarshalRFC5769LongTermAuthMessage(b *testing.B) {
+	wb := make([]byte, 0, rfc5769LongTermAuthMessage.Len())
+	m := rfc5769LongTermAuthMessage.(*stun.Control)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.AppendMarshal(wb[:0], rfc5769LongTermAuthKey); err != nil {
 			b.Fatal(err)
 		}
 	}
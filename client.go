@@ -0,0 +1,389 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mikioh/stun/internal/netutil"
+)
+
+// Errors returned by Client.
+var (
+	// ErrTimeout is returned when a transaction times out.
+	ErrTimeout = errors.New("transaction timed out")
+
+	// ErrMismatchedResponse is returned when a response to an
+	// outstanding transaction doesn't match the request; the
+	// method differs or it is not a response.
+	ErrMismatchedResponse = errors.New("mismatched response")
+
+	// ErrClientClosed is returned when a Client is closed while
+	// transactions are outstanding.
+	ErrClientClosed = errors.New("client closed")
+)
+
+// Default parameters of transaction layer as described in RFC 5389
+// section 7.2.
+const (
+	DefaultRTO     = 500 * time.Millisecond
+	DefaultRc      = 7
+	DefaultRm      = 16
+	DefaultTimeout = 39500 * time.Millisecond
+)
+
+// A Client represents a STUN client that runs transactions over a
+// connection as described in RFC 5389 section 7.2.
+//
+// Over a datagram connection such as UDP, a request is retransmitted
+// with the exponential backoff defined by RTO, Rc and Rm. Over a
+// byte stream connection such as TCP or TLS, a request is sent once
+// and the transaction times out after Timeout.
+//
+// Multiple goroutines may invoke methods on a Client simultaneously.
+type Client struct {
+	// RTO specifies the initial retransmission timeout.
+	// If zero, DefaultRTO is used.
+	RTO time.Duration
+
+	// Rc specifies the maximum number of requests to send.
+	// If zero, DefaultRc is used.
+	Rc int
+
+	// Rm specifies the multiplier of RTO for the time waiting
+	// for a response after the last request.
+	// If zero, DefaultRm is used.
+	Rm int
+
+	// Timeout specifies the transaction timeout over a byte
+	// stream connection.
+	// If zero, DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Key specifies the key used for marshaling requests.
+	// It must be a valid key when in use of STUN
+	// MESSAGE-INTEGRITY or MESSAGE-INTEGRITY-SHA256 attribute.
+	Key Key
+
+	// Unsolicited optionally specifies a function called with a
+	// received message that is not a response to an outstanding
+	// transaction, such as an indication or channel data message.
+	// It is called from the goroutine reading the connection and
+	// must not block; m remains valid after the call returns.
+	// It must be set before the first call to Do.
+	Unsolicited func(m Message)
+
+	conn     net.Conn       // connected conn
+	pconn    net.PacketConn // unconnected conn
+	raddr    net.Addr       // destination for pconn
+	reliable bool
+
+	once sync.Once
+	mu   sync.Mutex
+	txs  map[[12]byte]*transaction
+	err  error // set when the reader stops
+}
+
+type transaction struct {
+	req  *Control
+	resp chan *Control
+	err  chan error
+}
+
+// NewClient returns a new Client that runs transactions over the
+// connected conn.
+// If conn implements net.PacketConn, such as a connected UDP
+// connection, conn is treated as a datagram connection; otherwise,
+// conn is treated as a byte stream connection.
+func NewClient(conn net.Conn) *Client {
+	_, datagram := conn.(net.PacketConn)
+	return &Client{conn: conn, reliable: !datagram, txs: make(map[[12]byte]*transaction)}
+}
+
+// NewPacketClient returns a new Client that runs transactions with the
+// server at raddr over the unconnected datagram connection conn.
+// Datagrams from other than raddr are discarded.
+func NewPacketClient(conn net.PacketConn, raddr net.Addr) *Client {
+	return &Client{pconn: conn, raddr: raddr, txs: make(map[[12]byte]*transaction)}
+}
+
+// A RoundTripper represents the ability to run a single STUN
+// transaction.
+//
+// RoundTrip sends the request req marshaled with the key k and
+// returns the response. Both the success and error responses are
+// returned without error.
+type RoundTripper interface {
+	RoundTrip(ctx context.Context, req *Control, k Key) (*Control, error)
+}
+
+// Do sends the request req and returns the response.
+// If req.TID is nil, Do sets a new transaction ID.
+//
+// The response is not verified with MESSAGE-INTEGRITY and
+// MESSAGE-INTEGRITY-SHA256 attributes; use VerifyIntegrity method of
+// the response.
+// Both the success and error responses are returned without error.
+func (c *Client) Do(ctx context.Context, req *Control) (*Control, error) {
+	return c.RoundTrip(ctx, req, c.Key)
+}
+
+// RoundTrip implements the RoundTrip method of RoundTripper
+// interface.
+// It works like Do but uses k instead of c.Key.
+func (c *Client) RoundTrip(ctx context.Context, req *Control, k Key) (*Control, error) {
+	c.once.Do(func() { go c.readLoop() })
+	if len(req.TID) < 12 {
+		tid, err := TransactionID()
+		if err != nil {
+			return nil, err
+		}
+		req.TID = tid
+	}
+	b, err := req.AppendMarshal(nil, k)
+	if err != nil {
+		return nil, err
+	}
+	tx := &transaction{req: req, resp: make(chan *Control, 1), err: make(chan error, 1)}
+	var id [12]byte
+	copy(id[:], req.TID)
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	if _, ok := c.txs[id]; ok {
+		c.mu.Unlock()
+		return nil, &MessageError{Type: req.Type, Err: errors.New("duplicate transaction ID")}
+	}
+	c.txs[id] = tx
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.txs, id)
+		c.mu.Unlock()
+	}()
+
+	rto, rc, last := c.schedule()
+	t := time.NewTimer(last)
+	defer t.Stop()
+	for i := 0; i < rc; i++ {
+		if err := c.write(b); err != nil {
+			return nil, err
+		}
+		if i < rc-1 {
+			t.Reset(rto << uint(i))
+		} else {
+			t.Reset(last)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case resp := <-tx.resp:
+			return resp, nil
+		case err := <-tx.err:
+			return nil, err
+		case <-t.C:
+		}
+	}
+	return nil, &MessageError{Type: req.Type, Err: ErrTimeout}
+}
+
+// Send sends the message m marshaled with the key k without waiting
+// for a response.
+// It is used for sending indications and channel data messages.
+func (c *Client) Send(m Message, k Key) error {
+	c.once.Do(func() { go c.readLoop() })
+	var b []byte
+	var err error
+	switch m := m.(type) {
+	case *Control:
+		if len(m.TID) < 12 {
+			if m.TID, err = TransactionID(); err != nil {
+				return err
+			}
+		}
+		b, err = m.AppendMarshal(nil, k)
+	case *ChannelData:
+		b, err = m.AppendMarshal(nil, nil)
+	default:
+		return errors.New("unknown message")
+	}
+	if err != nil {
+		return err
+	}
+	return c.write(b)
+}
+
+// schedule returns the initial RTO, the maximum number of requests
+// and the time waiting for a response after the last request.
+func (c *Client) schedule() (time.Duration, int, time.Duration) {
+	if c.reliable {
+		if c.Timeout > 0 {
+			return 0, 1, c.Timeout
+		}
+		return 0, 1, DefaultTimeout
+	}
+	rto, rc, rm := c.RTO, c.Rc, c.Rm
+	if rto <= 0 {
+		rto = DefaultRTO
+	}
+	if rc <= 0 {
+		rc = DefaultRc
+	}
+	if rm <= 0 {
+		rm = DefaultRm
+	}
+	return rto, rc, rto * time.Duration(rm)
+}
+
+// RemoteAddr returns the transport address of the server.
+func (c *Client) RemoteAddr() net.Addr {
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return c.raddr
+}
+
+// Close closes the underlying connection.
+// Outstanding transactions fail with ErrClientClosed.
+func (c *Client) Close() error {
+	c.fail(ErrClientClosed)
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return c.pconn.Close()
+}
+
+func (c *Client) write(b []byte) error {
+	if c.conn != nil {
+		_, err := c.conn.Write(b)
+		return err
+	}
+	_, err := c.pconn.WriteTo(b, c.raddr)
+	return err
+}
+
+func (c *Client) readLoop() {
+	var read func() (Message, error)
+	switch {
+	case c.reliable:
+		dec := NewDecoder(c.conn)
+		dec.SetRetain(true) // the message must outlive the next read
+		read = func() (Message, error) {
+			m, framed, err := dec.decode(nil)
+			if err != nil && framed {
+				return nil, nil // skip the malformed message
+			}
+			return m, err
+		}
+	default:
+		buf := make([]byte, MaxMessageSize)
+		var delay netutil.Backoff
+		read = func() (Message, error) {
+			var n int
+			var from net.Addr
+			var err error
+			if c.conn != nil {
+				n, err = c.conn.Read(buf)
+			} else {
+				n, from, err = c.pconn.ReadFrom(buf)
+			}
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return nil, err
+				}
+				delay.Wait() // e.g. ICMP errors on connected socket
+				return nil, nil
+			}
+			delay.Reset()
+			if from != nil && !sameAddr(from, c.raddr) {
+				return nil, nil
+			}
+			_, m, err := ParseMessage(append([]byte(nil), buf[:n]...), nil)
+			if err != nil {
+				return nil, nil
+			}
+			return m, nil
+		}
+	}
+	for {
+		m, err := read()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if m == nil {
+			continue
+		}
+		if resp, ok := m.(*Control); ok && c.dispatch(resp) {
+			continue
+		}
+		if c.Unsolicited != nil {
+			c.Unsolicited(m)
+		}
+	}
+}
+
+// dispatch delivers resp to the outstanding transaction.
+// It reports whether resp belongs to a transaction.
+func (c *Client) dispatch(resp *Control) bool {
+	var id [12]byte
+	copy(id[:], resp.TID)
+	c.mu.Lock()
+	tx, ok := c.txs[id]
+	c.mu.Unlock()
+	if !ok {
+		return false // stale or unknown transaction, or indication
+	}
+	switch class := resp.Type.Class(); {
+	case class != ClassSuccessResponse && class != ClassErrorResponse, resp.Type.Method() != tx.req.Type.Method():
+		select {
+		case tx.err <- &MessageError{Type: resp.Type, Err: ErrMismatchedResponse}:
+		default:
+		}
+	default:
+		select {
+		case tx.resp <- resp:
+		default:
+		}
+	}
+	return true
+}
+
+// fail makes all the outstanding and future transactions fail with
+// err.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	if errors.Is(err, net.ErrClosed) {
+		err = ErrClientClosed
+	}
+	c.err = err
+	for _, tx := range c.txs {
+		select {
+		case tx.err <- err:
+		default:
+		}
+	}
+}
+
+// sameAddr reports whether a and b are the same transport address.
+func sameAddr(a, b net.Addr) bool {
+	aa, err := netutil.AddrPort(a)
+	if err != nil {
+		return a.String() == b.String()
+	}
+	ba, err := netutil.AddrPort(b)
+	return err == nil && aa == ba
+}
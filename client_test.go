@@ -0,0 +1,259 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mikioh/stun"
+)
+
+// servePacket serves requests on c with h until c is closed.
+// H returns nil to drop the request.
+func servePacket(c net.PacketConn, h func(req *stun.Control) *stun.Control) {
+	b := make([]byte, stun.MaxMessageSize)
+	for {
+		n, from, err := c.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		_, m, err := stun.ParseMessage(b[:n], nil)
+		if err != nil {
+			continue
+		}
+		resp := h(m.(*stun.Control))
+		if resp == nil {
+			continue
+		}
+		wb, err := resp.MarshalBinary()
+		if err != nil {
+			continue
+		}
+		c.WriteTo(wb, from)
+	}
+}
+
+func bindingResponse(req *stun.Control) *stun.Control {
+	return &stun.Control{
+		Type:  stun.MessageType(stun.ClassSuccessResponse, stun.MethodBinding),
+		TID:   req.TID,
+		Attrs: []stun.Attribute{stun.Software("test")},
+	}
+}
+
+func newBindingRequest() *stun.Control {
+	return &stun.Control{Type: stun.MessageType(stun.ClassRequest, stun.MethodBinding)}
+}
+
+func newPacketClient(t *testing.T, h func(req *stun.Control) *stun.Control) *stun.Client {
+	s, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go servePacket(s, h)
+	t.Cleanup(func() { s.Close() })
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := stun.NewPacketClient(c, s.LocalAddr())
+	cl.RTO = 10 * time.Millisecond
+	t.Cleanup(func() { cl.Close() })
+	return cl
+}
+
+func TestClientConcurrentTransactions(t *testing.T) {
+	cl := newPacketClient(t, bindingResponse)
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := newBindingRequest()
+			resp, err := cl.Do(context.Background(), req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(resp.TID, req.TID) {
+				t.Errorf("got %#v; want %#v", resp.TID, req.TID)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClientRetransmission(t *testing.T) {
+	var n int32
+	cl := newPacketClient(t, func(req *stun.Control) *stun.Control {
+		if atomic.AddInt32(&n, 1) < 3 {
+			return nil
+		}
+		return bindingResponse(req)
+	})
+	if _, err := cl.Do(context.Background(), newBindingRequest()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&n); n != 3 {
+		t.Fatalf("got %d requests; want 3", n)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	var n int32
+	cl := newPacketClient(t, func(req *stun.Control) *stun.Control {
+		atomic.AddInt32(&n, 1)
+		return nil
+	})
+	cl.Rc, cl.Rm = 4, 2
+	start := time.Now()
+	_, err := cl.Do(context.Background(), newBindingRequest())
+	if !errors.Is(err, stun.ErrTimeout) {
+		t.Fatalf("got %v; want %v", err, stun.ErrTimeout)
+	}
+	// 10ms + 20ms + 40ms + 10ms*2
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("timed out too early: %v", d)
+	}
+	if n := atomic.LoadInt32(&n); n != 4 {
+		t.Fatalf("got %d requests; want 4", n)
+	}
+}
+
+func TestClientMismatchedResponse(t *testing.T) {
+	cl := newPacketClient(t, func(req *stun.Control) *stun.Control {
+		return &stun.Control{Type: stun.MessageType(stun.ClassSuccessResponse, stun.MethodAllocate), TID: req.TID}
+	})
+	_, err := cl.Do(context.Background(), newBindingRequest())
+	if !errors.Is(err, stun.ErrMismatchedResponse) {
+		t.Fatalf("got %v; want %v", err, stun.ErrMismatchedResponse)
+	}
+}
+
+func TestClientCancelAndClose(t *testing.T) {
+	cl := newPacketClient(t, func(req *stun.Control) *stun.Control { return nil })
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := cl.Do(ctx, newBindingRequest()); err != context.DeadlineExceeded {
+		t.Fatalf("got %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	errc := make(chan error)
+	go func() {
+		_, err := cl.Do(context.Background(), newBindingRequest())
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cl.Close()
+	if err := <-errc; err != stun.ErrClientClosed {
+		t.Fatalf("got %v; want %v", err, stun.ErrClientClosed)
+	}
+	if _, err := cl.Do(context.Background(), newBindingRequest()); err != stun.ErrClientClosed {
+		t.Fatalf("got %v; want %v", err, stun.ErrClientClosed)
+	}
+}
+
+func TestClientSourceAddr(t *testing.T) {
+	var ln [2]net.PacketConn
+	for i := range ln {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		ln[i] = c
+	}
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The response from other than the server precedes the one
+	// from the server.
+	go servePacket(ln[0], func(req *stun.Control) *stun.Control {
+		resp := &stun.Control{Type: stun.MessageType(stun.ClassSuccessResponse, stun.MethodAllocate), TID: req.TID}
+		if wb, err := resp.MarshalBinary(); err == nil {
+			ln[1].WriteTo(wb, c.LocalAddr())
+		}
+		return bindingResponse(req)
+	})
+	cl := stun.NewPacketClient(c, ln[0].LocalAddr())
+	cl.RTO = 10 * time.Millisecond
+	defer cl.Close()
+	if _, err := cl.Do(context.Background(), newBindingRequest()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientStream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		dec, enc := stun.NewDecoder(c), stun.NewEncoder(c)
+		for {
+			m, err := dec.Decode(nil)
+			if err != nil {
+				return
+			}
+			req := m.(*stun.Control)
+			if sw, ok := stun.Get[stun.Software](req); ok && sw != "malformed" {
+				continue // never answered
+			} else if ok {
+				// The attribute length exceeds the message.
+				b := append([]byte("\x01\x01\x00\x08\x21\x12\xa4\x42"), req.TID...)
+				b = append(b, "\x80\x22\x00\x08test"...)
+				if _, err := c.Write(b); err != nil {
+					return
+				}
+			}
+			if err := enc.Encode(bindingResponse(req), nil); err != nil {
+				return
+			}
+		}
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := stun.NewClient(c)
+	defer cl.Close()
+	cl.Timeout = 50 * time.Millisecond
+	req := newBindingRequest()
+	resp, err := cl.Do(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.TID, req.TID) {
+		t.Fatalf("got %#v; want %#v", resp.TID, req.TID)
+	}
+
+	// The malformed message on the byte stream is skipped.
+	req = newBindingRequest()
+	req.Attrs = []stun.Attribute{stun.Software("malformed")}
+	if _, err := cl.Do(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	req = newBindingRequest()
+	req.Attrs = []stun.Attribute{stun.Software("test")}
+	if _, err := cl.Do(context.Background(), req); !errors.Is(err, stun.ErrTimeout) {
+		t.Fatalf("got %v; want %v", err, stun.ErrTimeout)
+	}
+}
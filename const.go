@@ -95,3 +95,24 @@ const (
 	StatusServerError                  = 500 // Server Error
 	StatusInsufficientCapacity         = 508 // Insufficient Capacity
 )
+
+var statusTexts = map[int]string{
+	300: "Try Alternate",
+	400: "Bad Request",
+	401: "Unauthorized",
+	403: "Forbidden",
+	405: "Mobility Forbidden",
+	420: "Unknown Attribute",
+	437: "Allocation Mismatch",
+	438: "Stale Nonce",
+	440: "Address Family not Supported",
+	441: "Wrong Credentials",
+	442: "Unsupported Transport Protocol",
+	443: "Peer Address Family Mismatch",
+	446: "Connection Already Exists",
+	447: "Connection Timeout or Failure",
+	486: "Allocation Quota Reached",
+	487: "Role Conflict",
+	500: "Server Error",
+	508: "Insufficient Capacity",
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun
+
+// Get returns the first attribute of type T in m.
+//
+// For example,
+//
+//	xa, ok := stun.Get[*stun.XORMappedAddr](m)
+func Get[T Attribute](m *Control) (T, bool) {
+	for _, attr := range m.Attrs {
+		if v, ok := attr.(T); ok {
+			return v, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// GetAll returns all the attributes of type T in m.
+func GetAll[T Attribute](m *Control) []T {
+	var vs []T
+	for _, attr := range m.Attrs {
+		if v, ok := attr.(T); ok {
+			vs = append(vs, v)
+		}
+	}
+	return vs
+}
+
+// Has reports whether m contains an attribute of type T.
+func Has[T Attribute](m *Control) bool {
+	_, ok := Get[T](m)
+	return ok
+}
+
+// Add adds attr to m.
+// MESSAGE-INTEGRITY, MESSAGE-INTEGRITY-SHA256 and FINGERPRINT
+// attributes are kept at the end of m in that order; other attributes
+// are inserted before them. An existing MESSAGE-INTEGRITY,
+// MESSAGE-INTEGRITY-SHA256 or FINGERPRINT attribute is replaced with
+// attr.
+func (m *Control) Add(attr Attribute) {
+	if attrRank(attr) > 0 {
+		if i := m.index(attrType(attr)); i >= 0 {
+			m.Attrs[i] = attr
+			m.remove(attrType(attr), i+1)
+			return
+		}
+	}
+	m.insert(m.addIndex(attr), attr)
+}
+
+// Set replaces the attributes of the same STUN attribute type as attr
+// in m with attr.
+// If m contains no such attributes, Set works like Add.
+func (m *Control) Set(attr Attribute) {
+	t := attrType(attr)
+	i := m.index(t)
+	if i < 0 {
+		m.Add(attr)
+		return
+	}
+	m.Attrs[i] = attr
+	m.remove(t, i+1)
+}
+
+// Remove removes all the attributes of the same STUN attribute type
+// as attr from m.
+// It reports whether any attributes are removed.
+func (m *Control) Remove(attr Attribute) bool {
+	n := len(m.Attrs)
+	m.remove(attrType(attr), 0)
+	return len(m.Attrs) != n
+}
+
+// InsertBefore inserts attr before the first attribute of the same
+// STUN attribute type as mark in m.
+// If attr is a MESSAGE-INTEGRITY, MESSAGE-INTEGRITY-SHA256 or
+// FINGERPRINT attribute, m contains no such attribute as mark, or the
+// insertion breaks the placement of MESSAGE-INTEGRITY,
+// MESSAGE-INTEGRITY-SHA256 and FINGERPRINT attributes, InsertBefore
+// works like Add.
+func (m *Control) InsertBefore(attr, mark Attribute) {
+	i := m.index(attrType(mark))
+	if attrRank(attr) > 0 || i < 0 || i > 0 && attrRank(m.Attrs[i-1]) > 0 {
+		m.Add(attr)
+		return
+	}
+	m.insert(i, attr)
+}
+
+func (m *Control) addIndex(attr Attribute) int {
+	r := attrRank(attr)
+	for i, a := range m.Attrs {
+		if attrRank(a) > r {
+			return i
+		}
+	}
+	return len(m.Attrs)
+}
+
+func (m *Control) index(t int) int {
+	if t < 0 {
+		return -1
+	}
+	for i, attr := range m.Attrs {
+		if attrType(attr) == t {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *Control) insert(i int, attr Attribute) {
+	m.Attrs = append(m.Attrs, nil)
+	copy(m.Attrs[i+1:], m.Attrs[i:])
+	m.Attrs[i] = attr
+}
+
+func (m *Control) remove(t, from int) {
+	if t < 0 {
+		return
+	}
+	attrs := m.Attrs[:from]
+	for _, attr := range m.Attrs[from:] {
+		if attrType(attr) != t {
+			attrs = append(attrs, attr)
+		}
+	}
+	for i := len(attrs); i < len(m.Attrs); i++ {
+		m.Attrs[i] = nil
+	}
+	m.Attrs = attrs
+}
+
+// attrRank returns the placement rank of attr.
+func attrRank(attr Attribute) int {
+	switch attr.(type) {
+	case MessageIntegrity:
+		return 1
+	case MessageIntegritySHA256:
+		return 2
+	case Fingerprint:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// attrType returns the STUN attribute type of attr, or -1 if
+// unknown.
+func attrType(attr Attribute) int {
+	t, _, err := attrTypeMarshaler(attr)
+	if err != nil {
+		return -1
+	}
+	return t
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mikioh/stun"
+)
+
+func TestControlAccessors(t *testing.T) {
+	m := stun.Control{
+		Type: stun.MessageType(stun.ClassSuccessResponse, stun.MethodBinding),
+		Attrs: []stun.Attribute{
+			stun.Software("test"),
+			&stun.XORMappedAddr{Port: 32853, IP: net.IPv4(192, 0, 2, 1)},
+			stun.Realm("example.org"),
+			stun.Realm("example.com"),
+		},
+	}
+	xa, ok := stun.Get[*stun.XORMappedAddr](&m)
+	if !ok || xa.Port != 32853 {
+		t.Fatalf("got %v, %v; want 32853, true", xa, ok)
+	}
+	if _, ok := stun.Get[*stun.Error](&m); ok {
+		t.Fatal("got ERROR-CODE attribute")
+	}
+	if realms := stun.GetAll[stun.Realm](&m); !reflect.DeepEqual(realms, []stun.Realm{"example.org", "example.com"}) {
+		t.Fatalf("got %v; want %v", realms, []stun.Realm{"example.org", "example.com"})
+	}
+	if !stun.Has[stun.Software](&m) || stun.Has[stun.Nonce](&m) {
+		t.Fatal("unexpected attribute presence")
+	}
+}
+
+func TestControlMutators(t *testing.T) {
+	var m stun.Control
+	m.Add(stun.Fingerprint(0))
+	m.Add(stun.MessageIntegrity{})
+	m.Add(stun.Software("test"))
+	m.Add(stun.MessageIntegritySHA256{})
+	m.Add(stun.Realm("example.org"))
+	m.Set(stun.Nonce("nonce"))
+	m.Add(stun.Realm("example.com"))
+	m.Set(stun.Realm("example.net"))
+	m.InsertBefore(stun.Username("user"), stun.Software(""))
+	m.InsertBefore(stun.Priority(1), stun.Fingerprint(0))
+	m.InsertBefore(stun.Fingerprint(0), stun.Username(""))
+	m.InsertBefore(stun.MessageIntegrity{}, stun.Fingerprint(0))
+	m.Add(stun.MessageIntegritySHA256{})
+	want := []stun.Attribute{
+		stun.Username("user"),
+		stun.Software("test"),
+		stun.Realm("example.net"),
+		stun.Nonce("nonce"),
+		stun.Priority(1),
+		stun.MessageIntegrity{},
+		stun.MessageIntegritySHA256{},
+		stun.Fingerprint(0),
+	}
+	if !reflect.DeepEqual(m.Attrs, want) {
+		t.Fatalf("got %#v; want %#v", m.Attrs, want)
+	}
+	if !m.Remove(stun.Fingerprint(0)) || m.Remove(stun.Lifetime(0)) {
+		t.Fatal("unexpected removal result")
+	}
+	if len(m.Attrs) != len(want)-1 || stun.Has[stun.Fingerprint](&m) {
+		t.Fatalf("got %#v", m.Attrs)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors returned by CredentialStore implementations.
+var (
+	// ErrUnknownUser is returned when no credential is found for
+	// a username.
+	ErrUnknownUser = errors.New("unknown user")
+
+	// ErrCredentialExpired is returned when an ephemeral
+	// credential has expired.
+	ErrCredentialExpired = errors.New("credential expired")
+)
+
+// A CredentialStore looks up the long-term credential key for a
+// username.
+//
+// Implementations must be safe for concurrent use by multiple
+// goroutines.
+type CredentialStore interface {
+	// Key returns the key for username in realm.
+	// Algorithm is the password algorithm number carried in
+	// PASSWORD-ALGORITHM attribute, or zero if none.
+	// The returned key is applicable to both MESSAGE-INTEGRITY
+	// and MESSAGE-INTEGRITY-SHA256 attributes.
+	Key(username, realm string, algorithm int) (Key, error)
+}
+
+// StaticCredentials represents an in-memory CredentialStore that maps
+// a username to the password.
+// The map must not be modified while in use.
+type StaticCredentials map[string]string
+
+// Key implements the Key method of CredentialStore interface.
+func (sc StaticCredentials) Key(username, realm string, algorithm int) (Key, error) {
+	password, ok := sc[username]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	return &LongTermKey{Username: username, Realm: realm, Password: password, Algorithm: algorithm}, nil
+}
+
+// A FileCredentials represents a CredentialStore backed by a file.
+//
+// The file consists of lines of the form "username:password"; empty
+// lines and lines beginning with "#" are ignored. The file is
+// reloaded when its modification time or size changes.
+type FileCredentials struct {
+	path string
+
+	mu    sync.Mutex
+	mtime time.Time
+	size  int64
+	creds StaticCredentials
+}
+
+// NewFileCredentials returns a new FileCredentials that loads
+// credentials from the file at path.
+func NewFileCredentials(path string) (*FileCredentials, error) {
+	fc := &FileCredentials{path: path}
+	if err := fc.reload(); err != nil {
+		return nil, err
+	}
+	return fc, nil
+}
+
+// Key implements the Key method of CredentialStore interface.
+// If reloading the file fails, Key keeps using the credentials
+// loaded previously.
+func (fc *FileCredentials) Key(username, realm string, algorithm int) (Key, error) {
+	fc.reload()
+	fc.mu.Lock()
+	creds := fc.creds
+	fc.mu.Unlock()
+	return creds.Key(username, realm, algorithm)
+}
+
+func (fc *FileCredentials) reload() error {
+	fi, err := os.Stat(fc.path)
+	if err != nil {
+		return err
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.creds != nil && fi.ModTime().Equal(fc.mtime) && fi.Size() == fc.size {
+		return nil
+	}
+	b, err := os.ReadFile(fc.path)
+	if err != nil {
+		return err
+	}
+	creds, err := parseCredentials(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fc.path, err)
+	}
+	fc.mtime, fc.size, fc.creds = fi.ModTime(), fi.Size(), creds
+	return nil
+}
+
+func parseCredentials(b []byte) (StaticCredentials, error) {
+	creds := make(StaticCredentials)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, password, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("line %d: invalid credential", n)
+		}
+		creds[username] = password
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// A RESTCredentials represents a CredentialStore for ephemeral
+// credentials of the TURN REST API.
+//
+// A username is of the form "expiry:user" or "expiry", where expiry is
+// the expiration time in seconds since the Unix epoch, and the password
+// is the base64 encoded HMAC-SHA1 of the username with the shared
+// secret.
+type RESTCredentials struct {
+	Secret []byte // shared secret
+}
+
+// Key implements the Key method of CredentialStore interface.
+func (rc *RESTCredentials) Key(username, realm string, algorithm int) (Key, error) {
+	expiry, _, _ := strings.Cut(username, ":")
+	sec, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return nil, ErrUnknownUser
+	}
+	if time.Now().Unix() > sec {
+		return nil, ErrCredentialExpired
+	}
+	return &LongTermKey{Username: username, Realm: realm, Password: restPassword(rc.Secret, username), Algorithm: algorithm}, nil
+}
+
+// NewRESTCredential returns an ephemeral credential of the TURN REST
+// API for user that expires at expiry.
+func NewRESTCredential(secret []byte, user string, expiry time.Time) (username, password string) {
+	username = strconv.FormatInt(expiry.Unix(), 10)
+	if user != "" {
+		username += ":" + user
+	}
+	return username, restPassword(secret, username)
+}
+
+func restPassword(secret []byte, username string) string {
+	h := hmac.New(sha1.New, secret)
+	h.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
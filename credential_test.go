@@ -0,0 +1,124 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mikioh/stun"
+)
+
+// verifyCredential reports whether a request signed with the
+// credential of username and password is verified with the key
+// returned from cs.
+func verifyCredential(t *testing.T, cs stun.CredentialStore, username, password string) error {
+	t.Helper()
+	for _, tt := range []struct {
+		algo int
+		mi   stun.Attribute
+	}{
+		{0, stun.MessageIntegrity(nil)},
+		{stun.PasswordAlgorithmSHA256, stun.MessageIntegritySHA256(nil)},
+	} {
+		req := newBindingRequest()
+		req.TID = make([]byte, 12)
+		req.Attrs = []stun.Attribute{stun.Username(username), stun.Realm("example.org"), tt.mi}
+		b, err := req.AppendMarshal(nil, &stun.LongTermKey{Username: username, Realm: "example.org", Password: password, Algorithm: tt.algo})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, m, err := stun.ParseMessage(b, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, err := cs.Key(username, "example.org", tt.algo)
+		if err != nil {
+			return err
+		}
+		if err := m.(*stun.Control).VerifyIntegrity(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestStaticCredentials(t *testing.T) {
+	cs := stun.StaticCredentials{"alice": "secret"}
+	if err := verifyCredential(t, cs, "alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCredential(t, cs, "alice", "wrong"); err == nil {
+		t.Fatal("verified with wrong password")
+	}
+	if err := verifyCredential(t, cs, "bob", "secret"); err != stun.ErrUnknownUser {
+		t.Fatalf("got %v; want %v", err, stun.ErrUnknownUser)
+	}
+}
+
+func TestFileCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	if err := os.WriteFile(path, []byte("# comment\nalice:secret\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := stun.NewFileCredentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCredential(t, cs, "alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte("alice:new-secret\nbob:pass:word\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCredential(t, cs, "alice", "new-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCredential(t, cs, "bob", "pass:word"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A broken file doesn't replace the loaded credentials.
+	if err := os.WriteFile(path, []byte("broken\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCredential(t, cs, "bob", "pass:word"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stun.NewFileCredentials(path); err == nil {
+		t.Fatal("loaded broken file")
+	}
+}
+
+func TestRESTCredentials(t *testing.T) {
+	secret := []byte("shared-secret")
+	cs := &stun.RESTCredentials{Secret: secret}
+	for _, user := range []string{"alice", ""} {
+		username, password := stun.NewRESTCredential(secret, user, time.Now().Add(time.Hour))
+		if err := verifyCredential(t, cs, username, password); err != nil {
+			t.Fatalf("%q: %v", user, err)
+		}
+	}
+
+	username, password := stun.NewRESTCredential([]byte("other-secret"), "alice", time.Now().Add(time.Hour))
+	if err := verifyCredential(t, cs, username, password); err == nil {
+		t.Fatal("verified with wrong secret")
+	}
+	username, password = stun.NewRESTCredential(secret, "alice", time.Now().Add(-time.Minute))
+	if err := verifyCredential(t, cs, username, password); err != stun.ErrCredentialExpired {
+		t.Fatalf("got %v; want %v", err, stun.ErrCredentialExpired)
+	}
+	if err := verifyCredential(t, cs, "alice", "secret"); err != stun.ErrUnknownUser {
+		t.Fatalf("got %v; want %v", err, stun.ErrUnknownUser)
+	}
+
+	username, password = stun.NewRESTCredential([]byte("north"), "username", time.Unix(1334455599, 0))
+	if username != "1334455599:username" || password != "UdoqM1+PswsNyv6LtgfT+wN4UIQ=" {
+		t.Fatalf("got %q, %q; want 1334455599:username, UdoqM1+PswsNyv6LtgfT+wN4UIQ=", username, password)
+	}
+}
@@ -9,10 +9,12 @@ Using Relays around NAT (TURN) and Interactive Connectivity
 Establishment (ICE) protocols.
 
 STUN is defined in RFC 5389.
+Classic STUN is defined in RFC 3489.
 TURN is defined in RFC 5766.
 Traversal Using Relays around NAT (TURN) Extensions for TCP Allocations is defined in RFC 6062.
 Traversal Using Relays around NAT (TURN) Extension for IPv6 is defined in RFC 6156.
 ICE is defined in RFC 5245.
+NAT Behavior Discovery Using STUN is defined in RFC 5780.
 Explicit Congestion Notification (ECN) for RTP over UDP is defined in RFC 6679.
 An Origin Attribute for the STUN Protocol is defined in https://tools.ietf.org/html/draft-ietf-tram-stun-origin.
 
@@ -20,6 +22,6 @@ Also see https://tools.ietf.org/html/draft-ietf-tram-stunbis and https://tools.i
 
 Note: THIRD-PARTY-AUTHORIZATION and ACCESS-TOKEN attributes defined in
 RFC 7635 are not implemented yet and you can use DefaultAttr for those
-attributes.
+attributes, or register typed attributes by using RegisterAttribute.
 */
 package stun
@@ -96,6 +96,13 @@ func parseSTUNParameters(w io.Writer, r io.Reader) error {
 		fmt.Fprintf(w, ")\n\n")
 		switch csp.Title {
 		case "STUN Methods":
+		case "STUN Error Codes":
+			fmt.Fprintf(w, "var statusTexts = map[int]string{\n")
+			for _, r := range csp.Records {
+				fmt.Fprintf(w, "%s: %q,\n", r.Value, r.OrigDescr)
+			}
+			fmt.Fprintf(w, "}\n")
+			continue
 		default:
 			continue
 		}
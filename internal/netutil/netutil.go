@@ -0,0 +1,72 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package netutil provides network helpers shared by the stun, nat
+// and turn packages.
+package netutil
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// ErrNotUDPAddress is returned by UDPAddrPort when the address is not
+// a UDP address.
+var ErrNotUDPAddress = errors.New("not UDP address")
+
+// AddrPort returns the transport address of addr.
+// An IPv4-mapped IPv6 address is converted to the IPv4 address.
+func AddrPort(addr net.Addr) (netip.AddrPort, error) {
+	var ap netip.AddrPort
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ap = addr.AddrPort()
+	case *net.TCPAddr:
+		ap = addr.AddrPort()
+	default:
+		var err error
+		if ap, err = netip.ParseAddrPort(addr.String()); err != nil {
+			return ap, err
+		}
+	}
+	return Unmap(ap), nil
+}
+
+// UDPAddrPort is like AddrPort but accepts only a UDP address.
+func UDPAddrPort(addr net.Addr) (netip.AddrPort, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok || ua == nil {
+		return netip.AddrPort{}, ErrNotUDPAddress
+	}
+	return Unmap(ua.AddrPort()), nil
+}
+
+// Unmap converts the IPv4-mapped IPv6 address of ap to the IPv4
+// address.
+func Unmap(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// A Backoff is the delay before retrying a failed read on a datagram
+// connection.
+type Backoff time.Duration
+
+// Wait doubles the delay, starting at 5ms up to 1s, and sleeps for
+// the delay.
+func (d *Backoff) Wait() {
+	switch {
+	case *d == 0:
+		*d = Backoff(5 * time.Millisecond)
+	case *d < Backoff(time.Second):
+		*d *= 2
+	}
+	time.Sleep(time.Duration(*d))
+}
+
+// Reset resets the delay after a successful read.
+func (d *Backoff) Reset() {
+	*d = 0
+}
@@ -0,0 +1,32 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netutil_test
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/mikioh/stun/internal/netutil"
+)
+
+func TestAddrPort(t *testing.T) {
+	want := netip.MustParseAddrPort("192.0.2.1:3478")
+	for i, addr := range []net.Addr{
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478},
+		&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478},
+		&net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 3478},
+	} {
+		if ap, err := netutil.AddrPort(addr); err != nil || ap != want {
+			t.Errorf("#%d: got %v, %v; want %v", i, ap, err, want)
+		}
+	}
+	if ap, err := netutil.UDPAddrPort(&net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 3478}); err != nil || ap != want {
+		t.Errorf("got %v, %v; want %v", ap, err, want)
+	}
+	if _, err := netutil.UDPAddrPort(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}); err != netutil.ErrNotUDPAddress {
+		t.Errorf("got %v; want %v", err, netutil.ErrNotUDPAddress)
+	}
+}
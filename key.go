@@ -0,0 +1,116 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+)
+
+// A Key represents a key for STUN MESSAGE-INTEGRITY and
+// MESSAGE-INTEGRITY-SHA256 attributes.
+//
+// Implementations must be safe for concurrent use by multiple
+// goroutines.
+type Key interface {
+	// HMAC returns a new HMAC for computing the value of attr.
+	// Attr is either MessageIntegrity or MessageIntegritySHA256.
+	// It returns nil when the key is not applicable to attr.
+	HMAC(attr Attribute) hash.Hash
+}
+
+// A ShortTermKey represents a short-term credential key.
+// The value is the password.
+type ShortTermKey string
+
+// HMAC implements the HMAC method of Key interface.
+func (k ShortTermKey) HMAC(attr Attribute) hash.Hash {
+	return newHMAC(attr, []byte(k)) // implement OpaqueString profile defined in RFC 7613
+}
+
+// A LongTermKey represents a long-term credential key.
+type LongTermKey struct {
+	Username  string // username
+	Realm     string // realm
+	Password  string // password
+	Algorithm int    // password algorithm number; zero or PasswordAlgorithmMD5 for MD5, PasswordAlgorithmSHA256 for SHA256
+}
+
+// HMAC implements the HMAC method of Key interface.
+func (k *LongTermKey) HMAC(attr Attribute) hash.Hash {
+	if k == nil {
+		return nil
+	}
+	key := k.Bytes()
+	if key == nil {
+		return nil
+	}
+	return newHMAC(attr, key)
+}
+
+// Bytes returns the key derived from the username, realm and
+// password by using the password algorithm.
+// It returns nil when the password algorithm is not supported.
+func (k *LongTermKey) Bytes() []byte {
+	var h hash.Hash
+	switch k.Algorithm {
+	case 0, PasswordAlgorithmMD5:
+		h = md5.New()
+	case PasswordAlgorithmSHA256:
+		h = sha256.New()
+	default:
+		return nil
+	}
+	h.Write([]byte(k.Username + ":" + k.Realm + ":" + k.Password)) // implement PRECIS defined in RFC 7613
+	return h.Sum(nil)
+}
+
+// A RawKey represents a pre-derived key such as the one returned
+// from the Bytes method of LongTermKey.
+type RawKey []byte
+
+// HMAC implements the HMAC method of Key interface.
+func (k RawKey) HMAC(attr Attribute) hash.Hash {
+	return newHMAC(attr, k)
+}
+
+// An IntegrityKeys represents a pair of independent keys for
+// MESSAGE-INTEGRITY and MESSAGE-INTEGRITY-SHA256 attributes.
+type IntegrityKeys struct {
+	MessageIntegrity       Key // key for MESSAGE-INTEGRITY
+	MessageIntegritySHA256 Key // key for MESSAGE-INTEGRITY-SHA256
+}
+
+// HMAC implements the HMAC method of Key interface.
+func (ks *IntegrityKeys) HMAC(attr Attribute) hash.Hash {
+	if ks == nil {
+		return nil
+	}
+	var k Key
+	switch attr.(type) {
+	case MessageIntegrity:
+		k = ks.MessageIntegrity
+	case MessageIntegritySHA256:
+		k = ks.MessageIntegritySHA256
+	}
+	if k == nil {
+		return nil
+	}
+	return k.HMAC(attr)
+}
+
+func newHMAC(attr Attribute, key []byte) hash.Hash {
+	switch attr.(type) {
+	case MessageIntegrity:
+		return hmac.New(sha1.New, key)
+	case MessageIntegritySHA256:
+		return hmac.New(sha256.New, key)
+	default:
+		return nil
+	}
+}
@@ -6,6 +6,7 @@ package stun
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
@@ -13,6 +14,7 @@ import (
 	"hash"
 	"hash/crc32"
 	"io"
+	"sync"
 )
 
 // A MessageError represents a STUN message error.
@@ -31,6 +33,11 @@ func (me *MessageError) Error() string {
 	return fmt.Sprintf("%s: %s", me.Type.String(), me.Err.Error())
 }
 
+// Unwrap returns the underlying error.
+func (me *MessageError) Unwrap() error {
+	return me.Err
+}
+
 const (
 	controlHeaderLen     = 20
 	channelDataHeaderLen = 4
@@ -106,6 +113,33 @@ func MessageType(c Class, m Method) Type {
 // MagicCookie is the fixed cookie value defined in RFC 5389.
 var MagicCookie = []byte{0x21, 0x12, 0xa4, 0x42}
 
+// Flags represents options for marshaling and parsing STUN messages.
+type Flags uint
+
+const (
+	// FlagStrict enables the strict placement of
+	// MESSAGE-INTEGRITY, MESSAGE-INTEGRITY-SHA256 and
+	// FINGERPRINT attributes defined in RFC 5389.
+	// On parsing, attributes following MESSAGE-INTEGRITY
+	// except MESSAGE-INTEGRITY-SHA256 and FINGERPRINT, and
+	// attributes following MESSAGE-INTEGRITY-SHA256 except
+	// FINGERPRINT are ignored, and FINGERPRINT not placed at
+	// the end of message is rejected.
+	// On marshaling, those attributes are moved to the end of
+	// message and duplicates are rejected.
+	FlagStrict Flags = 1 << iota
+
+	// FlagAddrPort makes the parser decode address attributes
+	// into the variants using netip.AddrPort such as
+	// XORMappedAddrPort, which preserve the address family on
+	// the wire exactly.
+	FlagAddrPort
+
+	// flagLegacy indicates that the message being parsed is an
+	// RFC 3489 message.
+	flagLegacy Flags = 1 << 31
+)
+
 // A Message represents a STUN message.
 type Message interface {
 	// Len returns the length of STUN message including the
@@ -114,9 +148,9 @@ type Message interface {
 
 	// Marshal writes the binary encoding of STUN message to b.
 	// It returns the number of bytes marshaled.
-	// H must be the HMAC-SHA1 when in use of STUN
-	// MESSAGE-INTEGRITY attribute.
-	Marshal(b []byte, h hash.Hash) (int, error)
+	// K must be a valid key when in use of STUN
+	// MESSAGE-INTEGRITY or MESSAGE-INTEGRITY-SHA256 attribute.
+	Marshal(b []byte, k Key) (int, error)
 }
 
 // A Control represents a STUN control message.
@@ -127,6 +161,10 @@ type Control struct {
 	// Cookie specifies the 32-bit magic cookie.
 	// If Cookie is nil, Marshal method of Message interface sets
 	// an appropriate value.
+	// A message with a value other than MagicCookie is treated
+	// as a classic STUN message defined in RFC 3489, in which
+	// Cookie holds the first 32 bits of the 128-bit transaction
+	// identifier.
 	Cookie []byte
 
 	// TID specifies the 96-bit transaction identifier.
@@ -136,6 +174,71 @@ type Control struct {
 
 	// Attrs specifies the list of STUN attributes.
 	Attrs []Attribute
+
+	// Flags specifies the options for marshaling.
+	// ParseMessageFlags sets the flags used for parsing.
+	Flags Flags
+
+	raw     []byte        // message parsed by ParseMessage
+	fps     []fingerprint // HMAC and CRC-32 fingerprints in raw
+	unknown UnknownAttrs  // unknown comprehension-required attributes in raw
+}
+
+// Legacy reports whether m is a classic STUN message defined in RFC
+// 3489, which has no magic cookie.
+// On parsing a classic STUN message, XOR address attributes are
+// treated as unknown attributes, and MESSAGE-INTEGRITY attribute is
+// verified as described in RFC 3489.
+func (m *Control) Legacy() bool {
+	return len(m.Cookie) >= 4 && !bytes.Equal(m.Cookie[:4], MagicCookie)
+}
+
+// UnknownRequiredAttrs returns the list of comprehension-required
+// attribute types in the range 0x0000-0x7FFF, found by ParseMessage,
+// that are neither supported in the package nor registered by
+// RegisterAttribute.
+func (m *Control) UnknownRequiredAttrs() UnknownAttrs {
+	return m.unknown
+}
+
+// VerifyIntegrity verifies the MESSAGE-INTEGRITY or
+// MESSAGE-INTEGRITY-SHA256 attribute of the message returned from
+// ParseMessage.
+// It allows a server to choose the key after inspecting USERNAME,
+// REALM and other attributes.
+// The buffer passed to ParseMessage must not be modified before
+// calling VerifyIntegrity.
+func (m *Control) VerifyIntegrity(k Key) error {
+	if m.raw == nil {
+		return &MessageError{Type: m.Type, Err: errors.New("not parsed message")}
+	}
+	if k == nil {
+		return &MessageError{Type: m.Type, Err: errors.New("nil key")}
+	}
+	if len(m.fps) < 2 || m.fps[0].attr == nil && m.fps[1].attr == nil {
+		return &MessageError{Type: m.Type, Err: errors.New("no message integrity")}
+	}
+	if err := validateIntegrity(m.raw, k, m.fps[:2]); err != nil {
+		return &MessageError{Type: m.Type, Err: err}
+	}
+	return nil
+}
+
+// VerifyFingerprint verifies the FINGERPRINT attribute of the message
+// returned from ParseMessage.
+// The buffer passed to ParseMessage must not be modified before
+// calling VerifyFingerprint.
+func (m *Control) VerifyFingerprint() error {
+	if m.raw == nil {
+		return &MessageError{Type: m.Type, Err: errors.New("not parsed message")}
+	}
+	if len(m.fps) < 3 || m.fps[2].attr == nil {
+		return &MessageError{Type: m.Type, Err: errors.New("no fingerprint")}
+	}
+	if err := validateIntegrity(m.raw, nil, m.fps); err != nil {
+		return &MessageError{Type: m.Type, Err: err}
+	}
+	return nil
 }
 
 // Len implements the Len method of Message interface.
@@ -148,17 +251,61 @@ func (m *Control) Len() int {
 }
 
 // Marshal implements the Marshal method of Message interface.
-func (m *Control) Marshal(b []byte, h hash.Hash) (int, error) {
-	l := 0
-	for _, attr := range m.Attrs {
-		l += roundup(4 + attr.Len())
+func (m *Control) Marshal(b []byte, k Key) (int, error) {
+	bb, err := m.marshal(b[:0:len(b)], k)
+	if err != nil {
+		return 0, err
 	}
-	ll := controlHeaderLen + l
-	if len(b) < ll {
+	if len(bb) > len(b) {
 		return 0, &MessageError{Type: m.Type, Err: errors.New("short buffer")}
 	}
+	return len(bb), nil
+}
+
+// AppendMarshal appends the binary encoding of STUN message to dst
+// and returns the extended buffer.
+// K must be a valid key when in use of STUN MESSAGE-INTEGRITY or
+// MESSAGE-INTEGRITY-SHA256 attribute.
+func (m *Control) AppendMarshal(dst []byte, k Key) ([]byte, error) {
+	off := len(dst)
+	b, err := m.marshal(dst, k)
+	if err != nil {
+		return dst[:off], err
+	}
+	return b, nil
+}
+
+// MarshalBinary implements the MarshalBinary method of
+// encoding.BinaryMarshaler interface.
+// It doesn't compute the value of MESSAGE-INTEGRITY and
+// MESSAGE-INTEGRITY-SHA256 attributes; use AppendMarshal instead.
+func (m *Control) MarshalBinary() ([]byte, error) {
+	return m.AppendMarshal(nil, nil)
+}
+
+// WriteTo implements the WriteTo method of io.WriterTo interface.
+// It doesn't compute the value of MESSAGE-INTEGRITY and
+// MESSAGE-INTEGRITY-SHA256 attributes; use AppendMarshal instead.
+func (m *Control) WriteTo(w io.Writer) (int64, error) {
+	return writeMessage(w, m)
+}
+
+// Reset resets m to the zero value for reuse.
+// It retains the underlying storage of the list of attributes.
+func (m *Control) Reset() {
+	for i := range m.Attrs {
+		m.Attrs[i] = nil
+	}
+	*m = Control{Attrs: m.Attrs[:0]}
+}
+
+// marshal appends the binary encoding of m to dst, computing the
+// length of each attribute once.
+func (m *Control) marshal(dst []byte, k Key) ([]byte, error) {
+	off := len(dst)
+	dst = append(dst, make([]byte, controlHeaderLen)...)
+	b := dst[off:]
 	binary.BigEndian.PutUint16(b[:2], uint16(m.Type))
-	binary.BigEndian.PutUint16(b[2:4], uint16(l))
 	if len(m.Cookie) < 4 {
 		copy(b[4:8], MagicCookie)
 	} else {
@@ -166,19 +313,21 @@ func (m *Control) Marshal(b []byte, h hash.Hash) (int, error) {
 	}
 	if len(m.TID) < 12 {
 		if _, err := io.ReadFull(rand.Reader, b[8:20]); err != nil {
-			return 0, &MessageError{Type: m.Type, Err: err}
+			return dst, &MessageError{Type: m.Type, Err: err}
 		}
 	} else {
 		copy(b[8:20], m.TID)
 	}
-	fps, err := marshalAttrs(b[:ll], m)
+	dst, fps, err := marshalAttrs(dst, off, m)
 	if err != nil {
-		return 0, &MessageError{Type: m.Type, Err: err}
+		return dst, &MessageError{Type: m.Type, Err: err}
 	}
-	if err := marshalIntegrity(b[:ll], h, fps); err != nil {
-		return 0, &MessageError{Type: m.Type, Err: err}
+	b = dst[off:]
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-controlHeaderLen))
+	if err := marshalIntegrity(b, k, fps[:]); err != nil {
+		return dst, &MessageError{Type: m.Type, Err: err}
 	}
-	return ll, nil
+	return dst, nil
 }
 
 // A ChannelData represents a STUN channel data message.
@@ -198,18 +347,67 @@ func (m *ChannelData) Len() int {
 }
 
 // Marshal implements the Marshal method of Message interface.
-func (m *ChannelData) Marshal(b []byte, _ hash.Hash) (int, error) {
-	l := len(m.Data)
-	ll := channelDataHeaderLen + roundup(l)
+func (m *ChannelData) Marshal(b []byte, _ Key) (int, error) {
+	ll := m.Len()
 	if len(b) < ll {
 		return 0, &MessageError{Type: m.Number, Err: errors.New("short buffer")}
 	}
-	binary.BigEndian.PutUint16(b[:2], uint16(m.Number))
-	binary.BigEndian.PutUint16(b[2:4], uint16(l))
-	copy(b[channelDataHeaderLen:], m.Data)
+	m.marshal(b[:ll])
 	return ll, nil
 }
 
+// AppendMarshal appends the binary encoding of STUN channel data
+// message to dst and returns the extended buffer.
+func (m *ChannelData) AppendMarshal(dst []byte, _ Key) ([]byte, error) {
+	off := len(dst)
+	dst = append(dst, make([]byte, m.Len())...)
+	m.marshal(dst[off:])
+	return dst, nil
+}
+
+// MarshalBinary implements the MarshalBinary method of
+// encoding.BinaryMarshaler interface.
+func (m *ChannelData) MarshalBinary() ([]byte, error) {
+	return m.AppendMarshal(nil, nil)
+}
+
+// WriteTo implements the WriteTo method of io.WriterTo interface.
+func (m *ChannelData) WriteTo(w io.Writer) (int64, error) {
+	return writeMessage(w, m)
+}
+
+func (m *ChannelData) marshal(b []byte) {
+	binary.BigEndian.PutUint16(b[:2], uint16(m.Number))
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(m.Data)))
+	n := copy(b[channelDataHeaderLen:], m.Data)
+	for i := channelDataHeaderLen + n; i < len(b); i++ {
+		b[i] = 0
+	}
+}
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1500)
+		return &b
+	},
+}
+
+type appendMarshaler interface {
+	AppendMarshal([]byte, Key) ([]byte, error)
+}
+
+func writeMessage(w io.Writer, m appendMarshaler) (int64, error) {
+	bp := bufPool.Get().(*[]byte)
+	defer bufPool.Put(bp)
+	b, err := m.AppendMarshal((*bp)[:0], nil)
+	if err != nil {
+		return 0, err
+	}
+	*bp = b
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
 // ParseHeader parses b as a STUN message header.
 // It returns the message type or channel number, and the message
 // length including the message header but not including padding
@@ -228,11 +426,23 @@ func ParseHeader(b []byte) (Type, int, error) {
 
 // ParseMessage parses b as a STUN message.
 // It returns the number of bytes parsed and message.
-// H must be the HMAC-SHA1 when in use of STUN MESSAGE-INTEGRITY
-// attribute.
-// It assumes that b contains padding bytes even if a channel data
-// message and sent over UDP.
-func ParseMessage(b []byte, h hash.Hash) (int, Message, error) {
+// K must be a valid key when in use of STUN MESSAGE-INTEGRITY or
+// MESSAGE-INTEGRITY-SHA256 attribute.
+// If k is nil, the verification of MESSAGE-INTEGRITY and
+// MESSAGE-INTEGRITY-SHA256 attributes is deferred to the
+// VerifyIntegrity method of the returned Control.
+// A channel data message is expected to be padded to a multiple of 4
+// bytes; the one without padding bytes is accepted only when it
+// exactly fills b, as a datagram sent over UDP.
+// ParseMessage never modifies b, so it is safe to parse the same
+// buffer from multiple goroutines concurrently.
+func ParseMessage(b []byte, k Key) (int, Message, error) {
+	return ParseMessageFlags(b, k, 0)
+}
+
+// ParseMessageFlags is like ParseMessage but takes options for
+// parsing.
+func ParseMessageFlags(b []byte, k Key, flags Flags) (int, Message, error) {
 	if len(b) < channelDataHeaderLen {
 		return 0, nil, &MessageError{Err: errors.New("short message")}
 	}
@@ -240,6 +450,9 @@ func ParseMessage(b []byte, h hash.Hash) (int, Message, error) {
 	l := int(binary.BigEndian.Uint16(b[2:4]))
 	if 0x4000 <= t && t <= 0x7fff {
 		ll := channelDataHeaderLen + roundup(l)
+		if len(b) == channelDataHeaderLen+l {
+			ll = len(b) // not padded over UDP
+		}
 		if len(b) < ll {
 			return 0, nil, &MessageError{Type: t, Err: errors.New("short message")}
 		}
@@ -255,60 +468,71 @@ func ParseMessage(b []byte, h hash.Hash) (int, Message, error) {
 	cookieTID := make([]byte, 16)
 	copy(cookieTID[:4], b[4:8])
 	copy(cookieTID[4:16], b[8:controlHeaderLen])
-	m := Control{Type: t, Cookie: cookieTID[:4], TID: cookieTID[4:16]}
-	var (
-		err error
-		fps []fingerprint
-	)
-	m.Attrs, fps, err = parseAttrs(b[controlHeaderLen:ll], m.TID)
+	m := Control{Type: t, Cookie: cookieTID[:4], TID: cookieTID[4:16], Flags: flags}
+	if m.Legacy() {
+		flags |= flagLegacy
+	}
+	var err error
+	m.Attrs, m.fps, err = parseAttrs(b[controlHeaderLen:ll], m.TID, flags)
 	if err != nil {
 		return 0, nil, &MessageError{Type: t, Err: err}
 	}
-	if err := validateIntegrity(b[:ll], h, fps); err != nil {
+	if err := validateIntegrity(b[:ll], k, m.fps); err != nil {
 		return 0, nil, &MessageError{Type: t, Err: err}
 	}
+	for _, attr := range m.Attrs {
+		if da, ok := attr.(*DefaultAttr); ok && da.Type < 0x8000 {
+			m.unknown = append(m.unknown, da.Type)
+		}
+	}
+	m.raw = b[:ll]
 	return ll, &m, nil
 }
 
-func marshalIntegrity(b []byte, h hash.Hash, fps []fingerprint) error {
-	for i, fp := range fps {
-		if i < 2 && h != nil && fp.attr != nil {
-			var tmp [2]byte
-			copy(tmp[:], b[2:4])
-			l := fp.off - controlHeaderLen + roundup(4+fp.attr.Len())
-			binary.BigEndian.PutUint16(b[2:4], uint16(l))
-			h.Reset()
-			h.Write(b[:fp.off])
+func marshalIntegrity(b []byte, k Key, fps []fingerprint) error {
+	order := [3]int{0, 1, 2}
+	if fps[0].attr != nil && fps[1].attr != nil && fps[1].off < fps[0].off {
+		order[0], order[1] = 1, 0 // HMAC covers preceding HMAC
+	}
+	for _, i := range order {
+		fp := fps[i]
+		if i < 2 && k != nil && fp.attr != nil {
+			h := k.HMAC(fp.attr)
+			if h == nil {
+				return &AttributeError{Type: integrityAttrTypes[i], Err: errors.New("no applicable key")}
+			}
+			writeIntegrityInput(h, b, fp.off, fp.attr)
 			copy(b[fp.off+4:], h.Sum(nil))
-			copy(b[2:4], tmp[:])
 		}
 		if i == 2 && fp.attr != nil {
-			if fp.attr.(Fingerprint) == 0 {
-				fp.attr = Fingerprint(crc32.ChecksumIEEE(b[:fp.off]) ^ crc32XOR)
+			crc := uint32(fp.attr.(Fingerprint))
+			if crc == 0 {
+				crc = crc32.ChecksumIEEE(b[:fp.off]) ^ crc32XOR
 			}
-			if err := marshalUintAttr(b[fp.off:], attrFINGERPRINT, fp.attr, nil); err != nil {
-				return &AttributeError{Type: attrFINGERPRINT, Err: err}
+			if len(b) < fp.off+4+4 {
+				return &AttributeError{Type: attrFINGERPRINT, Err: errors.New("short buffer")}
 			}
+			binary.BigEndian.PutUint32(b[fp.off+4:fp.off+8], crc)
 		}
 	}
 	return nil
 }
 
-func validateIntegrity(b []byte, h hash.Hash, fps []fingerprint) error {
+var integrityAttrTypes = [2]int{attrMESSAGE_INTEGRITY, attrMESSAGE_INTEGRITY_SHA256}
+
+func validateIntegrity(b []byte, k Key, fps []fingerprint) error {
 	for i, fp := range fps {
-		if i < 2 && h != nil && fp.attr != nil {
-			var tmp [2]byte
-			copy(tmp[:], b[2:4])
-			l := fp.off + roundup(4+fp.attr.Len())
-			binary.BigEndian.PutUint16(b[2:4], uint16(l))
-			h.Reset()
-			h.Write(b[:controlHeaderLen+fp.off])
+		if i < 2 && k != nil && fp.attr != nil {
+			h := k.HMAC(fp.attr)
+			if h == nil {
+				return &AttributeError{Type: integrityAttrTypes[i], Err: errors.New("no applicable key")}
+			}
+			writeIntegrityInput(h, b, controlHeaderLen+fp.off, fp.attr)
 			mac := h.Sum(nil)
-			copy(b[2:4], tmp[:])
-			if i == 0 && !bytes.Equal(mac, fp.attr.(MessageIntegrity)) {
+			if i == 0 && !hmac.Equal(mac, fp.attr.(MessageIntegrity)) {
 				return &AttributeError{Type: attrMESSAGE_INTEGRITY, Err: errors.New("HMAC fingerprint mismatch")}
 			}
-			if i == 1 && !bytes.Equal(mac, fp.attr.(MessageIntegritySHA256)) {
+			if i == 1 && !hmac.Equal(mac, fp.attr.(MessageIntegritySHA256)) {
 				return &AttributeError{Type: attrMESSAGE_INTEGRITY_SHA256, Err: errors.New("HMAC fingerprint mismatch")}
 			}
 		}
@@ -320,3 +544,23 @@ func validateIntegrity(b []byte, h hash.Hash, fps []fingerprint) error {
 	}
 	return nil
 }
+
+// writeIntegrityInput writes the first off bytes of b to h as the
+// input of HMAC for attr at off. The message length field is adjusted
+// to point to the end of attr without modifying b.
+// For a message without the magic cookie, it follows RFC 3489 section
+// 11.2.8 instead; the message length field is left as it is and the
+// input is padded with zeros to a multiple of 64 bytes.
+func writeIntegrityInput(h hash.Hash, b []byte, off int, attr Attribute) {
+	if !bytes.Equal(b[4:8], MagicCookie) {
+		var pad [64]byte
+		h.Write(b[:off])
+		h.Write(pad[:(64-off%64)%64])
+		return
+	}
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(off-controlHeaderLen+roundup(4+attr.Len())))
+	h.Write(b[:2])
+	h.Write(l[:])
+	h.Write(b[4:off])
+}
@@ -5,10 +5,18 @@
 package stun_test
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha1"
+	"encoding"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/mikioh/stun"
@@ -123,7 +131,7 @@ func TestMarshalAndParseMessage(t *testing.T) {
 	tests := append(rfc5769Tests, channelDataTests...)
 	for i, tt := range tests {
 		b := make([]byte, tt.raw.Len())
-		n, err := tt.raw.Marshal(b, tt.hash)
+		n, err := tt.raw.Marshal(b, tt.key)
 		if err != nil {
 			t.Fatalf("#%d: %v", i, err)
 		}
@@ -136,7 +144,7 @@ func TestMarshalAndParseMessage(t *testing.T) {
 		if _, _, err := stun.ParseHeader(wire); err != nil {
 			t.Fatalf("#%d: %v", i, err)
 		}
-		n, m, err := stun.ParseMessage(wire, tt.hash)
+		n, m, err := stun.ParseMessage(wire, tt.key)
 		if err != nil {
 			t.Fatalf("#%d: %v", i, err)
 		}
@@ -166,3 +174,579 @@ func TestMarshalAndParseMessage(t *testing.T) {
 		wire = wire[n:]
 	}
 }
+
+func TestParseChannelData(t *testing.T) {
+	for i, tt := range []struct {
+		wire string
+		n    int
+		data string
+	}{
+		{"\x7f\xff\x00\x01\xff", 5, "\xff"}, // not padded over UDP
+		{"\x7f\xff\x00\x01\xff\x00\x00\x00", 8, "\xff"},
+		{"\x7f\xff\x00\x01\xff\x00\x00\x00\x40\x00", 8, "\xff"},
+		{"\x7f\xff\x00\x01\xff\x00", 0, ""},
+		{"\x7f\xff\x00\x02\xff", 0, ""},
+	} {
+		n, m, err := stun.ParseMessage([]byte(tt.wire), nil)
+		if tt.n == 0 {
+			if err == nil {
+				t.Errorf("#%d: got nil; want error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		if n != tt.n || string(m.(*stun.ChannelData).Data) != tt.data {
+			t.Errorf("#%d: got %d, %q; want %d, %q", i, n, m.(*stun.ChannelData).Data, tt.n, tt.data)
+		}
+	}
+}
+
+func TestIntegrityKeys(t *testing.T) {
+	ks := &stun.IntegrityKeys{
+		MessageIntegrity:       stun.ShortTermKey("VOkJxbRl1RmTxUk/WvJxBt"),
+		MessageIntegritySHA256: &stun.LongTermKey{Username: "user", Realm: "example.org", Password: "TheMatrIX", Algorithm: stun.PasswordAlgorithmSHA256},
+	}
+	m := stun.Control{
+		Type: stun.MessageType(stun.ClassRequest, stun.MethodBinding),
+		Attrs: []stun.Attribute{
+			stun.Username("user"),
+			stun.Realm("example.org"),
+			stun.MessageIntegrity{},
+			stun.MessageIntegritySHA256{},
+			stun.Fingerprint(0),
+		},
+	}
+	b := make([]byte, m.Len())
+	n, err := m.Marshal(b, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := stun.ParseMessage(b[:n], ks); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []stun.Key{
+		stun.ShortTermKey("VOkJxbRl1RmTxUk/WvJxBt"),
+		&stun.LongTermKey{Username: "user", Realm: "example.org", Password: "TheMatrIX", Algorithm: stun.PasswordAlgorithmSHA256},
+		&stun.IntegrityKeys{MessageIntegrity: ks.MessageIntegrity},
+		&stun.IntegrityKeys{MessageIntegrity: ks.MessageIntegritySHA256, MessageIntegritySHA256: ks.MessageIntegrity},
+	} {
+		if _, _, err := stun.ParseMessage(b[:n], k); err == nil {
+			t.Errorf("%#v: verified with wrong key", k)
+		}
+	}
+	lk := &stun.LongTermKey{Username: "user", Realm: "example.org", Password: "TheMatrIX", Algorithm: stun.PasswordAlgorithmSHA256}
+	if _, _, err := stun.ParseMessage(b[:n], &stun.IntegrityKeys{MessageIntegrity: ks.MessageIntegrity, MessageIntegritySHA256: stun.RawKey(lk.Bytes())}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseMessageConcurrent(t *testing.T) {
+	wire := []byte(rfc5769Tests[0].wire)
+	orig := append([]byte(nil), wire...)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, m, err := stun.ParseMessage(wire, rfc5769Tests[0].key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := m.(*stun.Control).VerifyIntegrity(rfc5769Tests[0].key); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if !bytes.Equal(wire, orig) {
+		t.Fatalf("got %#v; want %#v", wire, orig)
+	}
+}
+
+func TestUnknownAttrsResponse(t *testing.T) {
+	m := stun.Control{
+		Type: stun.MessageType(stun.ClassRequest, stun.MethodBinding),
+		Attrs: []stun.Attribute{
+			&stun.DefaultAttr{Type: 0x7ff2, Data: []byte{0xde, 0xad}},
+			stun.Software("test"),
+			&stun.DefaultAttr{Type: 0xc001, Data: []byte{0xbe, 0xef}},
+			&stun.DefaultAttr{Type: 0x0031, Data: []byte{0, 0, 0, 0}},
+		},
+	}
+	b := make([]byte, m.Len())
+	n, err := m.Marshal(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rm, err := stun.ParseMessage(b[:n], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := rm.(*stun.Control)
+	if ua := req.UnknownRequiredAttrs(); !reflect.DeepEqual(ua, stun.UnknownAttrs{0x7ff2, 0x0031}) {
+		t.Fatalf("got %v; want %v", ua, stun.UnknownAttrs{0x7ff2, 0x0031})
+	}
+	resp := stun.UnknownAttrsResponse(req)
+	if resp == nil {
+		t.Fatal("got nil; want error response")
+	}
+	if resp.Type != stun.MessageType(stun.ClassErrorResponse, stun.MethodBinding) || !bytes.Equal(resp.TID, req.TID) {
+		t.Fatalf("got %v, %#v; want %v, %#v", resp.Type, resp.TID, stun.MessageType(stun.ClassErrorResponse, stun.MethodBinding), req.TID)
+	}
+	want := []stun.Attribute{&stun.Error{Code: stun.StatusUnknownAttribute, Reason: "Unknown Attribute"}, stun.UnknownAttrs{0x7ff2, 0x0031}}
+	if !reflect.DeepEqual(resp.Attrs, want) {
+		t.Fatalf("got %#v; want %#v", resp.Attrs, want)
+	}
+
+	m.Type = stun.MessageType(stun.ClassIndication, stun.MethodBinding)
+	n, err = m.Marshal(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rm, err = stun.ParseMessage(b[:n], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := stun.UnknownAttrsResponse(rm.(*stun.Control)); resp != nil {
+		t.Fatalf("got %#v; want nil", resp)
+	}
+}
+
+var parseStrictTests = []struct {
+	in     []stun.Attribute
+	strict []stun.Attribute // nil if rejected
+}{
+	{
+		in: []stun.Attribute{
+			stun.Software("test"),
+			stun.MessageIntegrity{},
+			stun.Fingerprint(0),
+		},
+		strict: []stun.Attribute{
+			stun.Software("test"),
+			stun.MessageIntegrity{},
+			stun.Fingerprint(0),
+		},
+	},
+	{
+		in: []stun.Attribute{
+			stun.Software("test"),
+			stun.MessageIntegrity{},
+			stun.Realm("example.org"),
+			stun.MessageIntegritySHA256{},
+			stun.Nonce("nonce"),
+			stun.Fingerprint(0),
+		},
+		strict: []stun.Attribute{
+			stun.Software("test"),
+			stun.MessageIntegrity{},
+			stun.MessageIntegritySHA256{},
+			stun.Fingerprint(0),
+		},
+	},
+	{
+		in: []stun.Attribute{
+			stun.MessageIntegritySHA256{},
+			stun.MessageIntegrity{},
+			stun.Software("test"),
+		},
+		strict: []stun.Attribute{
+			stun.MessageIntegritySHA256{},
+		},
+	},
+	{
+		in: []stun.Attribute{
+			stun.Fingerprint(0),
+			stun.Software("test"),
+		},
+	},
+	{
+		in: []stun.Attribute{
+			stun.Software("test"),
+			stun.Fingerprint(0),
+			stun.Fingerprint(0),
+		},
+	},
+}
+
+func TestParseStrict(t *testing.T) {
+	key := stun.ShortTermKey("VOkJxbRl1RmTxUk/WvJxBt")
+	for i, tt := range parseStrictTests {
+		m := stun.Control{Type: stun.MessageType(stun.ClassRequest, stun.MethodBinding), Attrs: tt.in}
+		b := make([]byte, m.Len())
+		n, err := m.Marshal(b, key)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if _, _, err := stun.ParseMessage(b[:n], key); err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		_, rm, err := stun.ParseMessageFlags(b[:n], key, stun.FlagStrict)
+		if tt.strict == nil {
+			if err == nil {
+				t.Errorf("#%d: got nil; want error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		attrs := rm.(*stun.Control).Attrs
+		if len(attrs) != len(tt.strict) {
+			t.Errorf("#%d: got %d attributes; want %d", i, len(attrs), len(tt.strict))
+			continue
+		}
+		for j := range attrs {
+			if reflect.TypeOf(attrs[j]) != reflect.TypeOf(tt.strict[j]) {
+				t.Errorf("#%d: got %T; want %T", i, attrs[j], tt.strict[j])
+			}
+		}
+	}
+}
+
+var marshalStrictTests = []struct {
+	in  []stun.Attribute
+	out []stun.Attribute // nil if rejected
+}{
+	{
+		in: []stun.Attribute{
+			stun.Fingerprint(0),
+			stun.MessageIntegrity{},
+			stun.Software("test"),
+			stun.MessageIntegritySHA256{},
+			stun.Realm("example.org"),
+		},
+		out: []stun.Attribute{
+			stun.Software("test"),
+			stun.Realm("example.org"),
+			stun.MessageIntegrity{},
+			stun.MessageIntegritySHA256{},
+			stun.Fingerprint(0),
+		},
+	},
+	{
+		in: []stun.Attribute{
+			stun.Software("test"),
+			stun.Realm("example.org"),
+		},
+		out: []stun.Attribute{
+			stun.Software("test"),
+			stun.Realm("example.org"),
+		},
+	},
+	{
+		in: []stun.Attribute{
+			stun.MessageIntegrity{},
+			stun.Software("test"),
+			stun.MessageIntegrity{},
+		},
+	},
+	{
+		in: []stun.Attribute{
+			stun.Fingerprint(0),
+			stun.Fingerprint(0),
+		},
+	},
+}
+
+func TestMarshalStrict(t *testing.T) {
+	key := stun.ShortTermKey("VOkJxbRl1RmTxUk/WvJxBt")
+	for i, tt := range marshalStrictTests {
+		in := cloneAttrs(tt.in)
+		m := stun.Control{Type: stun.MessageType(stun.ClassRequest, stun.MethodBinding), Attrs: tt.in, Flags: stun.FlagStrict}
+		b := make([]byte, m.Len())
+		n, err := m.Marshal(b, key)
+		if tt.out == nil {
+			if err == nil {
+				t.Errorf("#%d: got nil; want error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		_, rm, err := stun.ParseMessageFlags(b[:n], key, stun.FlagStrict)
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		attrs := rm.(*stun.Control).Attrs
+		if len(attrs) != len(tt.out) {
+			t.Errorf("#%d: got %d attributes; want %d", i, len(attrs), len(tt.out))
+			continue
+		}
+		for j := range attrs {
+			if reflect.TypeOf(attrs[j]) != reflect.TypeOf(tt.out[j]) {
+				t.Errorf("#%d: got %T; want %T", i, attrs[j], tt.out[j])
+			}
+		}
+		if !reflect.DeepEqual(tt.in, in) {
+			t.Errorf("#%d: got %#v; want %#v", i, tt.in, in)
+		}
+	}
+}
+
+// cloneAttrs returns a deep copy of attrs.
+func cloneAttrs(attrs []stun.Attribute) []stun.Attribute {
+	clone := make([]stun.Attribute, len(attrs))
+	for i, attr := range attrs {
+		switch attr := attr.(type) {
+		case stun.MessageIntegrity:
+			clone[i] = append(stun.MessageIntegrity{}, attr...)
+		case stun.MessageIntegritySHA256:
+			clone[i] = append(stun.MessageIntegritySHA256{}, attr...)
+		default:
+			clone[i] = attr
+		}
+	}
+	return clone
+}
+
+func TestAppendMarshal(t *testing.T) {
+	tests := append(rfc5769Tests, channelDataTests...)
+	for i, tt := range tests {
+		b := make([]byte, tt.raw.Len())
+		n, err := tt.raw.Marshal(b, tt.key)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		prefix := []byte("prefix")
+		var out []byte
+		var bb bytes.Buffer
+		switch m := tt.raw.(type) {
+		case *stun.Control:
+			out, err = m.AppendMarshal(prefix, tt.key)
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			if _, err := m.WriteTo(&bb); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+		case *stun.ChannelData:
+			out, err = m.AppendMarshal(prefix, tt.key)
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			if _, err := m.WriteTo(&bb); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+		}
+		if !bytes.Equal(out[:len(prefix)], prefix) || !bytes.Equal(out[len(prefix):], b[:n]) {
+			t.Fatalf("#%d: got %#v; want %#v", i, out[len(prefix):], b[:n])
+		}
+		mb, err := tt.raw.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !bytes.Equal(mb, bb.Bytes()) || len(mb) != n {
+			t.Fatalf("#%d: got %#v; want %#v", i, mb, bb.Bytes())
+		}
+	}
+}
+
+func TestControlReset(t *testing.T) {
+	m := stun.Control{
+		Type:   stun.MessageType(stun.ClassRequest, stun.MethodBinding),
+		Cookie: stun.MagicCookie,
+		TID:    make([]byte, 12),
+		Attrs:  []stun.Attribute{stun.Software("test"), stun.Fingerprint(0)},
+		Flags:  stun.FlagStrict,
+	}
+	m.Reset()
+	if m.Type != 0 || m.Cookie != nil || m.TID != nil || len(m.Attrs) != 0 || cap(m.Attrs) != 2 || m.Flags != 0 {
+		t.Fatalf("got %#v", m)
+	}
+}
+
+// raceEnabled reports whether the race detector is enabled, which
+// makes allocation counts unreliable.
+var raceEnabled = false
+
+func TestAppendMarshalAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("skipping test under race detector")
+	}
+	m := stun.Control{
+		Type:  stun.MessageType(stun.ClassSuccessResponse, stun.MethodBinding),
+		TID:   make([]byte, 12),
+		Attrs: []stun.Attribute{stun.Software("test"), stun.Fingerprint(0)},
+	}
+	b := make([]byte, 0, m.Len())
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := m.AppendMarshal(b[:0], nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("got %v allocs; want 0", allocs)
+	}
+}
+
+func TestAddrPort(t *testing.T) {
+	m := &stun.Control{
+		Type:   stun.MessageType(stun.ClassSuccessResponse, stun.MethodAllocate),
+		Cookie: stun.MagicCookie,
+		TID:    []byte("0123456789ab"),
+		Attrs: []stun.Attribute{
+			stun.XORMappedAddrPort{AddrPort: netip.MustParseAddrPort("192.0.2.1:32853")},
+			stun.XORPeerAddrPort{AddrPort: netip.MustParseAddrPort("192.0.2.2:49152")},
+			stun.XORRelayedAddrPort{AddrPort: netip.MustParseAddrPort("192.0.2.3:49153")},
+			stun.AlternateServerAddrPort{AddrPort: netip.MustParseAddrPort("192.0.2.4:3478")},
+			stun.AlternateServerAddrPort{AddrPort: netip.MustParseAddrPort("[2001:db8::4]:3478")},
+			stun.AlternateServerAddrPort{AddrPort: netip.MustParseAddrPort("[::ffff:192.0.2.4]:3478")},
+		},
+	}
+	b := make([]byte, m.Len())
+	n, err := m.Marshal(b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, mm, err := stun.ParseMessageFlags(b[:n], nil, stun.FlagAddrPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mm.(*stun.Control).Attrs, m.Attrs) {
+		t.Fatalf("got %#v; want %#v", mm.(*stun.Control).Attrs, m.Attrs)
+	}
+
+	_, mm, err = stun.ParseMessage(b[:n], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, attr := range mm.(*stun.Control).Attrs {
+		var a *stun.Addr
+		switch attr := attr.(type) {
+		case *stun.XORMappedAddr:
+			a = (*stun.Addr)(attr)
+		case *stun.XORPeerAddr:
+			a = (*stun.Addr)(attr)
+		case *stun.XORRelayedAddr:
+			a = (*stun.Addr)(attr)
+		case *stun.AlternateServer:
+			a = (*stun.Addr)(attr)
+		default:
+			t.Fatalf("#%d: unknown type: %T", i, attr)
+		}
+		ap := reflect.ValueOf(m.Attrs[i]).Field(0).Interface().(netip.AddrPort)
+		want := netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+		if a.AddrPort() != want {
+			t.Errorf("#%d: got %v; want %v", i, a.AddrPort(), want)
+		}
+		if ua := net.UDPAddrFromAddrPort(ap); ua.AddrPort() != ap {
+			t.Errorf("#%d: got %v; want %v", i, ua.AddrPort(), ap)
+		}
+		if ta := net.TCPAddrFromAddrPort(ap); ta.AddrPort() != ap {
+			t.Errorf("#%d: got %v; want %v", i, ta.AddrPort(), ap)
+		}
+		if a := stun.AddrFromAddrPort(ap); !a.IP.Equal(ap.Addr().AsSlice()) || a.Port != int(ap.Port()) {
+			t.Errorf("#%d: got %v; want %v", i, a, ap)
+		}
+	}
+}
+
+func TestLegacyMessage(t *testing.T) {
+	m := &stun.Control{
+		Type:   stun.MessageType(stun.ClassRequest, stun.MethodBinding),
+		Cookie: []byte("\xde\xad\xbe\xef"),
+		TID:    []byte("0123456789ab"),
+		Attrs: []stun.Attribute{
+			stun.Username("user"),
+			&stun.XORMappedAddr{Port: 3478, IP: net.ParseIP("192.0.2.1")},
+			stun.ChangeRequestIP,
+			stun.MessageIntegrity(nil),
+		},
+	}
+	k := stun.ShortTermKey("pass")
+	b := make([]byte, m.Len())
+	n, err := m.Marshal(b, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := n - 24 // MESSAGE-INTEGRITY
+	h := hmac.New(sha1.New, []byte("pass"))
+	h.Write(b[:off])
+	h.Write(make([]byte, (64-off%64)%64))
+	if !bytes.Equal(b[off+4:n], h.Sum(nil)) {
+		t.Fatalf("got %#v; want %#v", b[off+4:n], h.Sum(nil))
+	}
+
+	_, rm, err := stun.ParseMessage(b[:n], k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := rm.(*stun.Control)
+	if !req.Legacy() {
+		t.Fatal("got false; want true")
+	}
+	if _, ok := req.Attrs[1].(*stun.DefaultAttr); !ok {
+		t.Fatalf("got %T; want *stun.DefaultAttr", req.Attrs[1])
+	}
+	if req.Attrs[2] != stun.ChangeRequestIP {
+		t.Fatalf("got %#v; want %#v", req.Attrs[2], stun.ChangeRequestIP)
+	}
+	b[off+4] ^= 0xff
+	if _, _, err := stun.ParseMessage(b[:n], k); err == nil {
+		t.Fatal("got nil; want error")
+	}
+}
+
+func TestBindingResponse(t *testing.T) {
+	addr := netip.MustParseAddrPort("192.0.2.1:32853")
+	for i, tt := range []struct {
+		cookie []byte
+		attr   stun.Attribute
+	}{
+		{stun.MagicCookie, stun.XORMappedAddrPort{AddrPort: addr}},
+		{[]byte("\xde\xad\xbe\xef"), stun.MappedAddrPort{AddrPort: addr}},
+	} {
+		req := &stun.Control{
+			Type:   stun.MessageType(stun.ClassRequest, stun.MethodBinding),
+			Cookie: tt.cookie,
+			TID:    []byte("0123456789ab"),
+		}
+		resp := stun.BindingResponse(req, addr)
+		if resp == nil {
+			t.Fatalf("#%d: got nil; want response", i)
+		}
+		if !reflect.DeepEqual(resp.Attrs, []stun.Attribute{tt.attr}) {
+			t.Fatalf("#%d: got %#v; want %#v", i, resp.Attrs, tt.attr)
+		}
+		b, err := resp.MarshalBinary()
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		_, m, err := stun.ParseMessage(b, nil)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if ap, ok := stun.ReflexiveAddr(m.(*stun.Control)); !ok || ap != addr {
+			t.Fatalf("#%d: got %v, %v; want %v, true", i, ap, ok, addr)
+		}
+		if stun.BindingResponse(resp, addr) != nil {
+			t.Fatalf("#%d: got response for response", i)
+		}
+	}
+
+	m := &stun.Control{
+		Attrs: []stun.Attribute{
+			&stun.MappedAddr{Port: 1, IP: net.ParseIP("192.0.2.1")},
+			&stun.XORMappedAddr{Port: 2, IP: net.ParseIP("192.0.2.2")},
+		},
+	}
+	if ap, ok := stun.ReflexiveAddr(m); !ok || ap != netip.MustParseAddrPort("192.0.2.2:2") {
+		t.Fatalf("got %v, %v; want 192.0.2.2:2, true", ap, ok)
+	}
+	if _, ok := stun.ReflexiveAddr(&stun.Control{}); ok {
+		t.Fatal("got true; want false")
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/mikioh/stun"
+	"github.com/mikioh/stun/internal/netutil"
+)
+
+// A Behavior represents a mapping or filtering behavior of NAT.
+type Behavior int
+
+const (
+	Unknown                 Behavior = iota // undetermined
+	EndpointIndependent                     // endpoint-independent
+	AddressDependent                        // address-dependent
+	AddressAndPortDependent                 // address and port-dependent
+)
+
+var behaviors = map[Behavior]string{
+	Unknown:                 "unknown",
+	EndpointIndependent:     "endpoint-independent",
+	AddressDependent:        "address-dependent",
+	AddressAndPortDependent: "address and port-dependent",
+}
+
+func (b Behavior) String() string {
+	s, ok := behaviors[b]
+	if !ok {
+		return "<nil>"
+	}
+	return s
+}
+
+// A Result represents the result of NAT behavior discovery.
+type Result struct {
+	MappedAddr  netip.AddrPort // reflexive transport address
+	OtherAddr   netip.AddrPort // alternate address of server
+	Mapping     Behavior       // mapping behavior
+	Filtering   Behavior       // filtering behavior
+	Hairpinning bool           // whether hairpinning is supported
+}
+
+var (
+	errNoResponse   = errors.New("no response")
+	errNoOtherAddr  = errors.New("server does not support RFC 5780")
+	errNoChange     = errors.New("server does not honor CHANGE-REQUEST")
+	errNoMappedAddr = errors.New("no mapped address")
+)
+
+// Retransmission parameters of STUN transaction. The total time
+// waiting for a response is rto*(2^(maxRetransmits+1)-1).
+var (
+	rto            = 200 * time.Millisecond
+	maxRetransmits = 3
+)
+
+// Discover runs the mapping, filtering and hairpinning tests described
+// in RFC 5780 section 4 over conn against the STUN server at server.
+// The server must support RFC 5780; it must return OTHER-ADDRESS
+// attribute and honor CHANGE-REQUEST attribute.
+//
+// Discover uses the read deadline of conn to wait for responses and
+// clears it on return. The hairpinning test sends a request from
+// another local port on the IP address of conn.
+func Discover(ctx context.Context, conn net.PacketConn, server net.Addr) (*Result, error) {
+	primary, err := netutil.UDPAddrPort(server)
+	if err != nil {
+		return nil, &net.OpError{Op: "discover", Net: "udp", Addr: server, Err: err}
+	}
+	p := prober{conn: conn, buf: make([]byte, stun.MaxMessageSize)}
+	stop := context.AfterFunc(ctx, p.cancel)
+	defer func() {
+		stop()
+		conn.SetReadDeadline(time.Time{})
+	}()
+
+	// Test I; the basic Binding test
+	m, err := p.binding(ctx, primary)
+	if err != nil {
+		return nil, discoverError(server, err)
+	}
+	var res Result
+	var ok bool
+	if res.MappedAddr, ok = stun.ReflexiveAddr(m); !ok {
+		return nil, discoverError(server, errNoMappedAddr)
+	}
+	oa, ok := stun.Get[*stun.OtherAddr](m)
+	if !ok {
+		return nil, discoverError(server, errNoOtherAddr)
+	}
+	res.OtherAddr = netutil.Unmap((*stun.Addr)(oa).AddrPort())
+
+	// The filtering tests run before the mapping tests; the mapping
+	// tests send requests to the alternate address, which opens
+	// the NAT filter for the responses to the filtering tests.
+	if res.Filtering, err = p.filtering(ctx, primary, res.OtherAddr); err != nil {
+		return nil, discoverError(server, err)
+	}
+	if res.Mapping, err = p.mapping(ctx, primary, res.OtherAddr, res.MappedAddr); err != nil {
+		return nil, discoverError(server, err)
+	}
+	if res.Hairpinning, err = p.hairpinning(ctx, res.MappedAddr); err != nil {
+		return nil, discoverError(server, err)
+	}
+	return &res, nil
+}
+
+// mapping runs the mapping behavior tests described in RFC 5780
+// section 4.3.
+func (p *prober) mapping(ctx context.Context, primary, other, mapped netip.AddrPort) (Behavior, error) {
+	// Test II; the alternate address and the primary port
+	m, err := p.binding(ctx, netip.AddrPortFrom(other.Addr(), primary.Port()))
+	if err == errNoResponse {
+		return Unknown, nil
+	}
+	if err != nil {
+		return Unknown, err
+	}
+	mapped2, ok := stun.ReflexiveAddr(m)
+	if !ok {
+		return Unknown, errNoMappedAddr
+	}
+	if mapped2 == mapped {
+		return EndpointIndependent, nil
+	}
+
+	// Test III; the alternate address and the alternate port
+	m, err = p.binding(ctx, other)
+	if err == errNoResponse {
+		return Unknown, nil
+	}
+	if err != nil {
+		return Unknown, err
+	}
+	mapped3, ok := stun.ReflexiveAddr(m)
+	if !ok {
+		return Unknown, errNoMappedAddr
+	}
+	if mapped3 == mapped2 {
+		return AddressDependent, nil
+	}
+	return AddressAndPortDependent, nil
+}
+
+// filtering runs the filtering behavior tests described in RFC 5780
+// section 4.4.
+// The RESPONSE-ORIGIN attribute of responses must be the changed
+// address; a server that ignores CHANGE-REQUEST attribute responds
+// from the primary address.
+func (p *prober) filtering(ctx context.Context, primary, other netip.AddrPort) (Behavior, error) {
+	// Test II; request to change the IP address and port
+	m, err := p.binding(ctx, primary, stun.NewChangeRequest(true, true))
+	if err == nil {
+		if responseOrigin(m) != other {
+			return Unknown, errNoChange
+		}
+		return EndpointIndependent, nil
+	}
+	if err != errNoResponse {
+		return Unknown, err
+	}
+
+	// Test III; request to change the port
+	m, err = p.binding(ctx, primary, stun.NewChangeRequest(false, true))
+	if err == nil {
+		if responseOrigin(m) != netip.AddrPortFrom(primary.Addr(), other.Port()) {
+			return Unknown, errNoChange
+		}
+		return AddressDependent, nil
+	}
+	if err != errNoResponse {
+		return Unknown, err
+	}
+	return AddressAndPortDependent, nil
+}
+
+// hairpinning runs the hairpinning test described in RFC 5780
+// section 4.5.
+// The request is sent from another local port, so that the filtering
+// behavior of NAT does not drop the request.
+func (p *prober) hairpinning(ctx context.Context, mapped netip.AddrPort) (bool, error) {
+	var ip netip.Addr
+	if laddr, err := netutil.UDPAddrPort(p.conn.LocalAddr()); err == nil {
+		ip = laddr.Addr()
+	}
+	c, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)))
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	req, err := newBindingRequest()
+	if err != nil {
+		return false, err
+	}
+	_, err = p.roundTrip(ctx, c, mapped, req, stun.ClassRequest)
+	if err == errNoResponse {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// A prober runs STUN transactions over a packet connection.
+type prober struct {
+	conn net.PacketConn
+	buf  []byte
+
+	mu       sync.Mutex
+	canceled bool
+}
+
+// cancel interrupts the read in progress and makes subsequent
+// setDeadline calls fail.
+func (p *prober) cancel() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.canceled = true
+	p.conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+// setDeadline sets the read deadline of the connection unless
+// canceled.
+func (p *prober) setDeadline(ctx context.Context, t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.canceled {
+		return ctx.Err()
+	}
+	return p.conn.SetReadDeadline(t)
+}
+
+func (p *prober) binding(ctx context.Context, dst netip.AddrPort, attrs ...stun.Attribute) (*stun.Control, error) {
+	req, err := newBindingRequest(attrs...)
+	if err != nil {
+		return nil, err
+	}
+	return p.roundTrip(ctx, p.conn, dst, req, stun.ClassSuccessResponse)
+}
+
+// roundTrip sends req to dst over w and waits for a message of class
+// c with the same transaction ID as req on the connection of p,
+// retransmitting req as described in RFC 5389 section 7.2.1.
+// It returns errNoResponse when no message arrives.
+func (p *prober) roundTrip(ctx context.Context, w net.PacketConn, dst netip.AddrPort, req *stun.Control, c stun.Class) (*stun.Control, error) {
+	wb, err := req.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	to := net.UDPAddrFromAddrPort(dst)
+	d := rto
+	for i := 0; i <= maxRetransmits; i++ {
+		if _, err := w.WriteTo(wb, to); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(d)
+		d *= 2
+		for {
+			if err := p.setDeadline(ctx, deadline); err != nil {
+				return nil, err
+			}
+			n, _, err := p.conn.ReadFrom(p.buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					if err := ctx.Err(); err != nil {
+						return nil, err
+					}
+					break
+				}
+				return nil, err
+			}
+			_, m, err := stun.ParseMessage(p.buf[:n], nil)
+			if err != nil {
+				continue
+			}
+			if m, ok := m.(*stun.Control); ok && m.Type.Class() == c && bytes.Equal(m.TID, req.TID) {
+				return m, nil
+			}
+		}
+	}
+	return nil, errNoResponse
+}
+
+func newBindingRequest(attrs ...stun.Attribute) (*stun.Control, error) {
+	tid, err := stun.TransactionID()
+	if err != nil {
+		return nil, err
+	}
+	return &stun.Control{
+		Type:   stun.MessageType(stun.ClassRequest, stun.MethodBinding),
+		Cookie: stun.MagicCookie,
+		TID:    tid,
+		Attrs:  attrs,
+	}, nil
+}
+
+// responseOrigin returns the RESPONSE-ORIGIN attribute of m.
+func responseOrigin(m *stun.Control) netip.AddrPort {
+	ro, ok := stun.Get[*stun.ResponseOrigin](m)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	return netutil.Unmap((*stun.Addr)(ro).AddrPort())
+}
+
+func discoverError(server net.Addr, err error) error {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	return &net.OpError{Op: "discover", Net: "udp", Addr: server, Err: err}
+}
@@ -0,0 +1,300 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mikioh/stun"
+	"github.com/mikioh/stun/internal/netutil"
+)
+
+func newTestServer(t *testing.T) *Server {
+	s, err := NewServer(netip.MustParseAddrPort("127.0.0.1:0"), netip.MustParseAddrPort("127.0.0.2:0"))
+	if err != nil {
+		t.Skipf("loopback alias not available: %v", err)
+	}
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// A testNAT is a net.PacketConn which simulates the mapping,
+// filtering and hairpinning behaviors of NAT placed in front of the
+// client.
+// Each mapping is a UDP socket on 127.0.0.1. Datagrams from the
+// endpoints other than the server are treated as hairpinned.
+type testNAT struct {
+	mapping, filtering Behavior
+	hairpinning        bool
+	server             map[netip.AddrPort]bool // transport addresses of server
+
+	pkts   chan testPacket
+	closed chan struct{}
+
+	mu       sync.Mutex
+	ports    map[netip.AddrPort]*testMapping // keyed by mapping behavior
+	deadline time.Time
+	notify   chan struct{} // closed when deadline changes
+}
+
+type testMapping struct {
+	c    net.PacketConn
+	sent map[netip.AddrPort]bool // destinations
+}
+
+type testPacket struct {
+	b    []byte
+	from net.Addr
+}
+
+func newTestNAT(t *testing.T, s *Server, mapping, filtering Behavior, hairpinning bool) *testNAT {
+	primary, other := s.Addr(), s.OtherAddr()
+	n := &testNAT{
+		mapping:     mapping,
+		filtering:   filtering,
+		hairpinning: hairpinning,
+		server: map[netip.AddrPort]bool{
+			primary: true,
+			other:   true,
+			netip.AddrPortFrom(primary.Addr(), other.Port()): true,
+			netip.AddrPortFrom(other.Addr(), primary.Port()): true,
+		},
+		pkts:   make(chan testPacket, 16),
+		closed: make(chan struct{}),
+		ports:  make(map[netip.AddrPort]*testMapping),
+		notify: make(chan struct{}),
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func (n *testNAT) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst, err := netutil.UDPAddrPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	var key netip.AddrPort
+	switch n.mapping {
+	case AddressDependent:
+		key = netip.AddrPortFrom(dst.Addr(), 0)
+	case AddressAndPortDependent:
+		key = dst
+	}
+	n.mu.Lock()
+	m := n.ports[key]
+	if m == nil {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			n.mu.Unlock()
+			return 0, err
+		}
+		m = &testMapping{c: c, sent: make(map[netip.AddrPort]bool)}
+		n.ports[key] = m
+		go n.receive(m)
+	}
+	m.sent[dst] = true
+	n.mu.Unlock()
+	return m.c.WriteTo(b, addr)
+}
+
+func (n *testNAT) receive(m *testMapping) {
+	for {
+		b := make([]byte, stun.MaxMessageSize)
+		nn, from, err := m.c.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		src, _ := netutil.UDPAddrPort(from)
+		if !n.permitted(m, src) {
+			continue
+		}
+		select {
+		case n.pkts <- testPacket{b: b[:nn], from: from}:
+		default:
+		}
+	}
+}
+
+func (n *testNAT) permitted(m *testMapping, src netip.AddrPort) bool {
+	if !n.server[src] {
+		return n.hairpinning
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch n.filtering {
+	case AddressDependent:
+		for dst := range m.sent {
+			if dst.Addr() == src.Addr() {
+				return true
+			}
+		}
+		return false
+	case AddressAndPortDependent:
+		return m.sent[src]
+	default:
+		return true
+	}
+}
+
+func (n *testNAT) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n.mu.Lock()
+		deadline, notify := n.deadline, n.notify
+		n.mu.Unlock()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case p := <-n.pkts:
+			return copy(b, p.b), p.from, nil
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-notify:
+		case <-n.closed:
+			return 0, nil, net.ErrClosed
+		}
+	}
+}
+
+func (n *testNAT) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-n.closed:
+		return nil
+	default:
+	}
+	close(n.closed)
+	for _, m := range n.ports {
+		m.c.Close()
+	}
+	return nil
+}
+
+func (n *testNAT) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (n *testNAT) SetDeadline(t time.Time) error {
+	return n.SetReadDeadline(t)
+}
+
+func (n *testNAT) SetReadDeadline(t time.Time) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.deadline = t
+	close(n.notify)
+	n.notify = make(chan struct{})
+	return nil
+}
+
+func (n *testNAT) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func TestDiscover(t *testing.T) {
+	defer func(d time.Duration) { rto = d }(rto)
+	rto = 10 * time.Millisecond
+
+	s := newTestServer(t)
+	for _, tt := range []struct {
+		mapping, filtering Behavior
+		hairpinning        bool
+	}{
+		{EndpointIndependent, EndpointIndependent, true},
+		{EndpointIndependent, AddressDependent, true},
+		{AddressDependent, AddressAndPortDependent, false},
+		{AddressAndPortDependent, AddressDependent, true},
+		{AddressAndPortDependent, AddressAndPortDependent, true},
+	} {
+		c := newTestNAT(t, s, tt.mapping, tt.filtering, tt.hairpinning)
+		res, err := Discover(context.Background(), c, net.UDPAddrFromAddrPort(s.Addr()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Mapping != tt.mapping || res.Filtering != tt.filtering || res.Hairpinning != tt.hairpinning {
+			t.Errorf("got %v, %v, %v; want %v, %v, %v", res.Mapping, res.Filtering, res.Hairpinning, tt.mapping, tt.filtering, tt.hairpinning)
+		}
+		if !res.MappedAddr.Addr().IsLoopback() || res.OtherAddr != s.OtherAddr() {
+			t.Errorf("got %v, %v; want loopback address, %v", res.MappedAddr, res.OtherAddr, s.OtherAddr())
+		}
+	}
+}
+
+func TestDiscoverErrors(t *testing.T) {
+	defer func(d time.Duration) { rto = d }(rto)
+	rto = 10 * time.Millisecond
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+
+	if _, err := Discover(context.Background(), c, dead.LocalAddr()); err == nil {
+		t.Error("got nil; want error")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Discover(ctx, c, dead.LocalAddr()); err != context.Canceled {
+		t.Errorf("got %v; want %v", err, context.Canceled)
+	}
+
+	// The cancellation interrupts the retransmission timer.
+	rto = time.Second
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := Discover(ctx, c, dead.LocalAddr()); err != context.DeadlineExceeded {
+		t.Errorf("got %v; want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("took %v after cancellation", d)
+	}
+	rto = 10 * time.Millisecond
+
+	if _, err := Discover(context.Background(), c, &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}); err == nil {
+		t.Error("got nil; want error")
+	}
+
+	// The server ignores CHANGE-REQUEST attribute and responds
+	// from the primary address.
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := ln.LocalAddr().(*net.UDPAddr).AddrPort()
+	srv := &stun.Server{Handler: stun.HandlerFunc(func(w stun.ResponseWriter, r *stun.Request) {
+		resp := stun.BindingResponse(r.Message, r.RemoteAddr.(*net.UDPAddr).AddrPort())
+		resp.Add(stun.ResponseOriginAddrPort{AddrPort: primary})
+		resp.Add(stun.OtherAddrPort{AddrPort: netip.AddrPortFrom(netip.MustParseAddr("127.0.0.2"), primary.Port()+1)})
+		w.Write(resp, nil)
+	})}
+	go srv.ServePacket(ln)
+	defer srv.Close()
+	if _, err := Discover(context.Background(), c, ln.LocalAddr()); err == nil || !errors.Is(err, errNoChange) {
+		t.Errorf("got %v; want %v", err, errNoChange)
+	}
+}
@@ -0,0 +1,8 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nat implements the NAT behavior discovery using STUN.
+//
+// NAT Behavior Discovery Using STUN is defined in RFC 5780.
+package nat
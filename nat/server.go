@@ -0,0 +1,171 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nat
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"github.com/mikioh/stun"
+	"github.com/mikioh/stun/internal/netutil"
+)
+
+// A Server represents an RFC 5780-capable STUN server.
+//
+// The server listens on the four combinations of a primary and an
+// alternate IP address and port, honors CHANGE-REQUEST and
+// RESPONSE-PORT attributes, and fills in RESPONSE-ORIGIN and
+// OTHER-ADDRESS attributes of Binding responses.
+type Server struct {
+	conns [2][2]net.PacketConn // indexed by IP address and port
+	wg    sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewServer returns a new Server listening on primary and alternate
+// IP addresses. A zero port number chooses an available port; the
+// alternate port number, if zero, is chosen to be available on both
+// IP addresses.
+func NewServer(primary, alternate netip.AddrPort) (*Server, error) {
+	if primary.Addr() == alternate.Addr() {
+		return nil, errors.New("same primary and alternate IP addresses")
+	}
+	var s Server
+	ips := [2]netip.Addr{primary.Addr(), alternate.Addr()}
+	ports := [2]uint16{primary.Port(), alternate.Port()}
+	for j := range ports {
+		var err error
+		if s.conns[0][j], err = listen(ips[0], ports[j]); err != nil {
+			s.Close()
+			return nil, err
+		}
+		ports[j] = s.conns[0][j].LocalAddr().(*net.UDPAddr).AddrPort().Port()
+		if s.conns[1][j], err = listen(ips[1], ports[j]); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if ports[0] == ports[1] {
+		s.Close()
+		return nil, errors.New("same primary and alternate port numbers")
+	}
+	return &s, nil
+}
+
+func listen(ip netip.Addr, port uint16) (net.PacketConn, error) {
+	return net.ListenPacket("udp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+}
+
+// Addr returns the primary transport address of s.
+func (s *Server) Addr() netip.AddrPort {
+	return s.addr(0, 0)
+}
+
+// OtherAddr returns the alternate transport address of s.
+func (s *Server) OtherAddr() netip.AddrPort {
+	return s.addr(1, 1)
+}
+
+func (s *Server) addr(i, j int) netip.AddrPort {
+	return s.conns[i][j].LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// Serve serves Binding requests until s is closed.
+// It always returns nil after s is closed.
+func (s *Server) Serve() error {
+	errs := make(chan error, 4)
+	for i := range s.conns {
+		for j := range s.conns[i] {
+			s.wg.Add(1)
+			go func(i, j int) {
+				defer s.wg.Done()
+				errs <- s.serve(i, j)
+			}(i, j)
+		}
+	}
+	err := <-errs
+	s.Close()
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	return err
+}
+
+// Close closes s.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	for i := range s.conns {
+		for j := range s.conns[i] {
+			if s.conns[i][j] != nil {
+				s.conns[i][j].Close()
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) serve(i, j int) error {
+	b := make([]byte, stun.MaxMessageSize)
+	for {
+		n, from, err := s.conns[i][j].ReadFrom(b)
+		if err != nil {
+			return err
+		}
+		_, m, err := stun.ParseMessage(b[:n], nil)
+		if err != nil {
+			continue
+		}
+		req, ok := m.(*stun.Control)
+		if !ok || req.Type != stun.MessageType(stun.ClassRequest, stun.MethodBinding) {
+			continue
+		}
+		ri, rj, to, resp := s.response(i, j, from.(*net.UDPAddr), req)
+		wb, err := resp.MarshalBinary()
+		if err != nil {
+			continue
+		}
+		s.conns[ri][rj].WriteTo(wb, to)
+	}
+}
+
+// response returns the response for req received on the socket
+// indexed by i and j, and the socket and destination for the
+// response.
+func (s *Server) response(i, j int, from *net.UDPAddr, req *stun.Control) (int, int, *net.UDPAddr, *stun.Control) {
+	if resp := stun.UnknownAttrsResponse(req); resp != nil {
+		return i, j, from, resp
+	}
+	ri, rj, to := i, j, from
+	if cr, ok := stun.Get[stun.ChangeRequest](req); ok {
+		if cr.ChangeIP() {
+			ri = 1 - i
+		}
+		if cr.ChangePort() {
+			rj = 1 - j
+		}
+	}
+	if rp, ok := stun.Get[stun.ResponsePort](req); ok && !req.Legacy() {
+		to = &net.UDPAddr{IP: from.IP, Port: int(rp), Zone: from.Zone}
+	}
+	resp := stun.BindingResponse(req, netutil.Unmap(from.AddrPort()))
+	if req.Legacy() {
+		resp.Add(stun.SourceAddrPort{AddrPort: s.addr(ri, rj)})
+		resp.Add(stun.ChangedAddrPort{AddrPort: s.addr(1-i, 1-j)})
+	} else {
+		resp.Add(stun.ResponseOriginAddrPort{AddrPort: s.addr(ri, rj)})
+		resp.Add(stun.OtherAddrPort{AddrPort: s.addr(1-i, 1-j)})
+	}
+	return ri, rj, to, resp
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nat_test
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/mikioh/stun"
+	"github.com/mikioh/stun/nat"
+)
+
+func newServer(t *testing.T) *nat.Server {
+	s, err := nat.NewServer(netip.MustParseAddrPort("127.0.0.1:0"), netip.MustParseAddrPort("127.0.0.2:0"))
+	if err != nil {
+		t.Skipf("loopback alias not available: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- s.Serve() }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	return s
+}
+
+func exchange(t *testing.T, c, rc net.PacketConn, dst netip.AddrPort, req *stun.Control) (*stun.Control, netip.AddrPort) {
+	wb, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.WriteTo(wb, net.UDPAddrFromAddrPort(dst)); err != nil {
+		t.Fatal(err)
+	}
+	rb := make([]byte, stun.MaxMessageSize)
+	rc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := rc.ReadFrom(rb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, m, err := stun.ParseMessage(rb[:n], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.(*stun.Control), from.(*net.UDPAddr).AddrPort()
+}
+
+func TestServer(t *testing.T) {
+	s := newServer(t)
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	rc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	local := c.LocalAddr().(*net.UDPAddr).AddrPort()
+	rport := rc.LocalAddr().(*net.UDPAddr).Port
+
+	other := s.OtherAddr()
+	for i, tt := range []struct {
+		attrs  []stun.Attribute
+		origin netip.AddrPort
+	}{
+		{nil, s.Addr()},
+		{[]stun.Attribute{stun.NewChangeRequest(true, false)}, netip.AddrPortFrom(other.Addr(), s.Addr().Port())},
+		{[]stun.Attribute{stun.NewChangeRequest(false, true)}, netip.AddrPortFrom(s.Addr().Addr(), other.Port())},
+		{[]stun.Attribute{stun.NewChangeRequest(true, true)}, other},
+		{[]stun.Attribute{stun.ResponsePort(rport)}, s.Addr()},
+	} {
+		tid, err := stun.TransactionID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &stun.Control{
+			Type:  stun.MessageType(stun.ClassRequest, stun.MethodBinding),
+			TID:   tid,
+			Attrs: tt.attrs,
+		}
+		r := c
+		if _, ok := stun.Get[stun.ResponsePort](req); ok {
+			r = rc
+		}
+		resp, from := exchange(t, c, r, s.Addr(), req)
+		if from != tt.origin {
+			t.Errorf("#%d: got %v; want %v", i, from, tt.origin)
+		}
+		if ap, ok := stun.ReflexiveAddr(resp); !ok || ap != local {
+			t.Errorf("#%d: got %v; want %v", i, ap, local)
+		}
+		if ro, ok := stun.Get[*stun.ResponseOrigin](resp); !ok || (*stun.Addr)(ro).AddrPort() != tt.origin {
+			t.Errorf("#%d: got %v; want %v", i, ro, tt.origin)
+		}
+		if oa, ok := stun.Get[*stun.OtherAddr](resp); !ok || (*stun.Addr)(oa).AddrPort() != other {
+			t.Errorf("#%d: got %v; want %v", i, oa, other)
+		}
+	}
+
+	req := &stun.Control{
+		Type:   stun.MessageType(stun.ClassRequest, stun.MethodBinding),
+		Cookie: []byte("\xde\xad\xbe\xef"),
+		TID:    []byte("0123456789ab"),
+	}
+	resp, _ := exchange(t, c, c, s.Addr(), req)
+	if ma, ok := stun.Get[*stun.MappedAddr](resp); !ok || (*stun.Addr)(ma).AddrPort() != local {
+		t.Errorf("got %v; want %v", ma, local)
+	}
+	if ca, ok := stun.Get[*stun.ChangedAddr](resp); !ok || (*stun.Addr)(ca).AddrPort() != other {
+		t.Errorf("got %v; want %v", ca, other)
+	}
+}
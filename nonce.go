@@ -0,0 +1,222 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Errors returned by NonceManager.
+var (
+	// ErrInvalidNonce is returned when a nonce is not issued by
+	// NonceManager or is issued for another client.
+	ErrInvalidNonce = errors.New("invalid nonce")
+
+	// ErrStaleNonce is returned when a nonce has expired.
+	ErrStaleNonce = errors.New("stale nonce")
+)
+
+// DefaultNonceLifetime is the default lifetime of nonces issued by
+// NonceManager.
+const DefaultNonceLifetime = 10 * time.Minute
+
+const (
+	nonceTimeLen = 8
+	nonceMACLen  = 16
+)
+
+// A NonceManager issues and validates STUN NONCE attributes without
+// keeping per-client state.
+//
+// A nonce consists of the time of issue and an HMAC over the time
+// and the 5-tuple of the client; a nonce is valid only for the client
+// it is issued to, and expires after Lifetime.
+//
+// For key rotation in multi-instance deployments, SetKeys installs
+// the shared keys; the first key is used for issuing nonces and all
+// the keys are accepted for validation. The zero value uses a random
+// key generated on first use.
+//
+// Multiple goroutines may invoke methods on a NonceManager
+// simultaneously.
+type NonceManager struct {
+	// Lifetime specifies the lifetime of nonces.
+	// If zero, DefaultNonceLifetime is used.
+	Lifetime time.Duration
+
+	// Now optionally specifies the function returning the current
+	// time for issuing and validating nonces.
+	// If nil, time.Now is used.
+	Now func() time.Time
+
+	mu   sync.RWMutex
+	keys [][]byte
+}
+
+// NewNonceManager returns a new NonceManager with the keys.
+func NewNonceManager(keys ...[]byte) *NonceManager {
+	nm := &NonceManager{}
+	nm.SetKeys(keys...)
+	return nm
+}
+
+// SetKeys replaces the keys with keys.
+func (nm *NonceManager) SetKeys(keys ...[]byte) {
+	ks := make([][]byte, len(keys))
+	for i, k := range keys {
+		ks[i] = append([]byte(nil), k...)
+	}
+	nm.mu.Lock()
+	nm.keys = ks
+	nm.mu.Unlock()
+}
+
+func (nm *NonceManager) now() time.Time {
+	if nm.Now != nil {
+		return nm.Now()
+	}
+	return time.Now()
+}
+
+func (nm *NonceManager) getKeys() ([][]byte, error) {
+	nm.mu.RLock()
+	keys := nm.keys
+	nm.mu.RUnlock()
+	if len(keys) > 0 {
+		return keys, nil
+	}
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if len(nm.keys) == 0 {
+		k := make([]byte, sha256.Size)
+		if _, err := io.ReadFull(rand.Reader, k); err != nil {
+			return nil, err
+		}
+		nm.keys = [][]byte{k}
+	}
+	return nm.keys, nil
+}
+
+// Nonce returns a new nonce for the client of the request r.
+// It returns an error when no key is installed and a random key
+// cannot be generated.
+func (nm *NonceManager) Nonce(r *Request) (Nonce, error) {
+	keys, err := nm.getKeys()
+	if err != nil {
+		return "", err
+	}
+	var b [nonceTimeLen + nonceMACLen]byte
+	binary.BigEndian.PutUint64(b[:nonceTimeLen], uint64(nm.now().UnixNano()))
+	mac := nonceMAC(keys[0], b[:nonceTimeLen], r)
+	copy(b[nonceTimeLen:], mac)
+	return Nonce(base64.RawURLEncoding.EncodeToString(b[:])), nil
+}
+
+// Validate validates the nonce n for the client of the request r.
+// It returns ErrInvalidNonce if n is not issued for the client, or
+// ErrStaleNonce if n has expired.
+func (nm *NonceManager) Validate(r *Request, n Nonce) error {
+	b, err := base64.RawURLEncoding.DecodeString(string(n))
+	if err != nil || len(b) != nonceTimeLen+nonceMACLen {
+		return ErrInvalidNonce
+	}
+	keys, err := nm.getKeys()
+	if err != nil {
+		return err
+	}
+	var ok bool
+	for _, k := range keys {
+		if hmac.Equal(nonceMAC(k, b[:nonceTimeLen], r)[:nonceMACLen], b[nonceTimeLen:]) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return ErrInvalidNonce
+	}
+	lifetime := nm.Lifetime
+	if lifetime <= 0 {
+		lifetime = DefaultNonceLifetime
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(b[:nonceTimeLen])))
+	if now := nm.now(); now.Before(issued) || now.Sub(issued) > lifetime {
+		return ErrStaleNonce
+	}
+	return nil
+}
+
+// Check checks the NONCE attribute of the request r with the realm
+// as described in RFC 8489 section 9.2.4.
+// It returns an error response with the STUN error code 401 and new
+// nonce when r carries no credential or an invalid nonce, the one
+// with the STUN error code 438 when the nonce has expired, and the
+// one with the STUN error code 400 when the credential is incomplete,
+// and the one with the STUN error code 500 when no nonce can be
+// issued or validated.
+// It returns nil when the nonce is valid; the caller is responsible
+// for verifying MESSAGE-INTEGRITY or MESSAGE-INTEGRITY-SHA256
+// attribute.
+func (nm *NonceManager) Check(r *Request, realm Realm) *Control {
+	m := r.Message
+	if m.Type.Class() != ClassRequest {
+		return nil
+	}
+	if !Has[MessageIntegrity](m) && !Has[MessageIntegritySHA256](m) {
+		return nm.challenge(r, realm, StatusUnauthorized)
+	}
+	nonce, ok := Get[Nonce](m)
+	if !ok || !Has[Username](m) || !Has[Realm](m) {
+		return ErrorResponse(m, StatusBadRequest)
+	}
+	switch nm.Validate(r, nonce) {
+	case nil:
+		return nil
+	case ErrStaleNonce:
+		return nm.challenge(r, realm, StatusStaleNonce)
+	case ErrInvalidNonce:
+		return nm.challenge(r, realm, StatusUnauthorized)
+	default:
+		return ErrorResponse(m, StatusServerError)
+	}
+}
+
+func (nm *NonceManager) challenge(r *Request, realm Realm, code int) *Control {
+	n, err := nm.Nonce(r)
+	if err != nil {
+		return ErrorResponse(r.Message, StatusServerError)
+	}
+	resp := ErrorResponse(r.Message, code)
+	resp.Add(realm)
+	resp.Add(n)
+	return resp
+}
+
+// nonceMAC returns the HMAC over the time of issue ts and the 5-tuple
+// of the client of the request r.
+func nonceMAC(key, ts []byte, r *Request) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(ts)
+	h.Write([]byte(r.Network))
+	writeAddr(h, r.LocalAddr)
+	writeAddr(h, r.RemoteAddr)
+	return h.Sum(nil)
+}
+
+func writeAddr(h hash.Hash, addr net.Addr) {
+	h.Write([]byte{0})
+	if addr != nil {
+		h.Write([]byte(addr.String()))
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun_test
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mikioh/stun"
+)
+
+func newNonceRequest(raddr string) *stun.Request {
+	return &stun.Request{
+		Message:    newBindingRequest(),
+		Network:    "udp",
+		LocalAddr:  &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478},
+		RemoteAddr: &net.UDPAddr{IP: net.ParseIP(raddr), Port: 49152},
+	}
+}
+
+func tamper(n stun.Nonce) stun.Nonce {
+	if n[0] == 'A' {
+		return "B" + n[1:]
+	}
+	return "A" + n[1:]
+}
+
+func TestNonceManager(t *testing.T) {
+	r := newNonceRequest("198.51.100.1")
+	nm := stun.NewNonceManager([]byte("key-1"))
+	n, err := nm.Nonce(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(n) > 128 {
+		t.Fatalf("got %d characters; want less than or equal to 128", len(n))
+	}
+	if err := nm.Validate(r, n); err != nil {
+		t.Fatal(err)
+	}
+	for i, tt := range []struct {
+		r *stun.Request
+		n stun.Nonce
+	}{
+		{newNonceRequest("198.51.100.2"), n},
+		{r, tamper(n)},
+		{r, "nonce"},
+		{r, ""},
+	} {
+		if err := nm.Validate(tt.r, tt.n); err != stun.ErrInvalidNonce {
+			t.Errorf("#%d: got %v; want %v", i, err, stun.ErrInvalidNonce)
+		}
+	}
+
+	// Nonces issued with the previous key remain valid after
+	// rotation, and other instances sharing the keys accept them.
+	nm.SetKeys([]byte("key-2"), []byte("key-1"))
+	if err := stun.NewNonceManager([]byte("key-2"), []byte("key-1")).Validate(r, n); err != nil {
+		t.Fatal(err)
+	}
+	nn, err := nm.Nonce(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stun.NewNonceManager([]byte("key-1")).Validate(r, nn); err != stun.ErrInvalidNonce {
+		t.Fatalf("got %v; want %v", err, stun.ErrInvalidNonce)
+	}
+
+	nm.Now = func() time.Time { return time.Now().Add(stun.DefaultNonceLifetime + time.Second) }
+	if err := nm.Validate(r, n); err != stun.ErrStaleNonce {
+		t.Fatalf("got %v; want %v", err, stun.ErrStaleNonce)
+	}
+	nm.Now = nil
+	nm.Lifetime = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	if err := nm.Validate(r, n); err != stun.ErrStaleNonce {
+		t.Fatalf("got %v; want %v", err, stun.ErrStaleNonce)
+	}
+}
+
+func TestNonceManagerCheck(t *testing.T) {
+	var nm stun.NonceManager
+	r := newNonceRequest("198.51.100.1")
+	credential := func(n stun.Nonce) []stun.Attribute {
+		return []stun.Attribute{stun.Username("user"), stun.Realm("example.org"), n, stun.MessageIntegrity(nil)}
+	}
+
+	resp := nm.Check(r, "example.org")
+	if e, _ := stun.Get[*stun.Error](resp); e == nil || e.Code != stun.StatusUnauthorized {
+		t.Fatalf("got %v; want %d", e, stun.StatusUnauthorized)
+	}
+	if realm, _ := stun.Get[stun.Realm](resp); realm != "example.org" {
+		t.Fatalf("got %q; want example.org", realm)
+	}
+	n, ok := stun.Get[stun.Nonce](resp)
+	if !ok {
+		t.Fatal("no nonce")
+	}
+
+	r.Message.Attrs = credential(n)
+	if resp := nm.Check(r, "example.org"); resp != nil {
+		t.Fatalf("got %v; want nil", resp.Attrs)
+	}
+	r.Message.Attrs = credential("bogus")
+	if e, _ := stun.Get[*stun.Error](nm.Check(r, "example.org")); e == nil || e.Code != stun.StatusUnauthorized {
+		t.Fatalf("got %v; want %d", e, stun.StatusUnauthorized)
+	}
+	r.Message.Attrs = []stun.Attribute{stun.Username("user"), stun.MessageIntegrity(nil)}
+	if e, _ := stun.Get[*stun.Error](nm.Check(r, "example.org")); e == nil || e.Code != stun.StatusBadRequest {
+		t.Fatalf("got %v; want %d", e, stun.StatusBadRequest)
+	}
+
+	nm.Lifetime = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	r.Message.Attrs = credential(n)
+	resp = nm.Check(r, "example.org")
+	if e, _ := stun.Get[*stun.Error](resp); e == nil || e.Code != stun.StatusStaleNonce {
+		t.Fatalf("got %v; want %d", e, stun.StatusStaleNonce)
+	}
+	if nn, _ := stun.Get[stun.Nonce](resp); nn == n || nm.Validate(r, nn) != nil {
+		t.Fatalf("got %q; want new valid nonce", nn)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("no entropy") }
+
+func TestNonceManagerKeyError(t *testing.T) {
+	reader := rand.Reader
+	rand.Reader = errReader{}
+	defer func() { rand.Reader = reader }()
+
+	var nm stun.NonceManager
+	r := newNonceRequest("198.51.100.1")
+	if _, err := nm.Nonce(r); err == nil {
+		t.Fatal("got nil; want error")
+	}
+	if err := nm.Validate(r, stun.Nonce("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA")); err == nil || err == stun.ErrInvalidNonce {
+		t.Fatalf("got %v; want key generation error", err)
+	}
+	for i, attrs := range [][]stun.Attribute{
+		nil,
+		{stun.Username("user"), stun.Realm("example.org"), stun.Nonce("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"), stun.MessageIntegrity(nil)},
+	} {
+		r.Message.Attrs = attrs
+		if e, _ := stun.Get[*stun.Error](nm.Check(r, "example.org")); e == nil || e.Code != stun.StatusServerError {
+			t.Errorf("#%d: got %v; want %d", i, e, stun.StatusServerError)
+		}
+	}
+}
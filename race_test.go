@@ -0,0 +1,11 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build race
+
+package stun_test
+
+func init() {
+	raceEnabled = true
+}
@@ -0,0 +1,243 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// An AttributeCodec is the interface implemented by an attribute
+// that can marshal and parse its own value.
+type AttributeCodec interface {
+	Attribute
+
+	// MarshalAttr writes the binary encoding of attribute value
+	// to b. The length of b is equal to the return value of Len
+	// method.
+	// Tid is the transaction identifier of the message.
+	MarshalAttr(b, tid []byte) error
+
+	// ParseAttr parses b as the attribute value.
+	// Tid is the transaction identifier of the message.
+	ParseAttr(b, tid []byte) error
+}
+
+// A MarshalFunc writes the binary encoding of the value of attr to b.
+// The length of b is equal to the return value of Len method of
+// attr.
+// Tid is the transaction identifier of the message.
+type MarshalFunc func(b []byte, attr Attribute, tid []byte) error
+
+// A ParseFunc parses b as a STUN attribute value.
+// Tid is the transaction identifier of the message.
+type ParseFunc func(b, tid []byte) (Attribute, error)
+
+type marshaler struct {
+	typ int
+	fn  func([]byte, int, Attribute, []byte) error
+}
+
+type parser struct {
+	fn   func([]byte, int, int, []byte, int, int) (Attribute, error)
+	min  int
+	max  int
+	name string
+}
+
+var registry = struct {
+	sync.RWMutex
+	marshalers map[reflect.Type]marshaler
+	parsers    map[int]parser
+}{
+	marshalers: map[reflect.Type]marshaler{
+		reflect.TypeOf(Username("")):                {attrUSERNAME, marshalStringAttr},
+		reflect.TypeOf(MessageIntegrity(nil)):       {attrMESSAGE_INTEGRITY, marshalBytesAttr},
+		reflect.TypeOf(MessageIntegritySHA256(nil)): {attrMESSAGE_INTEGRITY_SHA256, marshalBytesAttr},
+		reflect.TypeOf((*Error)(nil)):               {attrERROR_CODE, marshalErrorAttr},
+		reflect.TypeOf(UnknownAttrs(nil)):           {attrUNKNOWN_ATTRIBUTES, marshalUnknownAttrs},
+		reflect.TypeOf((*ChannelNumber)(nil)):       {attrCHANNEL_NUMBER, marshalChannelNumberAttr},
+		reflect.TypeOf(Lifetime(0)):                 {attrLIFETIME, marshalDurationAttr},
+		reflect.TypeOf((*XORPeerAddr)(nil)):         {attrXOR_PEER_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf(Data(nil)):                   {attrDATA, marshalBytesAttr},
+		reflect.TypeOf(Realm("")):                   {attrREALM, marshalStringAttr},
+		reflect.TypeOf(Nonce("")):                   {attrNONCE, marshalStringAttr},
+		reflect.TypeOf((*XORRelayedAddr)(nil)):      {attrXOR_RELAYED_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf((*RequestedAddrFamily)(nil)): {attrREQUESTED_ADDRESS_FAMILY, marshalRequestedAddrFamilyAttr},
+		reflect.TypeOf((*EvenPort)(nil)):            {attrEVEN_PORT, marshalEvenPortAttr},
+		reflect.TypeOf((*RequestedTransport)(nil)):  {attrREQUESTED_TRANSPORT, marshalRequestedTransportAttr},
+		reflect.TypeOf((*DontFragment)(nil)):        {attrDONT_FRAGMENT, marshalDontFragmentAttr},
+		reflect.TypeOf((*XORMappedAddr)(nil)):       {attrXOR_MAPPED_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf(ReservationToken(nil)):       {attrRESERVATION_TOKEN, marshalBytesAttr},
+		reflect.TypeOf(Priority(0)):                 {attrPRIORITY, marshalUintAttr},
+		reflect.TypeOf((*UseCandidate)(nil)):        {attrUSE_CANDIDATE, marshalUseCandidateAttr},
+		reflect.TypeOf(ConnectionID(0)):             {attrCONNECTION_ID, marshalUintAttr},
+		reflect.TypeOf(Software("")):                {attrSOFTWARE, marshalStringAttr},
+		reflect.TypeOf((*AlternateServer)(nil)):     {attrALTERNATE_SERVER, marshalAddrAttr},
+		reflect.TypeOf(Fingerprint(0)):              {attrFINGERPRINT, marshalUintAttr},
+		reflect.TypeOf(ICEControlled(0)):            {attrICE_CONTROLLED, marshalUint64Attr},
+		reflect.TypeOf(ICEControlling(0)):           {attrICE_CONTROLLING, marshalUint64Attr},
+		reflect.TypeOf((*ECNCheck)(nil)):            {attrECN_CHECK_STUN, marshalECNCheckAttr},
+		reflect.TypeOf(PasswordAlgorithms(nil)):     {attrPASSWORD_ALGORITHMS, marshalPasswordAlgosAttr},
+		reflect.TypeOf((*PasswordAlgorithm)(nil)):   {attrPASSWORD_ALGORITHM, marshalPasswordAlgoAttr},
+		reflect.TypeOf(AlternateDomain("")):         {attrALTERNATE_DOMAIN, marshalStringAttr},
+		reflect.TypeOf(Origin("")):                  {attrORIGIN, marshalStringAttr},
+		reflect.TypeOf(XORPeerAddrPort{}):           {attrXOR_PEER_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf(XORRelayedAddrPort{}):        {attrXOR_RELAYED_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf(XORMappedAddrPort{}):         {attrXOR_MAPPED_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf(AlternateServerAddrPort{}):   {attrALTERNATE_SERVER, marshalAddrAttr},
+		reflect.TypeOf((*MappedAddr)(nil)):          {attrMAPPED_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf((*ResponseAddr)(nil)):        {attrRESPONSE_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf(ChangeRequest(0)):            {attrCHANGE_REQUEST, marshalChangeRequestAttr},
+		reflect.TypeOf((*SourceAddr)(nil)):          {attrSOURCE_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf((*ChangedAddr)(nil)):         {attrCHANGED_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf((*ReflectedFrom)(nil)):       {attrREFLECTED_FROM, marshalAddrAttr},
+		reflect.TypeOf(MappedAddrPort{}):            {attrMAPPED_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf(ResponseAddrPort{}):          {attrRESPONSE_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf(SourceAddrPort{}):            {attrSOURCE_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf(ChangedAddrPort{}):           {attrCHANGED_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf(ReflectedFromAddrPort{}):     {attrREFLECTED_FROM, marshalAddrAttr},
+		reflect.TypeOf(Padding(nil)):                {attrPADDING, marshalBytesAttr},
+		reflect.TypeOf(ResponsePort(0)):             {attrRESPONSE_PORT, marshalResponsePortAttr},
+		reflect.TypeOf((*ResponseOrigin)(nil)):      {attrRESPONSE_ORIGIN, marshalAddrAttr},
+		reflect.TypeOf((*OtherAddr)(nil)):           {attrOTHER_ADDRESS, marshalAddrAttr},
+		reflect.TypeOf(ResponseOriginAddrPort{}):    {attrRESPONSE_ORIGIN, marshalAddrAttr},
+		reflect.TypeOf(OtherAddrPort{}):             {attrOTHER_ADDRESS, marshalAddrAttr},
+	},
+	parsers: map[int]parser{
+		attrUSERNAME:                 {parseStringAttr, 0, 512, "USERNAME"},
+		attrMESSAGE_INTEGRITY:        {parseBytesAttr, 20, 20, "MESSAGE-INTEGRITY"},
+		attrMESSAGE_INTEGRITY_SHA256: {parseBytesAttr, 32, 32, "MESSAGE-INTEGRITY-SHA256"},
+		attrERROR_CODE:               {parseErrorAttr, 4, 4 + 763, "ERROR-CODE"},
+		attrUNKNOWN_ATTRIBUTES:       {parseUnknownAttrs, 0, 65535, "UNKNOWN-ATTRIBUTES"},
+		attrCHANNEL_NUMBER:           {parseChannelNumberAttr, 4, 4, "CHANNEL-NUMBER"},
+		attrLIFETIME:                 {parseDurationAttr, 4, 4, "LIFETIME"},
+		attrXOR_PEER_ADDRESS:         {parseAddrAttr, -1, -1, "XOR-PEER-ADDRESS"},
+		attrDATA:                     {parseBytesAttr, 0, 65535, "DATA"},
+		attrREALM:                    {parseStringAttr, 0, 763, "REALM"},
+		attrNONCE:                    {parseStringAttr, 0, 763, "NONCE"},
+		attrXOR_RELAYED_ADDRESS:      {parseAddrAttr, -1, -1, "XOR-RELAYED-ADDRESS"},
+		attrREQUESTED_ADDRESS_FAMILY: {parseRequestedAddrFamilyAttr, 4, 4, "REQUESTED-ADDRESS-FAMILY"},
+		attrEVEN_PORT:                {parseEvenPortAttr, 1, 1, "EVEN-PORT"},
+		attrREQUESTED_TRANSPORT:      {parseRequestedTransportAttr, 4, 4, "REQUESTED-TRANSPORT"},
+		attrDONT_FRAGMENT:            {parseDontFragmentAttr, 0, 0, "DONT-FRAGMENT"},
+		attrXOR_MAPPED_ADDRESS:       {parseAddrAttr, -1, -1, "XOR-MAPPED-ADDRESS"},
+		attrRESERVATION_TOKEN:        {parseBytesAttr, 8, 8, "RESERVATION-TOKEN"},
+		attrPRIORITY:                 {parseUintAttr, 4, 4, "PRIORITY"},
+		attrUSE_CANDIDATE:            {parseUseCandidateAttr, 0, 0, "USE-CANDIDATE"},
+		attrCONNECTION_ID:            {parseUintAttr, 4, 4, "CONNECTION-ID"},
+		attrSOFTWARE:                 {parseStringAttr, 0, 763, "SOFTWARE"},
+		attrALTERNATE_SERVER:         {parseAddrAttr, -1, -1, "ALTERNATE-SERVER"},
+		attrFINGERPRINT:              {parseUintAttr, 4, 4, "FINGERPRINT"},
+		attrICE_CONTROLLED:           {parseUint64Attr, 8, 8, "ICE-CONTROLLED"},
+		attrICE_CONTROLLING:          {parseUint64Attr, 8, 8, "ICE-CONTROLLING"},
+		attrECN_CHECK_STUN:           {parseECNCheckAttr, 4, 4, "ECN-CHECK STUN"},
+		attrPASSWORD_ALGORITHMS:      {parsePasswordAlgosAttr, 0, 65535, "PASSWORD-ALGORITHMS"},
+		attrPASSWORD_ALGORITHM:       {parsePasswordAlgoAttr, 4, 65535, "PASSWORD-ALGORITHM"},
+		attrALTERNATE_DOMAIN:         {parseStringAttr, 0, 763, "ALTERNATE-DOMAIN"},
+		attrORIGIN:                   {parseStringAttr, 0, 65535, "ORIGIN"},
+		attrMAPPED_ADDRESS:           {parseAddrAttr, -1, -1, "MAPPED-ADDRESS"},
+		attrRESPONSE_ADDRESS:         {parseAddrAttr, -1, -1, "RESPONSE-ADDRESS"},
+		attrCHANGE_REQUEST:           {parseChangeRequestAttr, 4, 4, "CHANGE-REQUEST"},
+		attrSOURCE_ADDRESS:           {parseAddrAttr, -1, -1, "SOURCE-ADDRESS"},
+		attrCHANGED_ADDRESS:          {parseAddrAttr, -1, -1, "CHANGED-ADDRESS"},
+		attrREFLECTED_FROM:           {parseAddrAttr, -1, -1, "REFLECTED-FROM"},
+		attrPADDING:                  {parseBytesAttr, 0, 65535, "PADDING"},
+		attrRESPONSE_PORT:            {parseResponsePortAttr, 4, 4, "RESPONSE-PORT"},
+		attrRESPONSE_ORIGIN:          {parseAddrAttr, -1, -1, "RESPONSE-ORIGIN"},
+		attrOTHER_ADDRESS:            {parseAddrAttr, -1, -1, "OTHER-ADDRESS"},
+	},
+}
+
+// RegisterAttribute registers the STUN attribute type t.
+// Name is the attribute name such as "SOFTWARE" used in error
+// messages.
+// NewAttr must return a new attribute value; its dynamic type is used to
+// find the marshaler when marshaling STUN messages, and the value is
+// used as the destination for parsing when parse is nil.
+// When marshal or parse is nil, the attribute returned from newAttr must
+// implement AttributeCodec interface.
+//
+// RegisterAttribute is usually called from an init function. It
+// returns an error if t or the dynamic type of the attribute is
+// already registered.
+func RegisterAttribute(t int, name string, newAttr func() Attribute, marshal MarshalFunc, parse ParseFunc) error {
+	if t < 0 || 0xffff < t {
+		return &AttributeError{Type: t, Err: errors.New("invalid attribute type")}
+	}
+	if newAttr == nil {
+		return &AttributeError{Type: t, Err: errors.New("nil constructor")}
+	}
+	attr := newAttr()
+	if attr == nil {
+		return &AttributeError{Type: t, Err: errors.New("nil attribute")}
+	}
+	if marshal == nil || parse == nil {
+		if _, ok := attr.(AttributeCodec); !ok {
+			return &AttributeError{Type: t, Err: fmt.Errorf("%T does not implement AttributeCodec", attr)}
+		}
+	}
+	if marshal == nil {
+		marshal = func(b []byte, attr Attribute, tid []byte) error {
+			return attr.(AttributeCodec).MarshalAttr(b, tid)
+		}
+	}
+	if parse == nil {
+		parse = func(b, tid []byte) (Attribute, error) {
+			attr := newAttr()
+			if err := attr.(AttributeCodec).ParseAttr(b, tid); err != nil {
+				return nil, err
+			}
+			return attr, nil
+		}
+	}
+	rt := reflect.TypeOf(attr)
+	registry.Lock()
+	defer registry.Unlock()
+	if p, ok := registry.parsers[t]; ok {
+		return &AttributeError{Type: t, Err: fmt.Errorf("already registered as %s", p.name)}
+	}
+	if _, ok := registry.marshalers[rt]; ok || rt == reflect.TypeOf((*DefaultAttr)(nil)) {
+		return &AttributeError{Type: t, Err: fmt.Errorf("%T already registered", attr)}
+	}
+	registry.marshalers[rt] = marshaler{typ: t, fn: func(b []byte, _ int, attr Attribute, tid []byte) error {
+		return marshal(b, attr, tid)
+	}}
+	registry.parsers[t] = parser{fn: func(b []byte, _, _ int, tid []byte, _, l int) (Attribute, error) {
+		if len(b) < l {
+			return nil, errors.New("short attribute")
+		}
+		return parse(b[:l], tid)
+	}, min: 0, max: 65535, name: name}
+	return nil
+}
+
+func attrTypeMarshaler(attr Attribute) (int, func([]byte, int, Attribute, []byte) error, error) {
+	if da, ok := attr.(*DefaultAttr); ok {
+		return da.Type, marshalDefaultAttr, nil
+	}
+	registry.RLock()
+	m, ok := registry.marshalers[reflect.TypeOf(attr)]
+	registry.RUnlock()
+	if !ok {
+		return 0, nil, fmt.Errorf("unknown attribute: %T", attr)
+	}
+	return m.typ, m.fn, nil
+}
+
+func attrTypeParser(t int) (parser, bool) {
+	registry.RLock()
+	p, ok := registry.parsers[t]
+	registry.RUnlock()
+	return p, ok
+}
+
+// attrName returns the name of the registered attribute type t.
+func attrName(t int) string {
+	p, _ := attrTypeParser(t)
+	return p.name
+}
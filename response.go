@@ -0,0 +1,86 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun
+
+import "net/netip"
+
+// UnknownAttrsResponse returns an error response with the STUN error
+// code 420 and UNKNOWN-ATTRIBUTES attribute for the request m, as
+// described in RFC 5389 section 7.3.1.
+// It returns nil if m is not a request or m contains no unknown
+// comprehension-required attributes.
+func UnknownAttrsResponse(m *Control) *Control {
+	if m.Type.Class() != ClassRequest || len(m.unknown) == 0 {
+		return nil
+	}
+	ua := make(UnknownAttrs, len(m.unknown))
+	copy(ua, m.unknown)
+	resp := ErrorResponse(m, StatusUnknownAttribute)
+	resp.Attrs = append(resp.Attrs, ua)
+	return resp
+}
+
+// ErrorResponse returns an error response with the STUN error code
+// for the request m.
+// It returns nil if m is not a request.
+func ErrorResponse(m *Control, code int) *Control {
+	if m.Type.Class() != ClassRequest {
+		return nil
+	}
+	return &Control{
+		Type:   MessageType(ClassErrorResponse, m.Type.Method()),
+		Cookie: m.Cookie,
+		TID:    m.TID,
+		Attrs:  []Attribute{NewError(code)},
+	}
+}
+
+// BindingResponse returns a success response for the Binding request m
+// that carries the reflexive transport address addr of the client.
+// The address is carried in XOR-MAPPED-ADDRESS attribute, or in
+// MAPPED-ADDRESS attribute when m is a classic STUN message defined in
+// RFC 3489.
+// It returns nil if m is not a Binding request.
+func BindingResponse(m *Control, addr netip.AddrPort) *Control {
+	if m.Type != MessageType(ClassRequest, MethodBinding) {
+		return nil
+	}
+	var attr Attribute = XORMappedAddrPort{addr}
+	if m.Legacy() {
+		attr = MappedAddrPort{addr}
+	}
+	return &Control{
+		Type:   MessageType(ClassSuccessResponse, MethodBinding),
+		Cookie: m.Cookie,
+		TID:    m.TID,
+		Attrs:  []Attribute{attr},
+	}
+}
+
+// ReflexiveAddr returns the reflexive transport address carried in
+// the response m.
+// It prefers XOR-MAPPED-ADDRESS attribute and falls back to
+// MAPPED-ADDRESS attribute.
+func ReflexiveAddr(m *Control) (netip.AddrPort, bool) {
+	var mapped addrAttr
+	for _, attr := range m.Attrs {
+		aa, ok := attr.(addrAttr)
+		if !ok {
+			continue
+		}
+		switch attrType(attr) {
+		case attrXOR_MAPPED_ADDRESS:
+			return aa.addrPort(), true
+		case attrMAPPED_ADDRESS:
+			if mapped == nil {
+				mapped = aa
+			}
+		}
+	}
+	if mapped == nil {
+		return netip.AddrPort{}, false
+	}
+	return mapped.addrPort(), true
+}
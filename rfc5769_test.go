@@ -6,11 +6,6 @@ package stun_test
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
-	"hash"
 	"net"
 	"reflect"
 	"testing"
@@ -18,20 +13,9 @@ import (
 	"github.com/mikioh/stun"
 )
 
-func shortTermAuth(username, realm, password string) hash.Hash {
-	return hmac.New(sha1.New, []byte(password)) // implement PRECIS defined in RFC 7613
-}
-
-func longTermAuth(username, realm, password string, hash func() hash.Hash) hash.Hash {
-	key := username + ":" + realm + ":" + password // implement PRECIS defined in RFC 7613
-	h := md5.New()
-	h.Write([]byte(key))
-	return hmac.New(hash, h.Sum(nil))
-}
-
 type rfc5769Test struct {
 	raw, msg          stun.Message
-	hash              hash.Hash
+	key               stun.Key
 	whiteSpacePadding bool
 	wire              string
 }
@@ -65,7 +49,7 @@ var rfc5769Tests = []rfc5769Test{
 				stun.Fingerprint(0xe57a3bcf),
 			},
 		},
-		hash:              shortTermAuth("", "", "VOkJxbRl1RmTxUk/WvJxBt"),
+		key:               stun.ShortTermKey("VOkJxbRl1RmTxUk/WvJxBt"),
 		whiteSpacePadding: true,
 		wire: "\x00\x01\x00\x58" +
 			"\x21\x12\xa4\x42" +
@@ -114,7 +98,7 @@ var rfc5769Tests = []rfc5769Test{
 				stun.Fingerprint(0xc07d4c96),
 			},
 		},
-		hash:              shortTermAuth("", "", "VOkJxbRl1RmTxUk/WvJxBt"),
+		key:               stun.ShortTermKey("VOkJxbRl1RmTxUk/WvJxBt"),
 		whiteSpacePadding: true,
 		wire: "\x01\x01\x00\x3c" +
 			"\x21\x12\xa4\x42" +
@@ -159,7 +143,7 @@ var rfc5769Tests = []rfc5769Test{
 				stun.Fingerprint(0xc8fb0b4c),
 			},
 		},
-		hash:              shortTermAuth("", "", "VOkJxbRl1RmTxUk/WvJxBt"),
+		key:               stun.ShortTermKey("VOkJxbRl1RmTxUk/WvJxBt"),
 		whiteSpacePadding: true,
 		wire: "\x01\x01\x00\x48" +
 			"\x21\x12\xa4\x42" +
@@ -199,7 +183,7 @@ var rfc5769Tests = []rfc5769Test{
 				stun.MessageIntegrity("\xf6\x70\x24\x65\x6d\xd6\x4a\x3e\x02\xb8\xe0\x71\x2e\x85\xc9\xa2\x8c\xa8\x96\x66"),
 			},
 		},
-		hash: longTermAuth("\u30de\u30c8\u30ea\u30c3\u30af\u30b9", "example.org", "TheMatrIX", sha1.New),
+		key: &stun.LongTermKey{Username: "\u30de\u30c8\u30ea\u30c3\u30af\u30b9", Realm: "example.org", Password: "TheMatrIX"},
 		wire: "\x00\x01\x00\x60" +
 			"\x21\x12\xa4\x42" +
 			"\x78\xad\x34\x33\xc6\xad\x72\xc0\x29\xda\x41\x2e" +
@@ -237,7 +221,7 @@ var rfc5769Tests = []rfc5769Test{
 				stun.MessageIntegritySHA256("\x33\x0e\x33\x74\x8a\xf3\xd4\xd1\xd2\x83\x08\xbf\xf9\x16\x1c\x88\xb7\xf1\xba\x18\xcb\xc0\x8a\x4f\xfb\xca\x64\x08\xab\x35\x44\x09"),
 			},
 		},
-		hash: longTermAuth("\u30de\u30c8\u30ea\u30c3\u30af\u30b9", "example.org", "TheMatrIX", sha256.New),
+		key: &stun.LongTermKey{Username: "\u30de\u30c8\u30ea\u30c3\u30af\u30b9", Realm: "example.org", Password: "TheMatrIX"},
 		wire: "\x00\x01\x00\x6c" +
 			"\x21\x12\xa4\x42" +
 			"\x78\xad\x34\x33\xc6\xad\x72\xc0\x29\xda\x41\x2e" +
@@ -257,24 +241,24 @@ func TestRFC5769(t *testing.T) {
 	for i, tt := range rfc5769Tests {
 		wire := make([]byte, len(tt.wire))
 		copy(wire, []byte(tt.wire))
-		_, m, err := stun.ParseMessage(wire, tt.hash)
+		_, m, err := stun.ParseMessage(wire, tt.key)
 		if err != nil {
 			t.Errorf("#%d: %v", i, err)
 			continue
 		}
-		if !reflect.DeepEqual(m, tt.msg) {
+		if !controlEqual(m.(*stun.Control), tt.msg.(*stun.Control)) {
 			t.Errorf("#%d: got %#v; want %#v", i, m, tt.msg)
 		}
 		if !bytes.Equal(wire, []byte(tt.wire)) {
 			t.Errorf("#%d: got %#v; want %#v", i, wire, tt.wire)
 		}
 		b := make([]byte, 1500)
-		n, err := tt.raw.Marshal(b, tt.hash)
+		n, err := tt.raw.Marshal(b, tt.key)
 		if err != nil {
 			t.Error(err)
 			continue
 		}
-		_, m, err = stun.ParseMessage(b[:n], tt.hash)
+		_, m, err = stun.ParseMessage(b[:n], tt.key)
 		if err != nil {
 			t.Error(err)
 			continue
@@ -287,3 +271,41 @@ func TestRFC5769(t *testing.T) {
 		}
 	}
 }
+
+func TestRFC5769DeferredVerification(t *testing.T) {
+	for i, tt := range rfc5769Tests {
+		wire := make([]byte, len(tt.wire))
+		copy(wire, []byte(tt.wire))
+		_, m, err := stun.ParseMessage(wire, nil)
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		c := m.(*stun.Control)
+		if err := c.VerifyIntegrity(tt.key); err != nil {
+			t.Errorf("#%d: %v", i, err)
+		}
+		if err := c.VerifyIntegrity(stun.ShortTermKey("wrong password")); err == nil {
+			t.Errorf("#%d: verified with wrong key", i)
+		}
+		err = c.VerifyFingerprint()
+		_, ok := c.Attrs[len(c.Attrs)-1].(stun.Fingerprint)
+		if ok && err != nil {
+			t.Errorf("#%d: %v", i, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("#%d: verified without fingerprint", i)
+		}
+		if !bytes.Equal(wire, []byte(tt.wire)) {
+			t.Errorf("#%d: got %#v; want %#v", i, wire, tt.wire)
+		}
+	}
+	var m stun.Control
+	if err := m.VerifyIntegrity(stun.ShortTermKey("VOkJxbRl1RmTxUk/WvJxBt")); err == nil {
+		t.Error("verified not parsed message")
+	}
+}
+
+func controlEqual(x, y *stun.Control) bool {
+	return x.Type == y.Type && bytes.Equal(x.Cookie, y.Cookie) && bytes.Equal(x.TID, y.TID) && reflect.DeepEqual(x.Attrs, y.Attrs)
+}
@@ -0,0 +1,464 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mikioh/stun/internal/netutil"
+)
+
+// ErrServerClosed is returned by the Serve and ServePacket methods of
+// Server after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("server closed")
+
+// DefaultSoftware is the default value of SOFTWARE attribute added to
+// responses by Server.
+const DefaultSoftware = "github.com/mikioh/stun"
+
+// A Request represents a STUN request or indication received by
+// Server.
+type Request struct {
+	// Message is the received message.
+	Message *Control
+
+	// Network is the name of network on which the message is
+	// received, such as "udp" or "tcp".
+	Network string
+
+	// LocalAddr is the local transport address.
+	LocalAddr net.Addr
+
+	// RemoteAddr is the transport address of the client.
+	RemoteAddr net.Addr
+}
+
+// A ResponseWriter is used by Handler to send a response.
+type ResponseWriter interface {
+	// Write sends the response m.
+	// K must be a valid key when in use of STUN
+	// MESSAGE-INTEGRITY or MESSAGE-INTEGRITY-SHA256 attribute.
+	// If m.Cookie or m.TID is nil, Write uses the value of the
+	// request.
+	Write(m *Control, k Key) error
+}
+
+// A Handler responds to a STUN request or indication.
+type Handler interface {
+	ServeSTUN(w ResponseWriter, r *Request)
+}
+
+// The HandlerFunc type is an adapter to allow the use of ordinary
+// functions as STUN handlers.
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+// ServeSTUN calls f(w, r).
+func (f HandlerFunc) ServeSTUN(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// BindingHandler responds to a Binding request with a success
+// response; Server fills in the reflexive transport address of the
+// client.
+var BindingHandler = HandlerFunc(func(w ResponseWriter, r *Request) {
+	w.Write(&Control{Type: MessageType(ClassSuccessResponse, MethodBinding)}, nil)
+})
+
+// A ServeMux is a STUN message multiplexer.
+// It dispatches a message to the handler registered for its method
+// and class.
+//
+// A request for which no handler is registered is answered with the
+// STUN error code 400; other messages are discarded.
+type ServeMux struct {
+	mu sync.RWMutex
+	hs map[Type]Handler
+}
+
+// NewServeMux returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{hs: make(map[Type]Handler)}
+}
+
+// Handle registers the handler for messages of method m and class c.
+func (mux *ServeMux) Handle(m Method, c Class, h Handler) {
+	mux.mu.Lock()
+	mux.hs[MessageType(c, m)] = h
+	mux.mu.Unlock()
+}
+
+// HandleFunc registers the handler function for messages of method m
+// and class c.
+func (mux *ServeMux) HandleFunc(m Method, c Class, f func(w ResponseWriter, r *Request)) {
+	mux.Handle(m, c, HandlerFunc(f))
+}
+
+// ServeSTUN implements the ServeSTUN method of Handler interface.
+func (mux *ServeMux) ServeSTUN(w ResponseWriter, r *Request) {
+	mux.mu.RLock()
+	h, ok := mux.hs[r.Message.Type]
+	mux.mu.RUnlock()
+	if ok {
+		h.ServeSTUN(w, r)
+		return
+	}
+	if resp := ErrorResponse(r.Message, StatusBadRequest); resp != nil {
+		w.Write(resp, nil)
+	}
+}
+
+// A Server represents a STUN server that serves messages over UDP,
+// TCP and TLS.
+//
+// On receiving a message, the server follows RFC 5389 section 7.3;
+// a message that is not a valid STUN message or has a wrong
+// FINGERPRINT attribute is discarded, and a request containing
+// unknown comprehension-required attributes is answered with the
+// STUN error code 420.
+type Server struct {
+	// Handler specifies the handler to invoke.
+	// If nil, only Binding requests are served by BindingHandler.
+	Handler Handler
+
+	// Software specifies the value of SOFTWARE attribute added
+	// to responses.
+	// If empty, DefaultSoftware is used.
+	Software string
+
+	// NoDefaultAttrs disables the addition of XOR-MAPPED-ADDRESS,
+	// SOFTWARE and FINGERPRINT attributes to responses.
+	NoDefaultAttrs bool
+
+	mu       sync.Mutex
+	closed   bool
+	lns      map[net.Listener]struct{}
+	pconns   map[net.PacketConn]struct{}
+	draining []net.PacketConn // datagram connections closed after Shutdown
+	conns    map[net.Conn]struct{}
+	active   sync.WaitGroup // listeners, connections and handlers in progress
+	defaults *ServeMux
+}
+
+// Serve accepts byte stream connections on ln, such as TCP or TLS
+// connections, and serves messages on them.
+// It always returns a non-nil error; after Shutdown or Close, the
+// returned error is ErrServerClosed.
+func (s *Server) Serve(ln net.Listener) error {
+	if !s.track(ln, true) {
+		return ErrServerClosed
+	}
+	defer s.track(ln, false)
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if !s.track(c, true) {
+			c.Close()
+			return ErrServerClosed
+		}
+		go s.serveConn(c, ln.Addr().Network())
+	}
+}
+
+// ServePacket serves messages on the datagram connection c such as a
+// UDP connection.
+// It always returns a non-nil error; after Shutdown or Close, the
+// returned error is ErrServerClosed.
+func (s *Server) ServePacket(c net.PacketConn) error {
+	if !s.track(c, true) {
+		return ErrServerClosed
+	}
+	defer s.track(c, false)
+	b := make([]byte, MaxMessageSize)
+	var delay netutil.Backoff
+	for {
+		n, from, err := c.ReadFrom(b)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			delay.Wait()
+			continue
+		}
+		delay.Reset()
+		_, m, err := ParseMessage(append([]byte(nil), b[:n]...), nil) // the message must outlive the next read
+		if err != nil {
+			continue
+		}
+		req, ok := m.(*Control)
+		if !ok {
+			continue
+		}
+		if !s.begin() {
+			continue // shutting down
+		}
+		go func() {
+			defer s.active.Done()
+			w := &packetWriter{conn: c, to: from}
+			s.handle(w, &Request{Message: req, Network: c.LocalAddr().Network(), LocalAddr: c.LocalAddr(), RemoteAddr: from})
+		}()
+	}
+}
+
+func (s *Server) serveConn(c net.Conn, network string) {
+	defer func() {
+		c.Close()
+		s.track(c, false)
+	}()
+	dec := NewDecoder(c)
+	dec.SetRetain(true) // the message must outlive the next read
+	w := &streamWriter{enc: NewEncoder(c)}
+	for {
+		m, err := dec.Decode(nil)
+		if err != nil {
+			return // no way to resynchronize the byte stream
+		}
+		req, ok := m.(*Control)
+		if !ok {
+			continue
+		}
+		if !s.begin() {
+			return
+		}
+		s.handle(w, &Request{Message: req, Network: network, LocalAddr: c.LocalAddr(), RemoteAddr: c.RemoteAddr()})
+		s.active.Done()
+	}
+}
+
+func (s *Server) handle(w responseWriter, r *Request) {
+	dw := &defaultsWriter{w: w, s: s, r: r}
+	switch r.Message.Type.Class() {
+	case ClassRequest:
+		if resp := UnknownAttrsResponse(r.Message); resp != nil {
+			dw.Write(resp, nil)
+			return
+		}
+	case ClassIndication:
+		if len(r.Message.unknown) > 0 {
+			return
+		}
+	default:
+		return
+	}
+	h := s.Handler
+	if h == nil {
+		h = s.defaultHandler()
+	}
+	h.ServeSTUN(dw, r)
+}
+
+func (s *Server) defaultHandler() Handler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.defaults == nil {
+		s.defaults = NewServeMux()
+		s.defaults.Handle(MethodBinding, ClassRequest, BindingHandler)
+	}
+	return s.defaults
+}
+
+// Shutdown gracefully shuts down s.
+// It closes all the listeners and stops reading next messages, and
+// then waits for the messages in progress to be served before
+// closing datagram and byte stream connections.
+// If ctx expires first, Shutdown closes s and returns the context's
+// error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for ln := range s.lns {
+		ln.Close()
+	}
+	for c := range s.pconns {
+		c.SetReadDeadline(time.Unix(1, 0)) // stop reading next messages
+		s.draining = append(s.draining, c)
+	}
+	for c := range s.conns {
+		c.SetReadDeadline(time.Unix(1, 0))
+	}
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.Close()
+		return nil
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+}
+
+// Close immediately closes all the listeners and connections of s.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.closeListenersLocked()
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (s *Server) closeListenersLocked() {
+	for ln := range s.lns {
+		ln.Close()
+	}
+	for c := range s.pconns {
+		c.Close()
+	}
+	for _, c := range s.draining {
+		c.Close()
+	}
+	s.draining = nil
+}
+
+// begin counts a message as in progress.
+// It reports false when s is closed.
+func (s *Server) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.active.Add(1)
+	return true
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// track adds or removes the listener or connection x, which is
+// counted as in progress while added.
+// It reports false when s is closed and x cannot be added.
+func (s *Server) track(x interface{}, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add && s.closed {
+		return false
+	}
+	if s.lns == nil {
+		s.lns = make(map[net.Listener]struct{})
+		s.pconns = make(map[net.PacketConn]struct{})
+		s.conns = make(map[net.Conn]struct{})
+	}
+	if add {
+		s.active.Add(1)
+	} else {
+		defer s.active.Done()
+	}
+	switch x := x.(type) {
+	case net.Listener:
+		if add {
+			s.lns[x] = struct{}{}
+		} else {
+			delete(s.lns, x)
+		}
+	case net.PacketConn:
+		if add {
+			s.pconns[x] = struct{}{}
+		} else {
+			delete(s.pconns, x)
+		}
+	case net.Conn:
+		if add {
+			s.conns[x] = struct{}{}
+		} else {
+			delete(s.conns, x)
+		}
+	}
+	return true
+}
+
+type responseWriter interface {
+	write(m *Control, k Key) error
+}
+
+// A defaultsWriter fills in the default values of response.
+type defaultsWriter struct {
+	w responseWriter
+	s *Server
+	r *Request
+}
+
+func (dw *defaultsWriter) Write(m *Control, k Key) error {
+	if m.Cookie == nil {
+		m.Cookie = dw.r.Message.Cookie
+	}
+	if m.TID == nil {
+		m.TID = dw.r.Message.TID
+	}
+	if !dw.s.NoDefaultAttrs {
+		if m.Type == MessageType(ClassSuccessResponse, MethodBinding) {
+			if _, ok := ReflexiveAddr(m); !ok {
+				if ap, err := netutil.AddrPort(dw.r.RemoteAddr); err == nil {
+					if m.Legacy() {
+						m.Add(MappedAddrPort{ap})
+					} else {
+						m.Add(XORMappedAddrPort{ap})
+					}
+				}
+			}
+		}
+		if !Has[Software](m) {
+			sw := dw.s.Software
+			if sw == "" {
+				sw = DefaultSoftware
+			}
+			m.Add(Software(sw))
+		}
+		if !Has[Fingerprint](m) && !m.Legacy() {
+			m.Add(Fingerprint(0))
+		}
+	}
+	return dw.w.write(m, k)
+}
+
+type packetWriter struct {
+	conn net.PacketConn
+	to   net.Addr
+}
+
+func (pw *packetWriter) write(m *Control, k Key) error {
+	b, err := m.AppendMarshal(nil, k)
+	if err != nil {
+		return err
+	}
+	_, err = pw.conn.WriteTo(b, pw.to)
+	return err
+}
+
+type streamWriter struct {
+	mu  sync.Mutex
+	enc *Encoder
+}
+
+func (sw *streamWriter) write(m *Control, k Key) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.enc.Encode(m, k)
+}
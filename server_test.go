@@ -0,0 +1,261 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mikioh/stun"
+)
+
+func servePacketServer(t *testing.T, s *stun.Server) net.Addr {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- s.ServePacket(c) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; err != stun.ErrServerClosed {
+			t.Errorf("got %v; want %v", err, stun.ErrServerClosed)
+		}
+	})
+	return c.LocalAddr()
+}
+
+func newTestClient(t *testing.T, raddr net.Addr) (*stun.Client, net.Addr) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := stun.NewPacketClient(c, raddr)
+	cl.RTO, cl.Rc, cl.Rm = 10*time.Millisecond, 3, 4
+	t.Cleanup(func() { cl.Close() })
+	return cl, c.LocalAddr()
+}
+
+func TestServerBinding(t *testing.T) {
+	var s stun.Server
+	cl, laddr := newTestClient(t, servePacketServer(t, &s))
+	resp, err := cl.Do(context.Background(), newBindingRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Type != stun.MessageType(stun.ClassSuccessResponse, stun.MethodBinding) {
+		t.Fatalf("got %v; want %v", resp.Type, stun.MessageType(stun.ClassSuccessResponse, stun.MethodBinding))
+	}
+	if ap, ok := stun.ReflexiveAddr(resp); !ok || ap != laddr.(*net.UDPAddr).AddrPort() {
+		t.Errorf("got %v; want %v", ap, laddr)
+	}
+	if sw, ok := stun.Get[stun.Software](resp); !ok || sw != stun.DefaultSoftware {
+		t.Errorf("got %q; want %q", sw, stun.DefaultSoftware)
+	}
+	if err := resp.VerifyFingerprint(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	var s stun.Server
+	cl, _ := newTestClient(t, servePacketServer(t, &s))
+	for i, tt := range []struct {
+		req  *stun.Control
+		code int
+		ua   stun.UnknownAttrs
+	}{
+		{
+			req:  &stun.Control{Type: stun.MessageType(stun.ClassRequest, stun.MethodAllocate)},
+			code: stun.StatusBadRequest,
+		},
+		{
+			req: &stun.Control{
+				Type:  stun.MessageType(stun.ClassRequest, stun.MethodBinding),
+				Attrs: []stun.Attribute{&stun.DefaultAttr{Type: 0x0031, Data: []byte{1, 2, 3, 4}}},
+			},
+			code: stun.StatusUnknownAttribute,
+			ua:   stun.UnknownAttrs{0x0031},
+		},
+	} {
+		resp, err := cl.Do(context.Background(), tt.req)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		e, ok := stun.Get[*stun.Error](resp)
+		if resp.Type.Class() != stun.ClassErrorResponse || !ok || e.Code != tt.code {
+			t.Fatalf("#%d: got %v, %v; want %d", i, resp.Type, e, tt.code)
+		}
+		if ua, _ := stun.Get[stun.UnknownAttrs](resp); !reflect.DeepEqual(ua, tt.ua) {
+			t.Errorf("#%d: got %v; want %v", i, ua, tt.ua)
+		}
+	}
+
+	req := newBindingRequest()
+	req.Attrs = []stun.Attribute{stun.Fingerprint(0xdeadbeef)} // wrong fingerprint
+	if _, err := cl.Do(context.Background(), req); !errors.Is(err, stun.ErrTimeout) {
+		t.Fatalf("got %v; want %v", err, stun.ErrTimeout)
+	}
+}
+
+func TestServeMux(t *testing.T) {
+	indications := make(chan *stun.Request, 1)
+	mux := stun.NewServeMux()
+	mux.HandleFunc(stun.MethodBinding, stun.ClassRequest, func(w stun.ResponseWriter, r *stun.Request) {
+		w.Write(&stun.Control{
+			Type:  stun.MessageType(stun.ClassSuccessResponse, stun.MethodBinding),
+			Attrs: []stun.Attribute{stun.Software("mux")},
+		}, nil)
+	})
+	mux.HandleFunc(stun.MethodBinding, stun.ClassIndication, func(w stun.ResponseWriter, r *stun.Request) {
+		indications <- r
+	})
+	s := stun.Server{Handler: mux, NoDefaultAttrs: true}
+	raddr := servePacketServer(t, &s)
+	cl, _ := newTestClient(t, raddr)
+
+	resp, err := cl.Do(context.Background(), newBindingRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []stun.Attribute{stun.Software("mux")}; !reflect.DeepEqual(resp.Attrs, want) {
+		t.Fatalf("got %#v; want %#v", resp.Attrs, want)
+	}
+
+	c, err := net.Dial("udp", raddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ind := &stun.Control{Type: stun.MessageType(stun.ClassIndication, stun.MethodBinding)}
+	if _, err := ind.WriteTo(c); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-indications:
+		if r.Network != "udp" || r.RemoteAddr.String() != c.LocalAddr().String() {
+			t.Fatalf("got %v, %v; want udp, %v", r.Network, r.RemoteAddr, c.LocalAddr())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("indication not delivered")
+	}
+}
+
+func selfSignedConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestServerStream(t *testing.T) {
+	tlsConfig := selfSignedConfig(t)
+	for _, network := range []string{"tcp", "tls"} {
+		var s stun.Server
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if network == "tls" {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		done := make(chan error)
+		go func() { done <- s.Serve(ln) }()
+
+		var c net.Conn
+		if network == "tls" {
+			c, err = tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		} else {
+			c, err = net.Dial("tcp", ln.Addr().String())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		cl := stun.NewClient(c)
+		resp, err := cl.Do(context.Background(), newBindingRequest())
+		if err != nil {
+			t.Fatalf("%s: %v", network, err)
+		}
+		if ap, ok := stun.ReflexiveAddr(resp); !ok || ap != c.LocalAddr().(*net.TCPAddr).AddrPort() {
+			t.Errorf("%s: got %v; want %v", network, ap, c.LocalAddr())
+		}
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatalf("%s: %v", network, err)
+		}
+		if err := <-done; err != stun.ErrServerClosed {
+			t.Fatalf("%s: got %v; want %v", network, err, stun.ErrServerClosed)
+		}
+		cl.Close()
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	mux := stun.NewServeMux()
+	mux.HandleFunc(stun.MethodBinding, stun.ClassRequest, func(w stun.ResponseWriter, r *stun.Request) {
+		started <- true
+		<-release
+		stun.BindingHandler(w, r)
+	})
+	s := stun.Server{Handler: mux}
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- s.ServePacket(c) }()
+	cl, _ := newTestClient(t, c.LocalAddr())
+	cl.Rc, cl.Rm = 1, 500
+	resp := make(chan error, 1)
+	go func() {
+		_, err := cl.Do(context.Background(), newBindingRequest())
+		resp <- err
+	}()
+	<-started
+
+	shutdown := make(chan error)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	if err := <-done; err != stun.ErrServerClosed {
+		t.Fatalf("got %v; want %v", err, stun.ErrServerClosed)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown before handler returns: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	// The response to the message in progress is delivered.
+	if err := <-resp; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ServePacket(c); err != stun.ErrServerClosed {
+		t.Fatalf("got %v; want %v", err, stun.ErrServerClosed)
+	}
+}
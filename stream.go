@@ -0,0 +1,159 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MaxMessageSize is the maximum size of STUN message including the
+// message header.
+const MaxMessageSize = controlHeaderLen + 0xffff
+
+// A Decoder reads and decodes STUN control and channel data messages
+// from a byte stream such as TCP or TLS connection.
+//
+// Unlike ParseMessage, the Decoder follows the framing rules defined
+// in RFC 5766 section 11.5; a channel data message on a byte stream
+// is always padded to a multiple of 4 bytes.
+type Decoder struct {
+	r      *bufio.Reader
+	buf    []byte
+	max    int
+	flags  Flags
+	retain bool // don't reuse buf
+}
+
+// NewDecoder returns a new Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), max: MaxMessageSize}
+}
+
+// SetMaxMessageSize sets the maximum size of message including the
+// message header and padding bytes.
+// Decode returns an error when it encounters a larger message.
+func (d *Decoder) SetMaxMessageSize(n int) {
+	if n < controlHeaderLen || n > MaxMessageSize {
+		n = MaxMessageSize
+	}
+	d.max = n
+}
+
+// SetFlags sets the options for parsing.
+func (d *Decoder) SetFlags(flags Flags) {
+	d.flags = flags
+}
+
+// SetRetain makes Decode return messages that don't refer to the
+// internal buffer of the Decoder when retain is true. It is useful
+// when messages are passed to other goroutines.
+func (d *Decoder) SetRetain(retain bool) {
+	d.retain = retain
+}
+
+// Decode reads the next message from the stream.
+// K must be a valid key when in use of STUN MESSAGE-INTEGRITY or
+// MESSAGE-INTEGRITY-SHA256 attribute.
+//
+// Unless SetRetain is used, the returned message refers to the
+// internal buffer of the Decoder and is valid only until the next
+// call to Decode.
+// A message that fails to parse is consumed from the stream.
+// At the end of stream, Decode returns io.EOF.
+func (d *Decoder) Decode(k Key) (Message, error) {
+	m, _, err := d.decode(k)
+	return m, err
+}
+
+// decode is like Decode but also reports whether the message is read
+// from the stream entirely; when true, a parse error leaves the
+// stream at the beginning of the next message.
+func (d *Decoder) decode(k Key) (Message, bool, error) {
+	var h [channelDataHeaderLen]byte
+	if _, err := io.ReadFull(d.r, h[:]); err != nil {
+		return nil, false, err
+	}
+	t := Type(binary.BigEndian.Uint16(h[:2]))
+	l := int(binary.BigEndian.Uint16(h[2:4]))
+	var ll int
+	switch {
+	case 0x4000 <= t && t <= 0x7fff:
+		ll = channelDataHeaderLen + roundup(l)
+	case h[0]&0xc0 == 0:
+		ll = controlHeaderLen + l
+	default:
+		return nil, false, &MessageError{Type: t, Err: errors.New("invalid header")}
+	}
+	if ll > d.max {
+		return nil, false, &MessageError{Type: t, Err: errors.New("message too long")}
+	}
+	if cap(d.buf) < ll || d.retain {
+		d.buf = make([]byte, ll)
+	}
+	b := d.buf[:ll]
+	copy(b, h[:])
+	if _, err := io.ReadFull(d.r, b[channelDataHeaderLen:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, false, err
+	}
+	_, m, err := ParseMessageFlags(b, k, d.flags)
+	if err != nil {
+		return nil, true, err
+	}
+	return m, true, nil
+}
+
+// An Encoder encodes and writes STUN control and channel data
+// messages to a byte stream such as TCP or TLS connection.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+	max int
+}
+
+// NewEncoder returns a new Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, max: MaxMessageSize}
+}
+
+// SetMaxMessageSize sets the maximum size of message including the
+// message header and padding bytes.
+// Encode returns an error when it is asked to write a larger
+// message.
+func (e *Encoder) SetMaxMessageSize(n int) {
+	if n < controlHeaderLen || n > MaxMessageSize {
+		n = MaxMessageSize
+	}
+	e.max = n
+}
+
+// Encode writes the binary encoding of m to the stream.
+// K must be a valid key when in use of STUN MESSAGE-INTEGRITY or
+// MESSAGE-INTEGRITY-SHA256 attribute.
+// A channel data message is padded to a multiple of 4 bytes.
+func (e *Encoder) Encode(m Message, k Key) error {
+	l := m.Len()
+	if l > e.max {
+		return errors.New("message too long")
+	}
+	if cap(e.buf) < l {
+		e.buf = make([]byte, l)
+	}
+	b := e.buf[:l]
+	for i := range b {
+		b[i] = 0
+	}
+	n, err := m.Marshal(b, k)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(b[:n])
+	return err
+}
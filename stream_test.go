@@ -0,0 +1,109 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/mikioh/stun"
+)
+
+func TestEncoderAndDecoder(t *testing.T) {
+	var bb bytes.Buffer
+	enc := stun.NewEncoder(&bb)
+	tests := append(rfc5769Tests, channelDataTests...)
+	for i, tt := range tests {
+		if err := enc.Encode(tt.raw, tt.key); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if bb.Len()%4 != 0 {
+		t.Fatalf("not multiple of 4 bytes: %d", bb.Len())
+	}
+
+	dec := stun.NewDecoder(iotest.HalfReader(&bb))
+	for i, tt := range tests {
+		m, err := dec.Decode(tt.key)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		switch m := m.(type) {
+		case *stun.Control:
+			if m.Type != tt.raw.(*stun.Control).Type {
+				t.Fatalf("#%d: got %v; want %v", i, m.Type, tt.raw.(*stun.Control).Type)
+			}
+		case *stun.ChannelData:
+			if !bytes.Equal(m.Data, tt.raw.(*stun.ChannelData).Data) {
+				t.Fatalf("#%d: got %#v; want %#v", i, m.Data, tt.raw.(*stun.ChannelData).Data)
+			}
+		default:
+			t.Fatalf("#%d: unknown type: %T", i, m)
+		}
+	}
+	if _, err := dec.Decode(nil); err != io.EOF {
+		t.Fatalf("got %v; want %v", err, io.EOF)
+	}
+}
+
+func TestDecoderRetain(t *testing.T) {
+	var bb bytes.Buffer
+	enc := stun.NewEncoder(&bb)
+	for _, tt := range channelDataTests {
+		if err := enc.Encode(tt.raw, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dec := stun.NewDecoder(&bb)
+	dec.SetRetain(true)
+	var ms []stun.Message
+	for range channelDataTests {
+		m, err := dec.Decode(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ms = append(ms, m)
+	}
+	for i, tt := range channelDataTests {
+		if !bytes.Equal(ms[i].(*stun.ChannelData).Data, tt.raw.(*stun.ChannelData).Data) {
+			t.Errorf("#%d: got %#v; want %#v", i, ms[i].(*stun.ChannelData).Data, tt.raw.(*stun.ChannelData).Data)
+		}
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	for i, tt := range []struct {
+		wire string
+		max  int
+		err  error
+	}{
+		{wire: "\x7f\xff\x00\x01\xff", err: io.ErrUnexpectedEOF}, // not padded on byte stream
+		{wire: "\x00\x01\x00\x08\x21\x12", err: io.ErrUnexpectedEOF},
+		{wire: "\x80\x01\x00\x00"},
+		{wire: rfc5769Tests[0].wire, max: 64},
+	} {
+		dec := stun.NewDecoder(bytes.NewReader([]byte(tt.wire)))
+		if tt.max > 0 {
+			dec.SetMaxMessageSize(tt.max)
+		}
+		_, err := dec.Decode(nil)
+		if err == nil {
+			t.Errorf("#%d: got nil; want error", i)
+			continue
+		}
+		if tt.err != nil && err != tt.err {
+			t.Errorf("#%d: got %v; want %v", i, err, tt.err)
+		}
+	}
+
+	enc := stun.NewEncoder(new(bytes.Buffer))
+	enc.SetMaxMessageSize(64)
+	if err := enc.Encode(rfc5769Tests[0].raw, rfc5769Tests[0].key); err == nil {
+		t.Error("got nil; want error")
+	}
+}
@@ -0,0 +1,481 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package turn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/mikioh/stun"
+	"github.com/mikioh/stun/internal/netutil"
+)
+
+// Lifetimes of permissions and channel bindings as described in RFC
+// 5766 section 8 and 11.
+const (
+	PermissionLifetime = 300 * time.Second
+	ChannelLifetime    = 600 * time.Second
+)
+
+// DefaultLifetime is the default lifetime of allocations as
+// described in RFC 5766 section 2.2.
+const DefaultLifetime = 600 * time.Second
+
+const (
+	protoUDP = 17 // REQUESTED-TRANSPORT protocol number for UDP
+
+	minChannel = 0x4000 // first channel number
+	maxChannel = 0x4fff // last channel number; see RFC 8656 section 12
+)
+
+var (
+	// ErrNoAllocation is returned when the client has no
+	// allocation.
+	ErrNoAllocation = errors.New("no allocation")
+
+	// ErrAllocationExists is returned when the client already
+	// has an allocation.
+	ErrAllocationExists = errors.New("allocation already exists")
+
+	errNoChannelNumber = errors.New("no channel number available")
+	errNoRelayedAddr   = errors.New("no relayed address")
+)
+
+// A Client represents a TURN client that relays UDP datagrams via an
+// allocation on a TURN server.
+//
+// Multiple goroutines may invoke methods on a Client simultaneously.
+type Client struct {
+	// Lifetime specifies the lifetime of allocation requested by
+	// Allocate and Refresh.
+	// If zero, the server chooses the lifetime.
+	Lifetime time.Duration
+
+	// Clock specifies the source of time for tracking the
+	// lifetimes of allocation, permissions and channel bindings.
+	// If nil, the system clock is used.
+	// It must be set before the first call to Allocate.
+	Clock Clock
+
+	stun *stun.Client
+	auth *stun.Authenticator
+
+	mu          sync.Mutex
+	relayed     netip.AddrPort
+	mapped      netip.AddrPort
+	expires     time.Time
+	perms       map[netip.Addr]time.Time
+	chans       map[netip.AddrPort]*channel
+	chanPeers   map[stun.Type]netip.AddrPort
+	expired     map[netip.AddrPort]stun.Type    // numbers of expired channels
+	reserved    map[netip.AddrPort]*reservation // channels being bound
+	released    []stun.Type                     // numbers of failed bindings
+	nextChannel stun.Type
+
+	data      chan packet
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type channel struct {
+	number  stun.Type
+	expires time.Time
+}
+
+// A reservation is a channel number reserved for the peer while
+// ChannelBind transactions are outstanding.
+type reservation struct {
+	number stun.Type
+	n      int // number of outstanding transactions
+}
+
+type packet struct {
+	b    []byte
+	peer netip.AddrPort
+}
+
+// NewClient returns a new Client that runs transactions with the
+// TURN server over c, and authenticates them with the long-term
+// credential of username and password.
+//
+// NewClient takes over the Unsolicited field of c to receive
+// indications and channel data messages; c must not have been used.
+func NewClient(c *stun.Client, username, password string) *Client {
+	cl := &Client{
+		stun:        c,
+		auth:        &stun.Authenticator{Transport: c, Username: username, Password: password},
+		perms:       make(map[netip.Addr]time.Time),
+		chans:       make(map[netip.AddrPort]*channel),
+		chanPeers:   make(map[stun.Type]netip.AddrPort),
+		expired:     make(map[netip.AddrPort]stun.Type),
+		reserved:    make(map[netip.AddrPort]*reservation),
+		nextChannel: minChannel,
+		data:        make(chan packet, 128),
+		closed:      make(chan struct{}),
+	}
+	c.Unsolicited = cl.receive
+	return cl
+}
+
+// Allocate creates an allocation on the server and returns the
+// relayed transport address.
+func (c *Client) Allocate(ctx context.Context) (netip.AddrPort, error) {
+	c.mu.Lock()
+	allocated := c.relayed.IsValid()
+	c.mu.Unlock()
+	if allocated {
+		return netip.AddrPort{}, ErrAllocationExists
+	}
+	req := &stun.Control{
+		Type:  stun.MessageType(stun.ClassRequest, stun.MethodAllocate),
+		Attrs: []stun.Attribute{&stun.RequestedTransport{Protocol: protoUDP}},
+	}
+	if c.Lifetime > 0 {
+		req.Add(stun.Lifetime(c.Lifetime))
+	}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	xa, ok := stun.Get[*stun.XORRelayedAddr](resp)
+	if !ok {
+		return netip.AddrPort{}, &stun.MessageError{Type: resp.Type, Err: errNoRelayedAddr}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.relayed = (*stun.Addr)(xa).AddrPort()
+	if xa, ok := stun.Get[*stun.XORMappedAddr](resp); ok {
+		c.mapped = (*stun.Addr)(xa).AddrPort()
+	}
+	c.expires = c.now().Add(lifetimeOf(resp, DefaultLifetime))
+	return c.relayed, nil
+}
+
+// Refresh refreshes the allocation with the lifetime.
+// If lifetime is zero, Refresh deletes the allocation; the error
+// response with the STUN error code 437, such as the one to a
+// retransmitted request, is treated as success.
+func (c *Client) Refresh(ctx context.Context, lifetime time.Duration) error {
+	if !c.allocated() {
+		return ErrNoAllocation
+	}
+	req := &stun.Control{
+		Type:  stun.MessageType(stun.ClassRequest, stun.MethodRefresh),
+		Attrs: []stun.Attribute{stun.Lifetime(lifetime)},
+	}
+	resp, err := c.do(ctx, req)
+	var e *stun.Error
+	if lifetime == 0 && errors.As(err, &e) && e.Code == stun.StatusAllocationMismatch {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if lifetime == 0 {
+		c.resetLocked()
+		return nil
+	}
+	c.expires = c.now().Add(lifetimeOf(resp, lifetime))
+	return nil
+}
+
+// CreatePermission installs or refreshes the permissions for the
+// peers.
+func (c *Client) CreatePermission(ctx context.Context, peers ...netip.Addr) error {
+	if !c.allocated() {
+		return ErrNoAllocation
+	}
+	req := &stun.Control{Type: stun.MessageType(stun.ClassRequest, stun.MethodCreatePermission)}
+	for _, peer := range peers {
+		req.Add(stun.XORPeerAddrPort{AddrPort: netip.AddrPortFrom(peer, 0)})
+	}
+	if _, err := c.do(ctx, req); err != nil {
+		return err
+	}
+	expires := c.now().Add(PermissionLifetime)
+	c.mu.Lock()
+	for _, peer := range peers {
+		c.perms[peer.Unmap()] = expires
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// BindChannel binds a channel to the peer, or refreshes the binding,
+// and returns the channel number.
+// The binding also installs or refreshes the permission for the
+// peer.
+func (c *Client) BindChannel(ctx context.Context, peer netip.AddrPort) (stun.Type, error) {
+	if !c.allocated() {
+		return 0, ErrNoAllocation
+	}
+	peer = netutil.Unmap(peer)
+	c.mu.Lock()
+	number, err := c.reserveLocked(peer)
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	req := &stun.Control{
+		Type: stun.MessageType(stun.ClassRequest, stun.MethodChannelBind),
+		Attrs: []stun.Attribute{
+			&stun.ChannelNumber{Number: number},
+			stun.XORPeerAddrPort{AddrPort: peer},
+		},
+	}
+	_, err = c.do(ctx, req)
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.releaseLocked(peer, err != nil)
+	if err != nil {
+		return 0, err
+	}
+	c.chans[peer] = &channel{number: number, expires: now.Add(ChannelLifetime)}
+	c.chanPeers[number] = peer
+	delete(c.expired, peer)
+	c.perms[peer.Addr()] = now.Add(PermissionLifetime)
+	return number, nil
+}
+
+// reserveLocked returns the channel number for the peer.
+// A new number is reserved for the peer until releaseLocked is called
+// by all the callers for the peer.
+func (c *Client) reserveLocked(peer netip.AddrPort) (stun.Type, error) {
+	if ch, ok := c.chans[peer]; ok {
+		return ch.number, nil
+	}
+	r, ok := c.reserved[peer]
+	if !ok {
+		r = &reservation{}
+		// The number of the expired channel remains bound to the
+		// peer on the server for a while.
+		number, ok := c.expired[peer]
+		switch {
+		case ok:
+			r.number = number
+		case len(c.released) > 0:
+			r.number = c.released[len(c.released)-1]
+			c.released = c.released[:len(c.released)-1]
+		case c.nextChannel <= maxChannel:
+			r.number = c.nextChannel
+			c.nextChannel++
+		default:
+			return 0, errNoChannelNumber
+		}
+		c.reserved[peer] = r
+	}
+	r.n++
+	return r.number, nil
+}
+
+// releaseLocked releases the reservation for the peer.
+// The channel number is returned for reuse when failed is true and
+// no channel is bound to the peer.
+func (c *Client) releaseLocked(peer netip.AddrPort, failed bool) {
+	r, ok := c.reserved[peer]
+	if !ok {
+		return
+	}
+	if r.n--; r.n > 0 {
+		return
+	}
+	delete(c.reserved, peer)
+	_, bound := c.chans[peer]
+	_, expired := c.expired[peer]
+	if failed && !bound && !expired {
+		c.released = append(c.released, r.number)
+	}
+}
+
+// unbindLocked removes the channel bound to the peer.
+// The channel number is kept for rebinding the peer.
+func (c *Client) unbindLocked(peer netip.AddrPort) {
+	if ch, ok := c.chans[peer]; ok {
+		delete(c.chans, peer)
+		delete(c.chanPeers, ch.number)
+		c.expired[peer] = ch.number
+	}
+}
+
+// SendTo sends b to the peer via the allocation.
+// It uses a channel data message when an unexpired channel is bound
+// to the peer; otherwise, it uses a Send indication.
+// The permission for the peer must be installed.
+func (c *Client) SendTo(b []byte, peer netip.AddrPort) error {
+	if !c.allocated() {
+		return ErrNoAllocation
+	}
+	peer = netutil.Unmap(peer)
+	now := c.now()
+	c.mu.Lock()
+	ch, ok := c.chans[peer]
+	if ok && !now.Before(ch.expires) {
+		c.unbindLocked(peer)
+		ok = false
+	}
+	c.mu.Unlock()
+	if ok {
+		return c.stun.Send(&stun.ChannelData{Number: ch.number, Data: b}, nil)
+	}
+	ind := &stun.Control{
+		Type: stun.MessageType(stun.ClassIndication, stun.MethodSend),
+		Attrs: []stun.Attribute{
+			stun.XORPeerAddrPort{AddrPort: peer},
+			stun.Data(b),
+		},
+	}
+	return c.stun.Send(ind, nil)
+}
+
+// ReceiveFrom receives data relayed from a peer and copies it into
+// b.
+// It returns the number of bytes copied and the transport address of
+// the peer.
+// After Close, it returns net.ErrClosed.
+func (c *Client) ReceiveFrom(ctx context.Context, b []byte) (int, netip.AddrPort, error) {
+	select {
+	case p := <-c.data:
+		return copy(b, p.b), p.peer, nil
+	case <-c.closed:
+		return 0, netip.AddrPort{}, net.ErrClosed
+	case <-ctx.Done():
+		return 0, netip.AddrPort{}, ctx.Err()
+	}
+}
+
+// RelayedAddr returns the relayed transport address of the
+// allocation.
+func (c *Client) RelayedAddr() netip.AddrPort {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.relayed
+}
+
+// MappedAddr returns the server-reflexive transport address of the
+// client.
+func (c *Client) MappedAddr() netip.AddrPort {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mapped
+}
+
+// Expires returns the expiration time of the allocation.
+func (c *Client) Expires() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.expires
+}
+
+// Close closes the underlying connection.
+// It doesn't delete the allocation; use Refresh with zero lifetime
+// before Close.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.stun.Close()
+}
+
+func (c *Client) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock.Now()
+	}
+	return time.Now()
+}
+
+func (c *Client) allocated() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.relayed.IsValid()
+}
+
+// permitted reports whether the permission for the peer is
+// installed and not expired.
+func (c *Client) permitted(peer netip.Addr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now().Before(c.perms[peer.Unmap()])
+}
+
+func (c *Client) resetLocked() {
+	c.relayed, c.mapped, c.expires = netip.AddrPort{}, netip.AddrPort{}, time.Time{}
+	clear(c.perms)
+	clear(c.chans)
+	clear(c.chanPeers)
+	clear(c.expired)
+	clear(c.reserved)
+	c.released = c.released[:0]
+	c.nextChannel = minChannel
+}
+
+// do runs the authenticated transaction for req and returns the
+// success response.
+// An error response is returned as an error that wraps the
+// ERROR-CODE attribute.
+func (c *Client) do(ctx context.Context, req *stun.Control) (*stun.Control, error) {
+	resp, err := c.auth.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Type.Class() == stun.ClassErrorResponse {
+		e, ok := stun.Get[*stun.Error](resp)
+		if !ok {
+			e = stun.NewError(stun.StatusServerError)
+		}
+		if e.Code == stun.StatusAllocationMismatch && req.Type.Method() != stun.MethodAllocate {
+			c.mu.Lock()
+			c.resetLocked()
+			c.mu.Unlock()
+		}
+		return nil, &stun.MessageError{Type: resp.Type, Err: e}
+	}
+	return resp, nil
+}
+
+// receive delivers data carried in a Data indication or channel data
+// message.
+func (c *Client) receive(m stun.Message) {
+	var p packet
+	switch m := m.(type) {
+	case *stun.ChannelData:
+		c.mu.Lock()
+		peer, ok := c.chanPeers[m.Number]
+		c.mu.Unlock()
+		if !ok {
+			return
+		}
+		p = packet{b: m.Data, peer: peer}
+	case *stun.Control:
+		if m.Type != stun.MessageType(stun.ClassIndication, stun.MethodData) {
+			return
+		}
+		xa, ok := stun.Get[*stun.XORPeerAddr](m)
+		data, ok2 := stun.Get[stun.Data](m)
+		if !ok || !ok2 {
+			return
+		}
+		p = packet{b: data, peer: (*stun.Addr)(xa).AddrPort()}
+	default:
+		return
+	}
+	select {
+	case c.data <- p:
+	default: // drop like a full socket receive buffer
+	}
+}
+
+// lifetimeOf returns the lifetime carried in resp, or lifetime if
+// none.
+func lifetimeOf(resp *stun.Control, lifetime time.Duration) time.Duration {
+	if lt, ok := stun.Get[stun.Lifetime](resp); ok {
+		return time.Duration(lt)
+	}
+	return lifetime
+}
@@ -0,0 +1,303 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package turn_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mikioh/stun"
+	"github.com/mikioh/stun/turn"
+)
+
+// A testConn is a client connection that counts the messages sent
+// and received, and drops the success responses of drop.
+type testConn struct {
+	net.PacketConn
+
+	mu          sync.Mutex
+	channelData int                    // number of channel data messages sent
+	responses   map[string]stun.Method // methods of responses keyed by transaction ID
+	drop        map[stun.Method]int    // numbers of responses to drop
+}
+
+func (c *testConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > 0 && b[0]&0xc0 == 0x40 {
+		c.mu.Lock()
+		c.channelData++
+		c.mu.Unlock()
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *testConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, from, err
+		}
+		if _, m, err := stun.ParseMessage(b[:n], nil); err == nil {
+			if m, ok := m.(*stun.Control); ok && m.Type.Class() == stun.ClassSuccessResponse {
+				c.mu.Lock()
+				method := m.Type.Method()
+				drop := c.drop[method] > 0
+				if drop {
+					c.drop[method]--
+				} else {
+					c.responses[string(m.TID)] = method
+				}
+				c.mu.Unlock()
+				if drop {
+					continue
+				}
+			}
+		}
+		return n, from, err
+	}
+}
+
+func (c *testConn) dropResponses(method stun.Method, n int) {
+	c.mu.Lock()
+	c.drop[method] += n
+	c.mu.Unlock()
+}
+
+func (c *testConn) channelDataCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.channelData
+}
+
+// responseCounts returns the number of success responses for each
+// method.
+func (c *testConn) responseCounts() map[stun.Method]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[stun.Method]int)
+	for _, method := range c.responses {
+		m[method]++
+	}
+	return m
+}
+
+func newTestClient(t *testing.T, server net.Addr, password string) (*turn.Client, *testConn) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testConn{PacketConn: pc, responses: make(map[string]stun.Method), drop: make(map[stun.Method]int)}
+	sc := stun.NewPacketClient(c, server)
+	sc.RTO = 20 * time.Millisecond
+	cl := turn.NewClient(sc, "user", password)
+	t.Cleanup(func() { cl.Close() })
+	return cl, c
+}
+
+func newPeer(t *testing.T) (net.PacketConn, netip.AddrPort) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, c.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func readPeer(t *testing.T, c net.PacketConn) (string, net.Addr) {
+	t.Helper()
+	b := make([]byte, 1500)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := c.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b[:n]), from
+}
+
+func TestClient(t *testing.T) {
+	addr := newServer(t, &turn.Server{})
+	cl, c := newTestClient(t, addr, "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	relayed, err := cl.Allocate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relayed != cl.RelayedAddr() || !relayed.Addr().IsLoopback() {
+		t.Fatalf("got %v, %v; want loopback address", relayed, cl.RelayedAddr())
+	}
+	if mapped := cl.MappedAddr(); mapped != c.LocalAddr().(*net.UDPAddr).AddrPort() {
+		t.Fatalf("got %v; want %v", mapped, c.LocalAddr())
+	}
+	if d := time.Until(cl.Expires()); d <= 0 || d > turn.DefaultLifetime {
+		t.Fatalf("got %v; want within %v", d, turn.DefaultLifetime)
+	}
+	if _, err := cl.Allocate(ctx); err != turn.ErrAllocationExists {
+		t.Fatalf("got %v; want %v", err, turn.ErrAllocationExists)
+	}
+
+	peer, peerAddr := newPeer(t)
+	if err := cl.CreatePermission(ctx, peerAddr.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1500)
+	for _, channel := range []bool{false, true} {
+		if channel {
+			number, err := cl.BindChannel(ctx, peerAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if number != 0x4000 {
+				t.Fatalf("got %#x; want 0x4000", number)
+			}
+		}
+		if err := cl.SendTo([]byte("hello"), peerAddr); err != nil {
+			t.Fatal(err)
+		}
+		data, from := readPeer(t, peer)
+		if data != "hello" || from.(*net.UDPAddr).AddrPort() != relayed {
+			t.Fatalf("got %q from %v; want hello from %v", data, from, relayed)
+		}
+		if _, err := peer.WriteTo([]byte("world"), net.UDPAddrFromAddrPort(relayed)); err != nil {
+			t.Fatal(err)
+		}
+		n, from2, err := cl.ReceiveFrom(ctx, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[:n], []byte("world")) || from2 != peerAddr {
+			t.Fatalf("got %q from %v; want world from %v", b[:n], from2, peerAddr)
+		}
+	}
+	if channelData := c.channelDataCount(); channelData != 1 {
+		t.Fatalf("got %d channel data messages; want 1", channelData)
+	}
+
+	if err := cl.Refresh(ctx, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Refresh(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.SendTo([]byte("hello"), peerAddr); err != turn.ErrNoAllocation {
+		t.Fatalf("got %v; want %v", err, turn.ErrNoAllocation)
+	}
+}
+
+func TestClientBindChannel(t *testing.T) {
+	addr := newServer(t, &turn.Server{})
+	cl, _ := newTestClient(t, addr, "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := cl.Allocate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed binding releases the channel number.
+	if _, err := cl.BindChannel(ctx, netip.MustParseAddrPort("[::1]:1")); err == nil {
+		t.Fatal("got nil; want error")
+	}
+	_, peer1 := newPeer(t)
+	_, peer2 := newPeer(t)
+	var wg sync.WaitGroup
+	var numbers [4]stun.Type
+	for i := range numbers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			number, err := cl.BindChannel(ctx, peer1)
+			if err != nil {
+				t.Error(err)
+			}
+			numbers[i] = number
+		}()
+	}
+	wg.Wait()
+	for i, number := range numbers {
+		if number != 0x4000 {
+			t.Fatalf("#%d: got %#x; want 0x4000", i, int(number))
+		}
+	}
+	if number, err := cl.BindChannel(ctx, peer2); err != nil || number != 0x4001 {
+		t.Fatalf("got %#x, %v; want 0x4001", int(number), err)
+	}
+}
+
+func TestClientChannelExpiry(t *testing.T) {
+	addr := newServer(t, &turn.Server{})
+	cl, c := newTestClient(t, addr, "secret")
+	fc := newFakeClock()
+	cl.Clock = fc
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := cl.Allocate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	peer, peerAddr := newPeer(t)
+	if _, err := cl.BindChannel(ctx, peerAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	// The expired channel is not used; the server runs on the
+	// system clock and still relays the Send indication.
+	fc.Advance(turn.ChannelLifetime)
+	if err := cl.SendTo([]byte("hello"), peerAddr); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := readPeer(t, peer); data != "hello" {
+		t.Fatalf("got %q; want hello", data)
+	}
+	if channelData := c.channelDataCount(); channelData != 0 {
+		t.Fatalf("got %d channel data messages; want 0", channelData)
+	}
+
+	// The peer is bound to the same channel number again.
+	if number, err := cl.BindChannel(ctx, peerAddr); err != nil || number != 0x4000 {
+		t.Fatalf("got %#x, %v; want 0x4000", int(number), err)
+	}
+	if err := cl.SendTo([]byte("hello"), peerAddr); err != nil {
+		t.Fatal(err)
+	}
+	readPeer(t, peer)
+	if channelData := c.channelDataCount(); channelData != 1 {
+		t.Fatalf("got %d channel data messages; want 1", channelData)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	fc := newFakeClock()
+	addr := newServer(t, &turn.Server{Clock: fc})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cl, _ := newTestClient(t, addr, "wrong")
+	if _, err := cl.Allocate(ctx); !errors.Is(err, stun.ErrUnauthorized) {
+		t.Fatalf("got %v; want %v", err, stun.ErrUnauthorized)
+	}
+	if err := cl.CreatePermission(ctx, netip.MustParseAddr("127.0.0.1")); err != turn.ErrNoAllocation {
+		t.Fatalf("got %v; want %v", err, turn.ErrNoAllocation)
+	}
+
+	// The allocation expired on the server is reported with the
+	// STUN error code 437.
+	cl, _ = newTestClient(t, addr, "secret")
+	if _, err := cl.Allocate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(turn.DefaultLifetime)
+	var e *stun.Error
+	if err := cl.Refresh(ctx, time.Minute); !errors.As(err, &e) || e.Code != stun.StatusAllocationMismatch {
+		t.Fatalf("got %v; want %d", err, stun.StatusAllocationMismatch)
+	}
+	if cl.RelayedAddr().IsValid() {
+		t.Fatal("allocation remains")
+	}
+}
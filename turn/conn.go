@@ -0,0 +1,265 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package turn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mikioh/stun/internal/netutil"
+)
+
+// closeTimeout is the maximum duration of the deletion of allocation
+// on Close.
+const closeTimeout = 5 * time.Second
+
+// A Conn represents a net.PacketConn relayed via a TURN allocation.
+// The local address is the relayed transport address of the
+// allocation.
+//
+// WriteTo installs the permission for the peer on demand, and uses a
+// channel data message instead of a Send indication once a channel is
+// bound to the peer by BindChannel. ReadFrom receives data carried in
+// Data indications and channel data messages.
+type Conn struct {
+	client *Client
+	laddr  *net.UDPAddr
+
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+// NewConn creates an allocation with the client c unless c already
+// has one, and returns a new Conn relayed via the allocation.
+// The Conn takes over c; closing the Conn deletes the allocation and
+// closes c.
+func NewConn(ctx context.Context, c *Client) (*Conn, error) {
+	relayed := c.RelayedAddr()
+	if !relayed.IsValid() {
+		var err error
+		if relayed, err = c.Allocate(ctx); err != nil {
+			return nil, &net.OpError{Op: "allocate", Net: "udp", Err: err}
+		}
+	}
+	return &Conn{
+		client:        c,
+		laddr:         net.UDPAddrFromAddrPort(relayed),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}, nil
+}
+
+// Client returns the underlying client.
+func (c *Conn) Client() *Client {
+	return c.client
+}
+
+// ReadFrom implements the ReadFrom method of net.PacketConn
+// interface.
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-c.readDeadline.wait():
+		return 0, nil, c.opError("read", nil, os.ErrDeadlineExceeded)
+	default:
+	}
+	select {
+	case p := <-c.client.data:
+		return copy(b, p.b), net.UDPAddrFromAddrPort(p.peer), nil
+	case <-c.client.closed:
+		return 0, nil, c.opError("read", nil, net.ErrClosed)
+	case <-c.readDeadline.wait():
+		return 0, nil, c.opError("read", nil, os.ErrDeadlineExceeded)
+	}
+}
+
+// WriteTo implements the WriteTo method of net.PacketConn interface.
+// It installs the permission for the peer at addr before sending b
+// unless installed.
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	peer, err := netutil.UDPAddrPort(addr)
+	if err != nil {
+		return 0, c.opError("write", addr, err)
+	}
+	select {
+	case <-c.writeDeadline.wait():
+		return 0, c.opError("write", addr, os.ErrDeadlineExceeded)
+	default:
+	}
+	if err := c.permit(peer.Addr()); err != nil {
+		return 0, c.opError("write", addr, err)
+	}
+	if err := c.client.SendTo(b, peer); err != nil {
+		return 0, c.opError("write", addr, err)
+	}
+	return len(b), nil
+}
+
+// BindChannel binds a channel to the peer at addr, or refreshes the
+// binding.
+// Subsequent writes to the peer use channel data messages.
+func (c *Conn) BindChannel(addr net.Addr) error {
+	peer, err := netutil.UDPAddrPort(addr)
+	if err != nil {
+		return c.opError("bind", addr, err)
+	}
+	ctx, cancel := c.writeContext()
+	defer cancel()
+	if _, err := c.client.BindChannel(ctx, peer); err != nil {
+		return c.opError("bind", addr, c.contextError(ctx, err))
+	}
+	return nil
+}
+
+// permit installs the permission for the peer unless installed.
+func (c *Conn) permit(peer netip.Addr) error {
+	if c.client.permitted(peer) {
+		return nil
+	}
+	ctx, cancel := c.writeContext()
+	defer cancel()
+	return c.contextError(ctx, c.client.CreatePermission(ctx, peer))
+}
+
+// writeContext returns a context canceled when the write deadline
+// expires.
+func (c *Conn) writeContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.writeDeadline.wait():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (c *Conn) contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil && errors.Is(err, context.Canceled) {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+// Close implements the Close method of net.PacketConn interface.
+// It deletes the allocation by a Refresh request with zero lifetime
+// and closes the underlying client.
+// The deletion is bounded by the write deadline and gives up after
+// a few seconds.
+func (c *Conn) Close() error {
+	ctx, cancel := c.writeContext()
+	defer cancel()
+	ctx, cancelTimeout := context.WithTimeout(ctx, closeTimeout)
+	defer cancelTimeout()
+	err := c.contextError(ctx, c.client.Refresh(ctx, 0))
+	if errors.Is(err, ErrNoAllocation) {
+		err = nil
+	}
+	if cerr := c.client.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return c.opError("close", nil, err)
+	}
+	return nil
+}
+
+// LocalAddr implements the LocalAddr method of net.PacketConn
+// interface.
+// It returns the relayed transport address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// SetDeadline implements the SetDeadline method of net.PacketConn
+// interface.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline implements the SetReadDeadline method of
+// net.PacketConn interface.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements the SetWriteDeadline method of
+// net.PacketConn interface.
+// The deadline applies to the installation of permission and
+// sending data.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Source: c.laddr, Addr: addr, Err: err}
+}
+
+// A deadline signals the expiration of read or write deadline.
+type deadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	done    chan struct{} // closed when expired
+	expired bool
+}
+
+func makeDeadline() deadline {
+	return deadline{done: make(chan struct{})}
+}
+
+// set sets the deadline to t.
+// A zero value for t means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.expired {
+		d.done, d.expired = make(chan struct{}), false
+	}
+	if t.IsZero() {
+		return
+	}
+	dur := time.Until(t)
+	if dur <= 0 {
+		d.expireLocked()
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(dur, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.timer == timer { // not stopped by set
+			d.expireLocked()
+		}
+	})
+	d.timer = timer
+}
+
+func (d *deadline) expireLocked() {
+	d.timer = nil
+	if !d.expired {
+		close(d.done)
+		d.expired = true
+	}
+}
+
+// wait returns a channel that is closed when the deadline expires.
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.done
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package turn_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mikioh/stun"
+	"github.com/mikioh/stun/turn"
+)
+
+func TestConn(t *testing.T) {
+	addr := newServer(t, &turn.Server{MaxAllocations: 1})
+	cl, c := newTestClient(t, addr, "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var conn net.PacketConn
+	conn, err := turn.NewConn(ctx, cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.LocalAddr().(*net.UDPAddr).AddrPort() != cl.RelayedAddr() {
+		t.Fatalf("got %v; want %v", conn.LocalAddr(), cl.RelayedAddr())
+	}
+
+	peer, peerAddr := newPeer(t)
+	b := make([]byte, 1500)
+	for _, channel := range []bool{false, true} {
+		if channel {
+			if err := conn.(*turn.Conn).BindChannel(peer.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := conn.WriteTo([]byte("hello"), peer.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if data, from := readPeer(t, peer); data != "hello" || from.String() != conn.LocalAddr().String() {
+			t.Fatalf("got %q from %v; want hello from %v", data, from, conn.LocalAddr())
+		}
+		if _, err := peer.WriteTo([]byte("world"), conn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, from, err := conn.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != "world" || from.(*net.UDPAddr).AddrPort() != peerAddr {
+			t.Fatalf("got %q from %v; want world from %v", b[:n], from, peerAddr)
+		}
+	}
+	if channelData := c.channelDataCount(); channelData != 1 {
+		t.Fatalf("got %d channel data messages; want 1", channelData)
+	}
+
+	// A read deadline in the past and a deadline set during a
+	// blocked read both time out.
+	conn.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, _, err := conn.ReadFrom(b); !isTimeout(err) {
+		t.Fatalf("got %v; want timeout", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.SetReadDeadline(time.Now())
+	}()
+	if _, _, err := conn.ReadFrom(b); !isTimeout(err) {
+		t.Fatalf("got %v; want timeout", err)
+	}
+
+	// Close deletes the allocation, so another one can be created.
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cl, _ = newTestClient(t, addr, "secret")
+	if _, err := cl.Allocate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if _, _, err := conn.ReadFrom(b); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v; want %v", err, net.ErrClosed)
+	}
+}
+
+func TestConnWriteDeadline(t *testing.T) {
+	s := &turn.Server{}
+	cl, _ := newTestClient(t, newServer(t, s), "secret")
+	conn, err := turn.NewConn(context.Background(), cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The write deadline in the past times out even if the
+	// permission is installed.
+	peer, _ := newPeer(t)
+	if _, err := conn.WriteTo([]byte("hello"), peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := conn.WriteTo([]byte("hello"), peer.LocalAddr()); !isTimeout(err) {
+		t.Fatalf("got %v; want timeout", err)
+	}
+
+	// The server stops responding, so the installation of
+	// permission for another peer times out.
+	s.Close()
+	conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1}); !isTimeout(err) {
+		t.Fatalf("got %v; want timeout", err)
+	}
+	if _, err := conn.WriteTo([]byte("hello"), &net.TCPAddr{}); err == nil {
+		t.Fatal("wrote to TCP address")
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	s := &turn.Server{MaxAllocations: 1}
+	addr := newServer(t, s)
+	cl, c := newTestClient(t, addr, "secret")
+	conn, err := turn.NewConn(context.Background(), cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The response to the deletion is lost, and the retransmitted
+	// request finds no allocation.
+	c.dropResponses(stun.MethodRefresh, 1)
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cl, _ = newTestClient(t, addr, "secret")
+	if _, err := cl.Allocate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server stops responding, so the deletion times out.
+	conn, err = turn.NewConn(context.Background(), cl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	if err := conn.Close(); !isTimeout(err) {
+		t.Fatalf("got %v; want timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("took %v; want less than 1s", d)
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
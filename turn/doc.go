@@ -0,0 +1,8 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package turn implements the relaying of UDP datagrams using TURN.
+//
+// Traversal Using Relays around NAT (TURN) is defined in RFC 5766.
+package turn
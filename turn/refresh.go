@@ -0,0 +1,223 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package turn
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/mikioh/stun"
+)
+
+// A Clock represents a source of time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the
+	// current time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Default parameters of Refresher.
+const (
+	DefaultRefreshMargin = 60 * time.Second
+	DefaultRetryInterval = 5 * time.Second
+)
+
+// A RefreshError represents a failure to refresh an allocation,
+// permission or channel binding.
+type RefreshError struct {
+	Method stun.Method    // MethodRefresh, MethodCreatePermission or MethodChannelBind
+	Peer   netip.AddrPort // peer of permission or channel binding; port is zero for permission
+	Err    error
+}
+
+func (e *RefreshError) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+	if e.Method == stun.MethodRefresh {
+		return "refresh allocation: " + e.Err.Error()
+	}
+	return "refresh " + e.Method.String() + " for " + e.Peer.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *RefreshError) Unwrap() error {
+	return e.Err
+}
+
+// A Refresher keeps the allocation, permissions and channel bindings
+// of Client alive by refreshing them before expiry.
+//
+// A transaction that times out is retried every RetryInterval until
+// the expiry. Stale nonces are handled by the client.
+type Refresher struct {
+	// Client specifies the client owning the allocation.
+	Client *Client
+
+	// Margin specifies how long before expiry the refresh takes
+	// place. When a lifetime is shorter than twice Margin, the
+	// refresh takes place at the half of the lifetime.
+	// If zero, DefaultRefreshMargin is used.
+	Margin time.Duration
+
+	// RetryInterval specifies the interval of retries.
+	// If zero, DefaultRetryInterval is used.
+	RetryInterval time.Duration
+
+	// OnError optionally specifies a function called with a
+	// permanent failure to refresh a permission or channel
+	// binding; the permission or channel binding is removed from
+	// the client.
+	OnError func(err *RefreshError)
+}
+
+type refreshKey struct {
+	method stun.Method
+	peer   netip.AddrPort
+}
+
+// Run refreshes the allocation, permissions and channel bindings
+// until ctx is done or the allocation fails.
+// It returns the context's error, or the RefreshError for the
+// allocation. A failure with the STUN error code 437 is permanent.
+func (r *Refresher) Run(ctx context.Context) error {
+	c := r.Client
+	clock := c.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	margin, retryInterval := r.Margin, r.RetryInterval
+	if margin <= 0 {
+		margin = DefaultRefreshMargin
+	}
+	if retryInterval <= 0 {
+		retryInterval = DefaultRetryInterval
+	}
+	retries := make(map[refreshKey]time.Time)   // time of next retry
+	refreshed := make(map[refreshKey]time.Time) // time of last refresh or first sight
+	for {
+		if !c.allocated() {
+			return &RefreshError{Method: stun.MethodRefresh, Err: ErrNoAllocation}
+		}
+		now := clock.Now()
+		next := now.Add(ChannelLifetime)
+		var attempted bool
+		for k, expires := range c.expiries() {
+			t, ok := refreshed[k]
+			if !ok {
+				t = now
+				refreshed[k] = t
+			}
+			due := expires.Add(-margin)
+			if due.Before(t.Add(expires.Sub(t) / 2)) {
+				due = t.Add(expires.Sub(t) / 2) // short lifetime
+			}
+			if t, ok := retries[k]; ok {
+				due = t
+			}
+			if due.After(now) {
+				if due.Before(next) {
+					next = due
+				}
+				continue
+			}
+			attempted = true
+			err := r.refresh(ctx, k)
+			if err == nil {
+				delete(retries, k)
+				refreshed[k] = clock.Now()
+				continue
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if now = clock.Now(); errors.Is(err, stun.ErrTimeout) && now.Add(retryInterval).Before(expires) {
+				retries[k] = now.Add(retryInterval)
+				if retries[k].Before(next) {
+					next = retries[k]
+				}
+				continue
+			}
+			delete(retries, k)
+			if k.method == stun.MethodRefresh || !c.allocated() {
+				c.mu.Lock()
+				c.resetLocked()
+				c.mu.Unlock()
+				return &RefreshError{Method: stun.MethodRefresh, Err: err}
+			}
+			rerr := &RefreshError{Method: k.method, Peer: k.peer, Err: err}
+			delete(refreshed, k)
+			c.remove(k)
+			if r.OnError != nil {
+				r.OnError(rerr)
+			}
+		}
+		if attempted {
+			continue // reschedule with the new expiration times
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(next.Sub(clock.Now())):
+		}
+	}
+}
+
+func (r *Refresher) refresh(ctx context.Context, k refreshKey) error {
+	c := r.Client
+	switch k.method {
+	case stun.MethodRefresh:
+		lifetime := c.Lifetime
+		if lifetime <= 0 {
+			lifetime = DefaultLifetime
+		}
+		return c.Refresh(ctx, lifetime)
+	case stun.MethodCreatePermission:
+		return c.CreatePermission(ctx, k.peer.Addr())
+	default:
+		_, err := c.BindChannel(ctx, k.peer)
+		return err
+	}
+}
+
+// expiries returns the expiration times of the allocation,
+// permissions and channel bindings.
+func (c *Client) expiries() map[refreshKey]time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[refreshKey]time.Time, 1+len(c.perms)+len(c.chans))
+	if c.relayed.IsValid() {
+		m[refreshKey{method: stun.MethodRefresh}] = c.expires
+	}
+	for peer, expires := range c.perms {
+		m[refreshKey{method: stun.MethodCreatePermission, peer: netip.AddrPortFrom(peer, 0)}] = expires
+	}
+	for peer, ch := range c.chans {
+		m[refreshKey{method: stun.MethodChannelBind, peer: peer}] = ch.expires
+	}
+	return m
+}
+
+// remove removes the permission or channel binding of k.
+func (c *Client) remove(k refreshKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch k.method {
+	case stun.MethodCreatePermission:
+		delete(c.perms, k.peer.Addr())
+	case stun.MethodChannelBind:
+		c.unbindLocked(k.peer)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package turn_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mikioh/stun"
+	"github.com/mikioh/stun/turn"
+)
+
+// A fakeClock is a manually advanced clock.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	waiting chan time.Duration // receives the duration passed to After
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1e9, 0), waiting: make(chan time.Duration)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	t := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	c.mu.Unlock()
+	c.waiting <- d
+	return t.c
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			timers = append(timers, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = timers
+}
+
+// wait waits for the refresher to sleep and returns the duration of
+// sleep.
+func (c *fakeClock) wait(t *testing.T) time.Duration {
+	t.Helper()
+	select {
+	case d := <-c.waiting:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("refresher is not sleeping")
+		return 0
+	}
+}
+
+// A testCredentials is a credential store that can revoke the
+// credentials.
+type testCredentials struct {
+	mu      sync.Mutex
+	revoked bool
+}
+
+func (c *testCredentials) Key(username, realm string, algorithm int) (stun.Key, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.revoked {
+		return nil, stun.ErrUnknownUser
+	}
+	return stun.StaticCredentials{"user": "secret"}.Key(username, realm, algorithm)
+}
+
+func (c *testCredentials) revoke(revoked bool) {
+	c.mu.Lock()
+	c.revoked = revoked
+	c.mu.Unlock()
+}
+
+func TestRefresher(t *testing.T) {
+	// The server runs on its own clock for expiring the
+	// allocation on the server only.
+	fc, sfc := newFakeClock(), newFakeClock()
+	creds := &testCredentials{}
+	addr := newServer(t, &turn.Server{
+		Credentials: creds,
+		Nonces:      &stun.NonceManager{Lifetime: 500 * time.Second, Now: sfc.Now},
+		Clock:       sfc,
+	})
+	cl, c := newTestClient(t, addr, "secret")
+	cl.Clock = fc
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := cl.Allocate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, peer1 := newPeer(t)
+	_, peer2 := newPeer(t)
+	if err := cl.CreatePermission(ctx, peer1.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.BindChannel(ctx, peer2); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan *turn.RefreshError, 1)
+	r := &turn.Refresher{Client: cl, OnError: func(err *turn.RefreshError) { errc <- err }}
+	done := make(chan error, 1)
+	go func() { done <- r.Run(ctx) }()
+
+	advance := func(d time.Duration) {
+		sfc.Advance(d)
+		fc.Advance(d)
+	}
+	expect := func(d, sleep time.Duration, delta map[stun.Method]int) {
+		t.Helper()
+		before := c.responseCounts()
+		advance(d)
+		if d := fc.wait(t); d != sleep {
+			t.Fatalf("got %v; want %v", d, sleep)
+		}
+		after := c.responseCounts()
+		for _, m := range []stun.Method{stun.MethodRefresh, stun.MethodCreatePermission, stun.MethodChannelBind} {
+			if after[m]-before[m] != delta[m] {
+				t.Fatalf("got %d %v responses; want %d", after[m]-before[m], m, delta[m])
+			}
+		}
+	}
+	// The permission, shared by the peers on the same IP address,
+	// expires in 300s; the allocation and channel binding expire in
+	// 600s. They are refreshed 60s before expiry, and the refresh of
+	// channel binding also refreshes the permission.
+	expect(0, 240*time.Second, nil)
+	expect(240*time.Second, 240*time.Second, map[stun.Method]int{stun.MethodCreatePermission: 1})
+	expect(240*time.Second, 60*time.Second, map[stun.Method]int{stun.MethodCreatePermission: 1})
+
+	// The cached nonce, issued 540s ago, is stale.
+	expect(60*time.Second, 240*time.Second, map[stun.Method]int{stun.MethodRefresh: 1, stun.MethodChannelBind: 1})
+
+	// The permission is rejected and removed.
+	creds.revoke(true)
+	expect(240*time.Second, 300*time.Second, nil)
+	if err := <-errc; err.Method != stun.MethodCreatePermission || !errors.Is(err, stun.ErrUnauthorized) {
+		t.Fatalf("got %v; want %v for %v", err, stun.ErrUnauthorized, stun.MethodCreatePermission)
+	}
+	creds.revoke(false)
+
+	// The allocation expires on the server.
+	sfc.Advance(turn.DefaultLifetime)
+	advance(300 * time.Second)
+	err := <-done
+	var rerr *turn.RefreshError
+	var e *stun.Error
+	if !errors.As(err, &rerr) || rerr.Method != stun.MethodRefresh || !errors.As(err, &e) || e.Code != stun.StatusAllocationMismatch {
+		t.Fatalf("got %v; want %d for %v", err, stun.StatusAllocationMismatch, stun.MethodRefresh)
+	}
+	if cl.RelayedAddr().IsValid() {
+		t.Fatal("allocation remains")
+	}
+}
+
+func TestRefresherShortLifetime(t *testing.T) {
+	fc := newFakeClock()
+	addr := newServer(t, &turn.Server{
+		Nonces: &stun.NonceManager{Now: fc.Now},
+		Clock:  fc,
+	})
+	cl, c := newTestClient(t, addr, "secret")
+	cl.Clock = fc
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := cl.Allocate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lifetime of 600s is shorter than the margin, so the
+	// allocation is refreshed at the half of the lifetime.
+	r := &turn.Refresher{Client: cl, Margin: 700 * time.Second}
+	go r.Run(ctx)
+	for i, d := range []time.Duration{0, 300 * time.Second, 300 * time.Second} {
+		fc.Advance(d)
+		if d := fc.wait(t); d != 300*time.Second {
+			t.Fatalf("#%d: got %v; want 300s", i, d)
+		}
+		if n := c.responseCounts()[stun.MethodRefresh]; n != i {
+			t.Fatalf("#%d: got %d refresh responses; want %d", i, n, i)
+		}
+	}
+}
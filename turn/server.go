@@ -0,0 +1,600 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package turn
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/mikioh/stun"
+	"github.com/mikioh/stun/internal/netutil"
+)
+
+// DefaultMaxLifetime is the default maximum lifetime of allocations
+// as described in RFC 5766 section 6.2.
+const DefaultMaxLifetime = 3600 * time.Second
+
+// channelCooldown is the duration after the expiry of channel binding
+// during which neither the channel number nor the peer can be bound
+// to another as described in RFC 5766 section 11.
+const channelCooldown = 300 * time.Second
+
+// sweepInterval is the interval of removing expired allocations.
+var sweepInterval = time.Second
+
+// A Server represents a TURN server that relays UDP datagrams between
+// clients and peers as described in RFC 5766.
+//
+// The server authenticates requests with the long-term credential
+// mechanism and keeps an allocation table keyed by the 5-tuple of
+// client and server transport addresses. Permissions and channel
+// bindings expire as described in RFC 5766 section 8 and 11.
+type Server struct {
+	// Realm specifies the realm of long-term credentials.
+	Realm string
+
+	// Credentials specifies the store of long-term credentials.
+	Credentials stun.CredentialStore
+
+	// Nonces optionally specifies the nonce manager.
+	// If nil, a nonce manager with a random key and Clock is used.
+	Nonces *stun.NonceManager
+
+	// RelayAddr optionally specifies the IP address of relayed
+	// transport addresses.
+	// If invalid, the IP address of the connection on which the
+	// Allocate request is received is used; it must be set when the
+	// connection is bound to an unspecified address.
+	RelayAddr netip.Addr
+
+	// MaxLifetime specifies the maximum lifetime of allocations.
+	// If zero, DefaultMaxLifetime is used.
+	MaxLifetime time.Duration
+
+	// MaxAllocations specifies the maximum number of allocations.
+	// If zero, there is no limit.
+	MaxAllocations int
+
+	// Clock specifies the source of time for tracking the
+	// lifetimes of allocations, permissions and channel bindings.
+	// If nil, the system clock is used.
+	Clock Clock
+
+	once   sync.Once
+	nonces *stun.NonceManager
+
+	mu     sync.Mutex
+	closed bool
+	stop   chan struct{} // closed on Close to stop the sweeper
+	conns  map[net.PacketConn]struct{}
+	allocs map[fiveTuple]*allocation
+}
+
+// A fiveTuple represents the 5-tuple of UDP transport.
+type fiveTuple struct {
+	client netip.AddrPort
+	server netip.AddrPort
+}
+
+type allocation struct {
+	s        *Server
+	conn     net.PacketConn // connection to client
+	client   net.Addr
+	tuple    fiveTuple
+	relay    net.PacketConn
+	relayed  netip.AddrPort // relayed transport address
+	username string
+	tid      []byte // transaction ID of Allocate request
+	resp     []byte // success response to Allocate request
+
+	mu      sync.Mutex
+	expires time.Time
+	perms   map[netip.Addr]time.Time
+	chans   map[stun.Type]*binding
+	peers   map[netip.AddrPort]*binding
+}
+
+type binding struct {
+	number  stun.Type
+	peer    netip.AddrPort
+	expires time.Time
+}
+
+// Serve serves TURN messages on the datagram connection c such as a
+// UDP connection.
+// It always returns a non-nil error; after Close, the returned error
+// is stun.ErrServerClosed.
+func (s *Server) Serve(c net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return stun.ErrServerClosed
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.PacketConn]struct{})
+		s.allocs = make(map[fiveTuple]*allocation)
+		s.stop = make(chan struct{})
+		go s.sweep(s.stop)
+	}
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+	laddr, err := netutil.UDPAddrPort(c.LocalAddr())
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, stun.MaxMessageSize)
+	var delay netutil.Backoff
+	for {
+		n, from, err := c.ReadFrom(b)
+		if err != nil {
+			if s.isClosed() {
+				return stun.ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			delay.Wait()
+			continue
+		}
+		delay.Reset()
+		raddr, err := netutil.UDPAddrPort(from)
+		if err != nil {
+			continue
+		}
+		_, m, err := stun.ParseMessage(b[:n], nil)
+		if err != nil {
+			continue
+		}
+		tuple := fiveTuple{client: raddr, server: laddr}
+		switch m := m.(type) {
+		case *stun.ChannelData:
+			if a := s.lookup(tuple); a != nil {
+				a.sendChannelData(m)
+			}
+		case *stun.Control:
+			switch m.Type.Class() {
+			case stun.ClassIndication:
+				if a := s.lookup(tuple); a != nil && m.Type.Method() == stun.MethodSend {
+					a.sendIndication(m)
+				}
+			case stun.ClassRequest:
+				r := &stun.Request{Message: m, Network: "udp", LocalAddr: c.LocalAddr(), RemoteAddr: from}
+				if b := s.handle(c, tuple, r); b != nil {
+					c.WriteTo(b, from)
+				}
+			}
+		}
+	}
+}
+
+// Close closes all the connections and allocations of s, and stops
+// the removal of expired allocations.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil && !s.closed {
+		close(s.stop)
+	}
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	for tuple, a := range s.allocs {
+		a.relay.Close()
+		delete(s.allocs, tuple)
+	}
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock.Now()
+	}
+	return time.Now()
+}
+
+func (s *Server) nonceManager() *stun.NonceManager {
+	s.once.Do(func() {
+		s.nonces = s.Nonces
+		if s.nonces == nil {
+			s.nonces = &stun.NonceManager{Now: s.now}
+		}
+	})
+	return s.nonces
+}
+
+// lookup returns the unexpired allocation for the 5-tuple.
+func (s *Server) lookup(tuple fiveTuple) *allocation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.allocs[tuple]
+	if a == nil {
+		return nil
+	}
+	if !a.alive(s.now()) {
+		s.removeLocked(a)
+		return nil
+	}
+	return a
+}
+
+func (s *Server) removeLocked(a *allocation) {
+	if s.allocs[a.tuple] == a {
+		delete(s.allocs, a.tuple)
+	}
+	a.relay.Close()
+}
+
+// sweep removes expired allocations until stop is closed.
+func (s *Server) sweep(stop <-chan struct{}) {
+	t := time.NewTicker(sweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		now := s.now()
+		s.mu.Lock()
+		for _, a := range s.allocs {
+			if !a.alive(now) {
+				s.removeLocked(a)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// handle handles the request r and returns the binary encoding of
+// response.
+func (s *Server) handle(c net.PacketConn, tuple fiveTuple, r *stun.Request) []byte {
+	m := r.Message
+	if resp := stun.UnknownAttrsResponse(m); resp != nil {
+		return marshalResponse(m, resp, nil)
+	}
+	switch m.Type.Method() {
+	case stun.MethodBinding:
+		return marshalResponse(m, stun.BindingResponse(m, tuple.client), nil)
+	case stun.MethodAllocate, stun.MethodRefresh, stun.MethodCreatePermission, stun.MethodChannelBind:
+	default:
+		return marshalResponse(m, stun.ErrorResponse(m, stun.StatusBadRequest), nil)
+	}
+
+	// Authenticate the request as described in RFC 5766 section 4
+	// and RFC 8489 section 9.2.4.
+	nm := s.nonceManager()
+	realm := stun.Realm(s.Realm)
+	if resp := nm.Check(r, realm); resp != nil {
+		return marshalResponse(m, resp, nil)
+	}
+	username, _ := stun.Get[stun.Username](m)
+	var algo int
+	if pa, ok := stun.Get[*stun.PasswordAlgorithm](m); ok {
+		algo = pa.Number
+	}
+	var k stun.Key
+	var err error
+	if s.Credentials == nil {
+		err = stun.ErrUnknownUser
+	} else {
+		k, err = s.Credentials.Key(string(username), s.Realm, algo)
+	}
+	if err != nil || m.VerifyIntegrity(k) != nil {
+		n, err := nm.Nonce(r)
+		if err != nil {
+			return marshalResponse(m, stun.ErrorResponse(m, stun.StatusServerError), nil)
+		}
+		resp := stun.ErrorResponse(m, stun.StatusUnauthorized)
+		resp.Add(realm)
+		resp.Add(n)
+		return marshalResponse(m, resp, nil)
+	}
+
+	a := s.lookup(tuple)
+	if a != nil && a.username != string(username) {
+		return marshalResponse(m, stun.ErrorResponse(m, stun.StatusWrongCredentials), k)
+	}
+	var resp *stun.Control
+	switch m.Type.Method() {
+	case stun.MethodAllocate:
+		if a == nil {
+			return s.allocate(c, tuple, r, string(username), k)
+		}
+		if bytes.Equal(a.tid, m.TID) {
+			return a.resp // retransmitted request
+		}
+		resp = stun.ErrorResponse(m, stun.StatusAllocationMismatch)
+	default:
+		if a == nil {
+			resp = stun.ErrorResponse(m, stun.StatusAllocationMismatch)
+			break
+		}
+		switch m.Type.Method() {
+		case stun.MethodRefresh:
+			resp = s.refresh(a, m)
+		case stun.MethodCreatePermission:
+			resp = a.createPermission(m)
+		default:
+			resp = a.bindChannel(m)
+		}
+	}
+	return marshalResponse(m, resp, k)
+}
+
+// lifetime returns the lifetime of allocation for the LIFETIME
+// attribute of m.
+func (s *Server) lifetime(m *stun.Control) time.Duration {
+	max := s.MaxLifetime
+	if max <= 0 {
+		max = DefaultMaxLifetime
+	}
+	lt := DefaultLifetime
+	if v, ok := stun.Get[stun.Lifetime](m); ok && time.Duration(v) > lt {
+		lt = time.Duration(v)
+	}
+	if lt > max {
+		lt = max
+	}
+	return lt
+}
+
+func (s *Server) allocate(c net.PacketConn, tuple fiveTuple, r *stun.Request, username string, k stun.Key) []byte {
+	m := r.Message
+	rt, ok := stun.Get[*stun.RequestedTransport](m)
+	if !ok {
+		return marshalResponse(m, stun.ErrorResponse(m, stun.StatusBadRequest), k)
+	}
+	if rt.Protocol != protoUDP {
+		return marshalResponse(m, stun.ErrorResponse(m, stun.StatusUnsupportedTransportProtocol), k)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.MaxAllocations > 0 && len(s.allocs) >= s.MaxAllocations {
+		return marshalResponse(m, stun.ErrorResponse(m, stun.StatusAllocationQuotaReached), k)
+	}
+	ip := s.RelayAddr
+	if !ip.IsValid() {
+		ip = tuple.server.Addr()
+	}
+	relay, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)))
+	if err != nil {
+		return marshalResponse(m, stun.ErrorResponse(m, stun.StatusInsufficientCapacity), k)
+	}
+	relayed := netutil.Unmap(relay.LocalAddr().(*net.UDPAddr).AddrPort())
+	lt := s.lifetime(m)
+	resp := &stun.Control{
+		Type: stun.MessageType(stun.ClassSuccessResponse, stun.MethodAllocate),
+		Attrs: []stun.Attribute{
+			stun.XORRelayedAddrPort{AddrPort: relayed},
+			stun.Lifetime(lt),
+			stun.XORMappedAddrPort{AddrPort: tuple.client},
+		},
+	}
+	b := marshalResponse(m, resp, k)
+	if b == nil || s.closed {
+		relay.Close()
+		return nil
+	}
+	a := &allocation{
+		s:        s,
+		conn:     c,
+		client:   r.RemoteAddr,
+		tuple:    tuple,
+		relay:    relay,
+		relayed:  relayed,
+		username: username,
+		tid:      append([]byte(nil), m.TID...),
+		resp:     b,
+		expires:  s.now().Add(lt),
+		perms:    make(map[netip.Addr]time.Time),
+		chans:    make(map[stun.Type]*binding),
+		peers:    make(map[netip.AddrPort]*binding),
+	}
+	s.allocs[tuple] = a
+	go a.relayPeers()
+	return b
+}
+
+func (s *Server) refresh(a *allocation, m *stun.Control) *stun.Control {
+	lt := s.lifetime(m)
+	if v, ok := stun.Get[stun.Lifetime](m); ok && v == 0 {
+		lt = 0
+		s.mu.Lock()
+		s.removeLocked(a)
+		s.mu.Unlock()
+	} else {
+		a.mu.Lock()
+		a.expires = s.now().Add(lt)
+		a.mu.Unlock()
+	}
+	return &stun.Control{
+		Type:  stun.MessageType(stun.ClassSuccessResponse, stun.MethodRefresh),
+		Attrs: []stun.Attribute{stun.Lifetime(lt)},
+	}
+}
+
+// marshalResponse returns the binary encoding of the response resp to
+// the request req.
+// The response is signed with the key k in the same way as req.
+func marshalResponse(req, resp *stun.Control, k stun.Key) []byte {
+	resp.Cookie, resp.TID = req.Cookie, req.TID
+	if k != nil {
+		if stun.Has[stun.MessageIntegritySHA256](req) {
+			resp.Add(stun.MessageIntegritySHA256(nil))
+		} else {
+			resp.Add(stun.MessageIntegrity(nil))
+		}
+	}
+	if !resp.Legacy() {
+		resp.Add(stun.Fingerprint(0))
+	}
+	b, err := resp.AppendMarshal(nil, k)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func (a *allocation) alive(now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return now.Before(a.expires)
+}
+
+func (a *allocation) createPermission(m *stun.Control) *stun.Control {
+	xas := stun.GetAll[*stun.XORPeerAddr](m)
+	if len(xas) == 0 {
+		return stun.ErrorResponse(m, stun.StatusBadRequest)
+	}
+	peers := make([]netip.Addr, 0, len(xas))
+	for _, xa := range xas {
+		peer := (*stun.Addr)(xa).AddrPort().Addr()
+		if peer.Is4() != a.relayed.Addr().Is4() {
+			return stun.ErrorResponse(m, stun.StatusPeerAddressFamilyMismatch)
+		}
+		peers = append(peers, peer)
+	}
+	expires := a.s.now().Add(PermissionLifetime)
+	a.mu.Lock()
+	for _, peer := range peers {
+		a.perms[peer] = expires
+	}
+	a.mu.Unlock()
+	return &stun.Control{Type: stun.MessageType(stun.ClassSuccessResponse, stun.MethodCreatePermission)}
+}
+
+func (a *allocation) bindChannel(m *stun.Control) *stun.Control {
+	cn, ok := stun.Get[*stun.ChannelNumber](m)
+	xa, ok2 := stun.Get[*stun.XORPeerAddr](m)
+	if !ok || !ok2 || cn.Number < minChannel || cn.Number > 0x7fff {
+		return stun.ErrorResponse(m, stun.StatusBadRequest)
+	}
+	peer := (*stun.Addr)(xa).AddrPort()
+	if peer.Addr().Is4() != a.relayed.Addr().Is4() {
+		return stun.ErrorResponse(m, stun.StatusPeerAddressFamilyMismatch)
+	}
+	now := a.s.now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b, ok := a.chans[cn.Number]
+	if ok && b.peer != peer && now.Before(b.expires.Add(channelCooldown)) {
+		return stun.ErrorResponse(m, stun.StatusBadRequest) // bound to another peer
+	}
+	if b, ok := a.peers[peer]; ok && b.number != cn.Number && now.Before(b.expires.Add(channelCooldown)) {
+		return stun.ErrorResponse(m, stun.StatusBadRequest) // bound to another channel
+	}
+	if ok {
+		delete(a.peers, b.peer)
+	}
+	if b, ok := a.peers[peer]; ok {
+		delete(a.chans, b.number)
+	}
+	b = &binding{number: cn.Number, peer: peer, expires: now.Add(ChannelLifetime)}
+	a.chans[cn.Number] = b
+	a.peers[peer] = b
+	a.perms[peer.Addr()] = now.Add(PermissionLifetime)
+	return &stun.Control{Type: stun.MessageType(stun.ClassSuccessResponse, stun.MethodChannelBind)}
+}
+
+// permitted reports whether the permission for the peer is installed
+// and not expired.
+func (a *allocation) permitted(peer netip.Addr, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return now.Before(a.perms[peer])
+}
+
+func (a *allocation) sendIndication(m *stun.Control) {
+	xa, ok := stun.Get[*stun.XORPeerAddr](m)
+	data, ok2 := stun.Get[stun.Data](m)
+	if !ok || !ok2 {
+		return
+	}
+	peer := (*stun.Addr)(xa).AddrPort()
+	if a.permitted(peer.Addr(), a.s.now()) {
+		a.relay.WriteTo(data, net.UDPAddrFromAddrPort(peer))
+	}
+}
+
+func (a *allocation) sendChannelData(m *stun.ChannelData) {
+	now := a.s.now()
+	a.mu.Lock()
+	b, ok := a.chans[m.Number]
+	ok = ok && now.Before(b.expires) && now.Before(a.perms[b.peer.Addr()])
+	a.mu.Unlock()
+	if ok {
+		a.relay.WriteTo(m.Data, net.UDPAddrFromAddrPort(b.peer))
+	}
+}
+
+// relayPeers relays datagrams from permitted peers to the client
+// until the allocation is removed.
+func (a *allocation) relayPeers() {
+	b := make([]byte, 65535)
+	var delay netutil.Backoff
+	for {
+		n, from, err := a.relay.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay.Wait()
+			continue
+		}
+		delay.Reset()
+		peer, err := netutil.UDPAddrPort(from)
+		if err != nil {
+			continue
+		}
+		now := a.s.now()
+		a.mu.Lock()
+		ok := now.Before(a.perms[peer.Addr()])
+		ch, bound := a.peers[peer]
+		bound = bound && now.Before(ch.expires)
+		a.mu.Unlock()
+		if !ok {
+			continue
+		}
+		var m stun.Message
+		if bound {
+			m = &stun.ChannelData{Number: ch.number, Data: b[:n]}
+		} else {
+			tid, err := stun.TransactionID()
+			if err != nil {
+				continue
+			}
+			m = &stun.Control{
+				Type: stun.MessageType(stun.ClassIndication, stun.MethodData),
+				TID:  tid,
+				Attrs: []stun.Attribute{
+					stun.XORPeerAddrPort{AddrPort: peer},
+					stun.Data(b[:n]),
+				},
+			}
+		}
+		wb := make([]byte, m.Len())
+		if _, err := m.Marshal(wb, nil); err != nil {
+			continue
+		}
+		a.conn.WriteTo(wb, a.client)
+	}
+}
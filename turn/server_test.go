@@ -0,0 +1,235 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package turn_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/mikioh/stun"
+	"github.com/mikioh/stun/turn"
+)
+
+func newServer(t *testing.T, s *turn.Server) net.Addr {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Realm == "" {
+		s.Realm = "example.org"
+	}
+	if s.Credentials == nil {
+		s.Credentials = stun.StaticCredentials{"user": "secret", "other": "secret"}
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(c) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; err != stun.ErrServerClosed {
+			t.Errorf("got %v; want %v", err, stun.ErrServerClosed)
+		}
+	})
+	return c.LocalAddr()
+}
+
+func TestServer(t *testing.T) {
+	addr := newServer(t, &turn.Server{})
+	cl, _ := newTestClient(t, addr, "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	relayed, err := cl.Allocate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !relayed.Addr().IsLoopback() || relayed.Port() == addr.(*net.UDPAddr).AddrPort().Port() {
+		t.Fatalf("got %v; want relayed address on loopback", relayed)
+	}
+
+	if err := cl.Refresh(ctx, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// The lifetime shorter than the default is raised to the default.
+	if d := time.Until(cl.Expires()); d <= time.Minute {
+		t.Fatalf("got %v; want %v", d, turn.DefaultLifetime)
+	}
+
+	// The deleted allocation can be created again on the same
+	// 5-tuple.
+	if err := cl.Refresh(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Allocate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cl, _ = newTestClient(t, addr, "wrong")
+	if _, err := cl.Allocate(ctx); !errors.Is(err, stun.ErrUnauthorized) {
+		t.Fatalf("got %v; want %v", err, stun.ErrUnauthorized)
+	}
+}
+
+// newAuthenticator returns a new Authenticator for running raw
+// transactions with the server at addr.
+func newAuthenticator(t *testing.T, addr net.Addr) (*stun.Authenticator, net.PacketConn) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := stun.NewPacketClient(c, addr)
+	sc.RTO = 20 * time.Millisecond
+	t.Cleanup(func() { sc.Close() })
+	return &stun.Authenticator{Transport: sc, Username: "user", Password: "secret"}, c
+}
+
+// errorCode runs the transaction for the request of method with
+// attrs, and returns the STUN error code of the response.
+func errorCode(t *testing.T, auth *stun.Authenticator, method stun.Method, attrs ...stun.Attribute) int {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req := &stun.Control{Type: stun.MessageType(stun.ClassRequest, method), Attrs: attrs}
+	resp, err := auth.Do(ctx, req)
+	if err != nil {
+		t.Fatalf("%v: %v", method, err)
+	}
+	if e, ok := stun.Get[*stun.Error](resp); ok {
+		return e.Code
+	}
+	return 0
+}
+
+func TestServerErrors(t *testing.T) {
+	addr := newServer(t, &turn.Server{MaxAllocations: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	auth, c := newAuthenticator(t, addr)
+
+	p1, peer1 := newPeer(t)
+	_, peer2 := newPeer(t)
+	for _, tt := range []struct {
+		method stun.Method
+		attrs  []stun.Attribute
+		code   int
+	}{
+		{stun.MethodRefresh, nil, stun.StatusAllocationMismatch},
+		{stun.MethodCreatePermission, []stun.Attribute{stun.XORPeerAddrPort{AddrPort: peer1}}, stun.StatusAllocationMismatch},
+		{stun.MethodAllocate, nil, stun.StatusBadRequest},
+		{stun.MethodAllocate, []stun.Attribute{&stun.RequestedTransport{Protocol: 6}}, stun.StatusUnsupportedTransportProtocol},
+		{stun.MethodAllocate, []stun.Attribute{&stun.RequestedTransport{Protocol: 17}}, 0},
+		{stun.MethodAllocate, []stun.Attribute{&stun.RequestedTransport{Protocol: 17}}, stun.StatusAllocationMismatch},
+		{stun.MethodCreatePermission, nil, stun.StatusBadRequest},
+		{stun.MethodCreatePermission, []stun.Attribute{stun.XORPeerAddrPort{AddrPort: netip.MustParseAddrPort("[::1]:1")}}, stun.StatusPeerAddressFamilyMismatch},
+		{stun.MethodChannelBind, []stun.Attribute{&stun.ChannelNumber{Number: 0x3fff}, stun.XORPeerAddrPort{AddrPort: peer1}}, stun.StatusBadRequest},
+		{stun.MethodChannelBind, []stun.Attribute{&stun.ChannelNumber{Number: 0x4000}, stun.XORPeerAddrPort{AddrPort: peer1}}, 0},
+		{stun.MethodChannelBind, []stun.Attribute{&stun.ChannelNumber{Number: 0x4000}, stun.XORPeerAddrPort{AddrPort: peer1}}, 0},
+		{stun.MethodChannelBind, []stun.Attribute{&stun.ChannelNumber{Number: 0x4000}, stun.XORPeerAddrPort{AddrPort: peer2}}, stun.StatusBadRequest},
+		{stun.MethodChannelBind, []stun.Attribute{&stun.ChannelNumber{Number: 0x4001}, stun.XORPeerAddrPort{AddrPort: peer1}}, stun.StatusBadRequest},
+		{stun.MethodRefresh, []stun.Attribute{stun.Lifetime(time.Minute)}, 0},
+	} {
+		if code := errorCode(t, auth, tt.method, tt.attrs...); code != tt.code {
+			t.Fatalf("%v %v: got %d; want %d", tt.method, tt.attrs, code, tt.code)
+		}
+	}
+
+	// The channel data message sent over UDP is not required to be
+	// padded.
+	if _, err := c.WriteTo([]byte("\x40\x00\x00\x05hello"), addr); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := readPeer(t, p1); data != "hello" {
+		t.Fatalf("got %q; want hello", data)
+	}
+
+	// The allocation belongs to the user.
+	other := &stun.Authenticator{Transport: auth.Transport, Username: "other", Password: "secret"}
+	req := &stun.Control{Type: stun.MessageType(stun.ClassRequest, stun.MethodRefresh)}
+	if _, err := other.Do(ctx, req); !errors.Is(err, stun.ErrWrongCredentials) {
+		t.Fatalf("got %v; want %v", err, stun.ErrWrongCredentials)
+	}
+
+	// The number of allocations is limited.
+	cl, _ := newTestClient(t, addr, "secret")
+	var e *stun.Error
+	if _, err := cl.Allocate(ctx); !errors.As(err, &e) || e.Code != stun.StatusAllocationQuotaReached {
+		t.Fatalf("got %v; want %d", err, stun.StatusAllocationQuotaReached)
+	}
+}
+
+func TestServerLifetime(t *testing.T) {
+	fc := newFakeClock()
+	addr := newServer(t, &turn.Server{Clock: fc})
+	cl, _ := newTestClient(t, addr, "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := cl.Allocate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	peer, peerAddr := newPeer(t)
+	if err := cl.CreatePermission(ctx, peerAddr.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The expired permission drops the datagram; requests are
+	// processed in order, so the peer receives the one sent after
+	// the permission is installed again.
+	fc.Advance(turn.PermissionLifetime)
+	if err := cl.SendTo([]byte("dropped"), peerAddr); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.CreatePermission(ctx, peerAddr.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.SendTo([]byte("hello"), peerAddr); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := readPeer(t, peer); data != "hello" {
+		t.Fatalf("got %q; want hello", data)
+	}
+
+	// The expired allocation is removed.
+	fc.Advance(turn.DefaultLifetime)
+	var e *stun.Error
+	if err := cl.Refresh(ctx, time.Minute); !errors.As(err, &e) || e.Code != stun.StatusAllocationMismatch {
+		t.Fatalf("got %v; want %d", err, stun.StatusAllocationMismatch)
+	}
+}
+
+func TestServerChannelCooldown(t *testing.T) {
+	fc := newFakeClock()
+	addr := newServer(t, &turn.Server{Clock: fc})
+	auth, _ := newAuthenticator(t, addr)
+	_, peer1 := newPeer(t)
+	_, peer2 := newPeer(t)
+	bind := func(number stun.Type, peer netip.AddrPort) int {
+		t.Helper()
+		return errorCode(t, auth, stun.MethodChannelBind, &stun.ChannelNumber{Number: number}, stun.XORPeerAddrPort{AddrPort: peer})
+	}
+	if code := errorCode(t, auth, stun.MethodAllocate, &stun.RequestedTransport{Protocol: 17}, stun.Lifetime(turn.DefaultMaxLifetime)); code != 0 {
+		t.Fatalf("got %d; want 0", code)
+	}
+	if code := bind(0x4000, peer1); code != 0 {
+		t.Fatalf("got %d; want 0", code)
+	}
+
+	// Neither the channel number nor the peer of the expired
+	// binding can be bound to another for 5 minutes.
+	fc.Advance(turn.ChannelLifetime)
+	if code := bind(0x4000, peer2); code != stun.StatusBadRequest {
+		t.Fatalf("got %d; want %d", code, stun.StatusBadRequest)
+	}
+	if code := bind(0x4001, peer1); code != stun.StatusBadRequest {
+		t.Fatalf("got %d; want %d", code, stun.StatusBadRequest)
+	}
+	fc.Advance(5 * time.Minute)
+	if code := bind(0x4000, peer2); code != 0 {
+		t.Fatalf("got %d; want 0", code)
+	}
+	if code := bind(0x4001, peer1); code != 0 {
+		t.Fatalf("got %d; want 0", code)
+	}
+}
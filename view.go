@@ -0,0 +1,185 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net/netip"
+)
+
+// A MessageView represents a read-only view of STUN control message
+// over the underlying buffer.
+// Unlike ParseMessage, it never allocates memory for iterating
+// attributes and decodes attribute values only on demand.
+type MessageView struct {
+	b []byte
+}
+
+// NewMessageView returns a view of the STUN control message in b.
+// It validates the message header and the framing of attributes but
+// does not decode attribute values.
+// The view refers to b and b must not be modified while the view is
+// in use.
+func NewMessageView(b []byte) (MessageView, error) {
+	if len(b) < controlHeaderLen {
+		return MessageView{}, &MessageError{Err: errors.New("short message")}
+	}
+	t := Type(binary.BigEndian.Uint16(b[:2]))
+	if b[0]&0xc0 != 0 {
+		return MessageView{}, &MessageError{Type: t, Err: errors.New("invalid header")}
+	}
+	ll := controlHeaderLen + int(binary.BigEndian.Uint16(b[2:4]))
+	if len(b) < ll {
+		return MessageView{}, &MessageError{Type: t, Err: errors.New("short buffer")}
+	}
+	for ab := b[controlHeaderLen:ll]; len(ab) > 0; {
+		at, _, all, err := parseAttrTypeLen(ab)
+		if err != nil {
+			return MessageView{}, &MessageError{Type: t, Err: &AttributeError{Type: at, Err: err}}
+		}
+		ab = ab[all:]
+	}
+	return MessageView{b: b[:ll]}, nil
+}
+
+// Type returns the message type.
+func (v MessageView) Type() Type {
+	return Type(binary.BigEndian.Uint16(v.b[:2]))
+}
+
+// Len returns the length of message including the message header.
+func (v MessageView) Len() int {
+	return len(v.b)
+}
+
+// Cookie returns the magic cookie.
+// It refers to the underlying buffer.
+func (v MessageView) Cookie() []byte {
+	return v.b[4:8]
+}
+
+// TID returns the transaction identifier.
+// It refers to the underlying buffer.
+func (v MessageView) TID() []byte {
+	return v.b[8:controlHeaderLen]
+}
+
+// Attrs returns an iterator over the attributes in the message.
+func (v MessageView) Attrs() AttrIter {
+	return AttrIter{b: v.b, off: controlHeaderLen, tid: v.b[8:controlHeaderLen]}
+}
+
+// Lookup returns the value of the first attribute of the same STUN
+// attribute type as attr.
+// The returned value refers to the underlying buffer.
+func (v MessageView) Lookup(attr Attribute) ([]byte, bool) {
+	t := attrType(attr)
+	for it := v.Attrs(); it.Next(); {
+		if it.Type() == t {
+			return it.Value(), true
+		}
+	}
+	return nil, false
+}
+
+// VerifyFingerprint verifies the FINGERPRINT attribute of the
+// message.
+func (v MessageView) VerifyFingerprint() error {
+	for it := v.Attrs(); it.Next(); {
+		if it.Type() != attrFINGERPRINT {
+			continue
+		}
+		if len(it.Value()) != 4 {
+			return &MessageError{Type: v.Type(), Err: &AttributeError{Type: attrFINGERPRINT, Err: errors.New("short attribute")}}
+		}
+		if crc32.ChecksumIEEE(v.b[:it.off])^crc32XOR != binary.BigEndian.Uint32(it.Value()) {
+			return &MessageError{Type: v.Type(), Err: &AttributeError{Type: attrFINGERPRINT, Err: errors.New("CRC-32 fingerprint mismatch")}}
+		}
+		return nil
+	}
+	return &MessageError{Type: v.Type(), Err: errors.New("no fingerprint")}
+}
+
+// Control returns the message decoded as Control.
+// K must be a valid key when in use of STUN MESSAGE-INTEGRITY or
+// MESSAGE-INTEGRITY-SHA256 attribute.
+func (v MessageView) Control(k Key) (*Control, error) {
+	_, m, err := ParseMessage(v.b, k)
+	if err != nil {
+		return nil, err
+	}
+	return m.(*Control), nil
+}
+
+// An AttrIter represents an iterator over the attributes in
+// MessageView.
+type AttrIter struct {
+	b   []byte
+	tid []byte
+	off int // offset of current attribute
+	nxt int // offset of next attribute
+}
+
+// Next advances the iterator to the next attribute.
+// It returns false when no attributes remain.
+func (it *AttrIter) Next() bool {
+	if it.nxt > 0 {
+		it.off = it.nxt
+	}
+	if it.off >= len(it.b) {
+		return false
+	}
+	_, _, ll, err := parseAttrTypeLen(it.b[it.off:])
+	if err != nil {
+		return false
+	}
+	it.nxt = it.off + ll
+	return true
+}
+
+// Type returns the attribute type of current attribute.
+func (it *AttrIter) Type() int {
+	return int(binary.BigEndian.Uint16(it.b[it.off : it.off+2]))
+}
+
+// Value returns the value of current attribute not including
+// padding bytes.
+// It refers to the underlying buffer.
+func (it *AttrIter) Value() []byte {
+	l := int(binary.BigEndian.Uint16(it.b[it.off+2 : it.off+4]))
+	return it.b[it.off+4 : it.off+4+l]
+}
+
+// Attr decodes current attribute.
+func (it *AttrIter) Attr() (Attribute, error) {
+	t := it.Type()
+	b := it.Value()
+	var attr Attribute
+	var err error
+	if p, ok := attrTypeParser(t); ok {
+		attr, err = p.fn(b, p.min, p.max, it.tid, t, len(b))
+	} else {
+		attr, err = parseDefaultAttr(b, -1, -1, it.tid, t, len(b))
+	}
+	if err != nil {
+		return nil, &AttributeError{Type: t, Err: err}
+	}
+	return attr, nil
+}
+
+// AddrPort decodes current attribute as an address attribute such as
+// XOR-MAPPED-ADDRESS without allocating memory.
+// The on-wire address family is preserved; an IPv6 address family is
+// always decoded as an IPv6 address.
+func (it *AttrIter) AddrPort() (netip.AddrPort, error) {
+	t := it.Type()
+	ap, err := parseAddrPort(it.Value(), it.tid, t)
+	if err != nil {
+		return netip.AddrPort{}, &AttributeError{Type: t, Err: err}
+	}
+	return ap, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun_test
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/mikioh/stun"
+)
+
+func TestMessageView(t *testing.T) {
+	for i, tt := range rfc5769Tests {
+		wire := []byte(tt.wire)
+		v, err := stun.NewMessageView(wire)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		want := tt.msg.(*stun.Control)
+		if v.Type() != want.Type || !bytes.Equal(v.Cookie(), want.Cookie) || !bytes.Equal(v.TID(), want.TID) || v.Len() != len(wire) {
+			t.Fatalf("#%d: got %v, %#v, %#v, %d", i, v.Type(), v.Cookie(), v.TID(), v.Len())
+		}
+		var attrs []stun.Attribute
+		for it := v.Attrs(); it.Next(); {
+			attr, err := it.Attr()
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			attrs = append(attrs, attr)
+		}
+		if !reflect.DeepEqual(attrs, want.Attrs) {
+			t.Fatalf("#%d: got %#v; want %#v", i, attrs, want.Attrs)
+		}
+		if _, ok := want.Attrs[len(want.Attrs)-1].(stun.Fingerprint); ok {
+			if err := v.VerifyFingerprint(); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+		}
+		m, err := v.Control(tt.key)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !controlEqual(m, want) {
+			t.Fatalf("#%d: got %#v; want %#v", i, m, want)
+		}
+	}
+
+	for _, wire := range []string{
+		"\x00\x01\x00",
+		"\x80\x01\x00\x00" + "\x21\x12\xa4\x42" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		"\x00\x01\x00\x08" + "\x21\x12\xa4\x42" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00" + "\x80\x22\x00\x08\x00\x00\x00\x00",
+	} {
+		if _, err := stun.NewMessageView([]byte(wire)); err == nil {
+			t.Errorf("%#v: got nil; want error", wire)
+		}
+	}
+}
+
+func TestMessageViewAllocs(t *testing.T) {
+	wire := []byte(rfc5769Tests[0].wire)
+	allocs := testing.AllocsPerRun(100, func() {
+		v, err := stun.NewMessageView(wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for it := v.Attrs(); it.Next(); {
+			_ = it.Type()
+			_ = it.Value()
+		}
+		if _, ok := v.Lookup(stun.Software("")); !ok {
+			t.Fatal("no SOFTWARE attribute")
+		}
+		if err := v.VerifyFingerprint(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("got %v allocs; want 0", allocs)
+	}
+}
+
+func TestAttrIterAddrPort(t *testing.T) {
+	wire := []byte(rfc5769Tests[1].wire) // sample IPv4 response
+	v, err := stun.NewMessageView(wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := netip.MustParseAddrPort("192.0.2.1:32853")
+	var got netip.AddrPort
+	allocs := testing.AllocsPerRun(100, func() {
+		for it := v.Attrs(); it.Next(); {
+			if it.Type() != 0x0020 { // XOR-MAPPED-ADDRESS
+				continue
+			}
+			got, err = it.AddrPort()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if got != want {
+		t.Fatalf("got %v; want %v", got, want)
+	}
+	if allocs != 0 {
+		t.Fatalf("got %v allocs; want 0", allocs)
+	}
+
+	it := v.Attrs()
+	it.Next() // SOFTWARE
+	if _, err := it.AddrPort(); err == nil {
+		t.Fatal("got nil; want error")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun_test
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/mikioh/stun"
+)
+
+// xorAddrTID is the transaction ID used in RFC 5769 section 2.2 and
+// 2.3.
+const xorAddrTID = "\xb7\xe7\xa7\x01\xbc\x34\xd6\x86\xfa\x87\xdf\xae"
+
+var xorAddrTests = []struct {
+	attr     stun.Attribute // parsed without FlagAddrPort
+	addrPort stun.Attribute // parsed with FlagAddrPort
+	wire     string
+}{
+	{
+		&stun.XORPeerAddr{Port: 32853, IP: net.ParseIP("192.0.2.1")},
+		stun.XORPeerAddrPort{AddrPort: netip.MustParseAddrPort("192.0.2.1:32853")},
+		"\x00\x12\x00\x08\x00\x01\xa1\x47\xe1\x12\xa6\x43",
+	},
+	{
+		&stun.XORPeerAddr{Port: 32853, IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677")},
+		stun.XORPeerAddrPort{AddrPort: netip.MustParseAddrPort("[2001:db8:1234:5678:11:2233:4455:6677]:32853")},
+		"\x00\x12\x00\x14\x00\x02\xa1\x47" +
+			"\x01\x13\xa9\xfa\xa5\xd3\xf1\x79\xbc\x25\xf4\xb5\xbe\xd2\xb9\xd9",
+	},
+	{
+		&stun.XORRelayedAddr{Port: 32853, IP: net.ParseIP("192.0.2.1")},
+		stun.XORRelayedAddrPort{AddrPort: netip.MustParseAddrPort("192.0.2.1:32853")},
+		"\x00\x16\x00\x08\x00\x01\xa1\x47\xe1\x12\xa6\x43",
+	},
+	{
+		&stun.XORRelayedAddr{Port: 32853, IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677")},
+		stun.XORRelayedAddrPort{AddrPort: netip.MustParseAddrPort("[2001:db8:1234:5678:11:2233:4455:6677]:32853")},
+		"\x00\x16\x00\x14\x00\x02\xa1\x47" +
+			"\x01\x13\xa9\xfa\xa5\xd3\xf1\x79\xbc\x25\xf4\xb5\xbe\xd2\xb9\xd9",
+	},
+	{
+		&stun.XORMappedAddr{Port: 32853, IP: net.ParseIP("192.0.2.1")},
+		stun.XORMappedAddrPort{AddrPort: netip.MustParseAddrPort("192.0.2.1:32853")},
+		"\x00\x20\x00\x08\x00\x01\xa1\x47\xe1\x12\xa6\x43", // RFC 5769 section 2.2
+	},
+	{
+		&stun.XORMappedAddr{Port: 32853, IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677")},
+		stun.XORMappedAddrPort{AddrPort: netip.MustParseAddrPort("[2001:db8:1234:5678:11:2233:4455:6677]:32853")},
+		"\x00\x20\x00\x14\x00\x02\xa1\x47" + // RFC 5769 section 2.3
+			"\x01\x13\xa9\xfa\xa5\xd3\xf1\x79\xbc\x25\xf4\xb5\xbe\xd2\xb9\xd9",
+	},
+	{
+		nil, // IPv4-mapped IPv6 address is not representable
+		stun.XORMappedAddrPort{AddrPort: netip.MustParseAddrPort("[::ffff:192.0.2.1]:32853")},
+		"\x00\x20\x00\x14\x00\x02\xa1\x47" +
+			"\x21\x12\xa4\x42\xb7\xe7\xa7\x01\xbc\x34\x29\x79\x3a\x87\xdd\xaf",
+	},
+}
+
+func TestXORAddrConformance(t *testing.T) {
+	for i, tt := range xorAddrTests {
+		wire := "\x01\x01" + string([]byte{0, byte(len(tt.wire))}) + "\x21\x12\xa4\x42" + xorAddrTID + tt.wire
+		for _, attr := range []stun.Attribute{tt.attr, tt.addrPort} {
+			if attr == nil {
+				continue
+			}
+			m := &stun.Control{
+				Type:   stun.MessageType(stun.ClassSuccessResponse, stun.MethodBinding),
+				Cookie: stun.MagicCookie,
+				TID:    []byte(xorAddrTID),
+				Attrs:  []stun.Attribute{attr},
+			}
+			b, err := m.MarshalBinary()
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			if !bytes.Equal(b, []byte(wire)) {
+				t.Errorf("#%d: %T: got %#v; want %#v", i, attr, string(b), wire)
+			}
+		}
+
+		if tt.attr != nil {
+			_, m, err := stun.ParseMessage([]byte(wire), nil)
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+			if attrs := m.(*stun.Control).Attrs; !reflect.DeepEqual(attrs, []stun.Attribute{tt.attr}) {
+				t.Errorf("#%d: got %#v; want %#v", i, attrs[0], tt.attr)
+			}
+		}
+		_, m, err := stun.ParseMessageFlags([]byte(wire), nil, stun.FlagAddrPort)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if attrs := m.(*stun.Control).Attrs; !reflect.DeepEqual(attrs, []stun.Attribute{tt.addrPort}) {
+			t.Errorf("#%d: got %#v; want %#v", i, attrs[0], tt.addrPort)
+		}
+		v, err := stun.NewMessageView([]byte(wire))
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		it := v.Attrs()
+		it.Next()
+		ap, err := it.AddrPort()
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if want := reflect.ValueOf(tt.addrPort).Field(0).Interface().(netip.AddrPort); ap != want {
+			t.Errorf("#%d: got %v; want %v", i, ap, want)
+		}
+	}
+}